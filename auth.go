@@ -0,0 +1,377 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/google/logger"
+)
+
+/*
+API tokens, loaded from a JSON file (see LoadTokens):
+
+	{
+	  "tokens": [
+	    {"name": "admin", "token": "...", "scope": "readwrite"},
+	    {"name": "indexer", "token": "...", "scope": "read", "namespaces": ["words"], "prefixes": ["en/"]},
+	    {"name": "warehouse", "subject": "CN=warehouse,O=Example", "scope": "read"}
+	  ]
+	}
+
+A "read" token may only run read-only commands; a "readwrite" token may run any command.
+A token with namespaces may only use those namespaces (an alias stands for the namespace it
+currently points at), and a token with prefixes may only touch keys that start with one of
+them. Commands that can't be narrowed to those keys, such as listing every key, and the
+commands that manage namespaces, need a token without either limit.
+
+HTTP clients send their token as "Authorization: Bearer [TOKEN]". Browsers can't set
+headers on WebSocket connections or EventSources, so the token may also be passed as
+an `access_token` query parameter. RESP clients use AUTH, and binary clients the "auth" op.
+
+When the server verifies client certificates (see tls.go), a token may instead name the
+subject of a certificate, either in full or by its common name. Clients presenting that
+certificate are given the token without sending a secret. A secret sent explicitly wins.
+
+Requests without a known token fail with ERR_CODE_UNAUTHORIZED, and requests their token
+doesn't allow with ERR_CODE_FORBIDDEN.
+*/
+const (
+	AUTH_SCOPE_READ      = "read"
+	AUTH_SCOPE_READWRITE = "readwrite"
+)
+
+/*
+A Token is an API key and what it is allowed to do.
+*/
+type Token struct {
+	// Name identifies the token in logs; it is not secret
+	Name   string `json:"name"`
+	Secret string `json:"token"`
+	// Subject is the subject of the client certificates that are given this token
+	Subject    string   `json:"subject"`
+	Scope      string   `json:"scope"`
+	Namespaces []string `json:"namespaces"`
+	Prefixes   []string `json:"prefixes"`
+}
+
+/*
+A TokenSet holds the tokens a server accepts.
+*/
+type TokenSet struct {
+	// tokens are keyed by the SHA-256 of their secret, so that looking a secret up
+	// takes the same time however much of it matches a real one
+	tokens map[[sha256.Size]byte]*Token
+	// bySubject holds the tokens given to client certificates
+	bySubject map[string]*Token
+}
+
+// The format of the token file
+type tokenFile struct {
+	Tokens []*Token `json:"tokens"`
+}
+
+/*
+LoadTokens reads a token file.
+*/
+func LoadTokens(path string) (*TokenSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file tokenFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	set := &TokenSet{
+		tokens:    make(map[[sha256.Size]byte]*Token),
+		bySubject: make(map[string]*Token),
+	}
+	for i, token := range file.Tokens {
+		if token.Secret == "" && token.Subject == "" {
+			return nil, fmt.Errorf("token %d (%q) has neither a secret nor a subject", i, token.Name)
+		}
+		if token.Scope != AUTH_SCOPE_READ && token.Scope != AUTH_SCOPE_READWRITE {
+			return nil, fmt.Errorf("token %d (%q) must have scope %q or %q", i, token.Name, AUTH_SCOPE_READ, AUTH_SCOPE_READWRITE)
+		}
+
+		if token.Subject != "" {
+			if _, ok := set.bySubject[token.Subject]; ok {
+				return nil, fmt.Errorf("token %d (%q) has the same subject as another", i, token.Name)
+			}
+			set.bySubject[token.Subject] = token
+		}
+
+		if token.Secret != "" {
+			hash := sha256.Sum256([]byte(token.Secret))
+			if _, ok := set.tokens[hash]; ok {
+				return nil, fmt.Errorf("token %d (%q) is listed twice", i, token.Name)
+			}
+			set.tokens[hash] = token
+		}
+	}
+
+	return set, nil
+}
+
+/*
+Lookup finds the token with the given secret.
+*/
+func (t *TokenSet) Lookup(secret string) (*Token, error) {
+	if secret == "" {
+		return nil, &CodedError{Code: ERR_CODE_UNAUTHORIZED, Message: "a token is required"}
+	}
+
+	token, ok := t.tokens[sha256.Sum256([]byte(secret))]
+	if !ok {
+		return nil, &CodedError{Code: ERR_CODE_UNAUTHORIZED, Message: "invalid token"}
+	}
+	return token, nil
+}
+
+/*
+LookupSubject finds the token given to a client certificate, by its full subject
+or by its common name.
+*/
+func (t *TokenSet) LookupSubject(certificate *x509.Certificate) (*Token, error) {
+	if token, ok := t.bySubject[certificate.Subject.String()]; ok {
+		return token, nil
+	}
+	if token, ok := t.bySubject[certificate.Subject.CommonName]; ok && certificate.Subject.CommonName != "" {
+		return token, nil
+	}
+	return nil, &CodedError{
+		Code:    ERR_CODE_UNAUTHORIZED,
+		Message: fmt.Sprintf("no token for certificate %q", certificate.Subject.String()),
+	}
+}
+
+/*
+Authorize checks that a token allows running a command in a dispatcher's namespace.
+A nil token allows everything; it stands for callers inside the server, and for every
+caller when authentication is disabled.
+*/
+func (t *Token) Authorize(dispatcher *ThreadSafeDispatcher, command *Command, args interface{}) error {
+	if t == nil {
+		return nil
+	}
+
+	if !command.ReadOnly && t.Scope != AUTH_SCOPE_READWRITE {
+		return t.forbidden("is read-only")
+	}
+
+	if command.Unlocked {
+		// Commands that manage the server aren't tied to a namespace or to keys
+		return t.AuthorizeAdmin("run "+command.Name, command.ReadOnly)
+	}
+
+	if !t.allowsNamespace(dispatcher) {
+		return t.forbidden(fmt.Sprintf("can't use namespace %q", dispatcher.name))
+	}
+
+	if len(t.Prefixes) == 0 {
+		return nil
+	}
+
+	var keys []string
+	switch args := args.(type) {
+	case keyedArgs:
+		keys = []string{args.primaryKey()}
+	case *batchArgs:
+		keys = args.Keys
+	case *keyListArgs:
+		keys = args.Keys
+	case *helloArgs:
+		// Negotiating a protocol version doesn't touch any key
+	default:
+		return t.forbidden("is limited to some keys, so it can't run " + command.Name)
+	}
+
+	for _, key := range keys {
+		if !t.allowsKey(key) {
+			return t.forbidden(fmt.Sprintf("can't use key %q", key))
+		}
+	}
+	return nil
+}
+
+/*
+AuthorizeAdmin checks that a token may manage the server, which takes a token without
+namespace or prefix limits, and with the readwrite scope unless the action is read-only.
+*/
+func (t *Token) AuthorizeAdmin(action string, readOnly bool) error {
+	if t == nil {
+		return nil
+	}
+
+	if !readOnly && t.Scope != AUTH_SCOPE_READWRITE {
+		return t.forbidden("is read-only")
+	}
+	if len(t.Namespaces) > 0 || len(t.Prefixes) > 0 {
+		return t.forbidden("is limited to some namespaces or keys, so it can't " + action)
+	}
+	return nil
+}
+
+/*
+AuthorizeSubscription checks that a token allows following changes to keys with the
+given prefixes in a dispatcher's namespace.
+*/
+func (t *Token) AuthorizeSubscription(dispatcher *ThreadSafeDispatcher, prefixes []string) error {
+	if t == nil {
+		return nil
+	}
+
+	if !t.allowsNamespace(dispatcher) {
+		return t.forbidden(fmt.Sprintf("can't use namespace %q", dispatcher.name))
+	}
+	for _, prefix := range prefixes {
+		if !t.allowsKey(prefix) {
+			return t.forbidden(fmt.Sprintf("can't follow prefix %q", prefix))
+		}
+	}
+	return nil
+}
+
+// Returns whether the token may use a dispatcher's namespace
+func (t *Token) allowsNamespace(dispatcher *ThreadSafeDispatcher) bool {
+	if len(t.Namespaces) == 0 {
+		return true
+	}
+
+	for _, name := range t.Namespaces {
+		if name == dispatcher.name {
+			return true
+		}
+		// The name may be an alias of the namespace
+		if dispatcher.namespaces != nil {
+			if target, err := dispatcher.namespaces.Get(name); err == nil && target == dispatcher {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns whether the token may use a key, or every key with a prefix
+func (t *Token) allowsKey(key string) bool {
+	if len(t.Prefixes) == 0 {
+		return true
+	}
+
+	for _, prefix := range t.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Token) forbidden(reason string) error {
+	return &CodedError{Code: ERR_CODE_FORBIDDEN, Message: fmt.Sprintf("token %q %s", t.Name, reason)}
+}
+
+/*
+Finds the token of an HTTP request. Both results are nil if authentication is disabled.
+*/
+func (s *Server) authenticate(r *http.Request) (*Token, error) {
+	if s.tokens == nil {
+		return certificateIdentity(r.TLS), nil
+	}
+
+	secret := r.URL.Query().Get("access_token")
+	if header := r.Header.Get("Authorization"); header != "" {
+		const bearer = "Bearer "
+		if !strings.HasPrefix(header, bearer) {
+			return nil, &CodedError{Code: ERR_CODE_UNAUTHORIZED, Message: "the Authorization header must hold a bearer token"}
+		}
+		secret = strings.TrimPrefix(header, bearer)
+	}
+
+	if secret == "" {
+		if certificate := clientCertificate(r.TLS); certificate != nil {
+			return s.tokens.LookupSubject(certificate)
+		}
+	}
+
+	return s.tokens.Lookup(secret)
+}
+
+/*
+Finds the token of a connection from its client certificate, before it sends anything.
+The token is nil if the connection has no verified certificate, or none with a token.
+It only fails if the TLS handshake does.
+*/
+func (s *Server) authenticateConn(conn net.Conn) (*Token, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, err
+	}
+
+	state := tlsConn.ConnectionState()
+	if s.tokens == nil {
+		return certificateIdentity(&state), nil
+	}
+	if certificate := clientCertificate(&state); certificate != nil {
+		token, err := s.tokens.LookupSubject(certificate)
+		if err != nil {
+			// The connection may still authenticate with a secret
+			logger.Infof("%v", err)
+		}
+		return token, nil
+	}
+	return nil, nil
+}
+
+// Returns the verified client certificate of a TLS connection, if any
+func clientCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+/*
+Without API tokens, a client certificate still identifies the client in the logs,
+through a token that allows everything.
+*/
+func certificateIdentity(state *tls.ConnectionState) *Token {
+	certificate := clientCertificate(state)
+	if certificate == nil {
+		return nil
+	}
+	return &Token{Name: certificate.Subject.String(), Scope: AUTH_SCOPE_READWRITE}
+}
+
+/*
+Finds the token of a connection that authenticates with a command (RESP and binary).
+Connections start without one, so they are refused until they authenticate, unless
+authentication is disabled.
+*/
+func (s *Server) authenticateSecret(secret string) (*Token, error) {
+	if s.tokens == nil {
+		return nil, &CodedError{Code: ERR_CODE_INVALID, Message: "authentication is disabled"}
+	}
+	return s.tokens.Lookup(secret)
+}
+
+/*
+Returns an error if a connection that hasn't authenticated must do so first.
+*/
+func (s *Server) requireToken(token *Token) error {
+	if s.tokens != nil && token == nil {
+		return &CodedError{Code: ERR_CODE_UNAUTHORIZED, Message: "authentication required"}
+	}
+	return nil
+}
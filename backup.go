@@ -0,0 +1,428 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/logger"
+)
+
+/*
+Backups can be taken and restored over HTTP, without access to the server's disk:
+
+	GET  /admin/backup[?namespace=NAME]   download a backup
+	POST /admin/restore[?namespace=NAME]  upload a backup, replacing the namespaces in it
+
+A backup is a tar archive holding one snapshot (see snapshot.go) per namespace, named
+[NAMESPACE].snap. Each namespace's snapshot is consistent on its own; namespaces are
+saved one after the other. Aliases and dictionary namespaces aren't included.
+
+A restore accepts such an archive, or a single snapshot if a namespace is given. Every
+snapshot is checked before anything is replaced, and each namespace's trie is swapped
+for the restored one at once, so requests see either the old keys or the new ones.
+Namespaces that don't exist are created. The restore is recorded as a "load" change at
+a new revision, so clients following the namespace know to reload it.
+
+Taking a backup needs a token without namespace or prefix limits; restoring one needs
+such a token with the readwrite scope.
+*/
+const BACKUP_CONTENT_TYPE = "application/x-tar"
+
+// The largest backup a restore accepts
+const BACKUP_MAX_RESTORE_BYTES = 1 << 30
+
+// How many times a load is tried while changes go on, the last time holding the write lock
+const LOAD_ATTEMPTS = 3
+
+/*
+RestoreResult describes a namespace replaced by a restore.
+*/
+type RestoreResult struct {
+	Namespace string `json:"namespace"`
+	// Revision is the revision of the "load" change
+	Revision uint64 `json:"revision"`
+	Keys     int    `json:"keys"`
+}
+
+/*
+HandleBackup serves GET /admin/backup, a backup of one namespace or all of them.
+*/
+func (s *Server) HandleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, err := s.authenticate(r)
+	if err == nil {
+		err = token.AuthorizeAdmin("take backups", true)
+	}
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	names := s.namespaces.Names()
+	if namespace := requestNamespace(r); namespace != "" {
+		dispatcher, err := s.namespaces.Get(namespace)
+		if err == nil && dispatcher.dictionary != nil {
+			err = &CodedError{Code: ERR_CODE_INVALID, Message: fmt.Sprintf("namespace %q is a dictionary, whose file is its backup", namespace)}
+		}
+		if err != nil {
+			writeRESTError(w, err)
+			return
+		}
+		names = []string{dispatcher.name}
+	}
+
+	now := time.Now()
+	w.Header().Set("Content-Type", BACKUP_CONTENT_TYPE)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="trie-backup-%s.tar"`, now.UTC().Format("20060102T150405Z")))
+	w.WriteHeader(http.StatusOK)
+
+	archive := tar.NewWriter(w)
+	for _, name := range names {
+		dispatcher, err := s.namespaces.Get(name)
+		if err != nil || dispatcher.dictionary != nil {
+			// Dropped since it was listed, or a dictionary
+			continue
+		}
+
+		// The lock is only held while encoding, not while sending
+		snapshot := dispatcher.EncodeSnapshot()
+
+		header := &tar.Header{Name: name + SNAPSHOT_SUFFIX, Mode: 0660, Size: int64(len(snapshot)), ModTime: now}
+		if err := archive.WriteHeader(header); err != nil {
+			logger.Errorf("Error sending backup: %v", err)
+			return
+		}
+		if _, err := archive.Write(snapshot); err != nil {
+			logger.Errorf("Error sending backup: %v", err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		logger.Errorf("Error sending backup: %v", err)
+		return
+	}
+
+	logger.Infof("sent a backup of namespaces %v", names)
+}
+
+/*
+HandleRestore serves POST /admin/restore, which replaces namespaces with the ones in a backup.
+*/
+func (s *Server) HandleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, err := s.authenticate(r)
+	if err == nil {
+		err = token.AuthorizeAdmin("restore backups", false)
+	}
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	tries, err := readBackup(http.MaxBytesReader(w, r.Body, BACKUP_MAX_RESTORE_BYTES), requestNamespace(r))
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	results := make([]RestoreResult, 0, len(tries))
+	for _, name := range sortedTrieNames(tries) {
+		result, err := s.namespaces.Load(name, tries[name])
+		if err != nil {
+			writeRESTError(w, err)
+			return
+		}
+		results = append(results, result)
+	}
+
+	writeRESTJSON(w, http.StatusOK, results)
+}
+
+/*
+Reads the snapshots in a backup, by namespace. A single snapshot is restored into
+the given namespace. Every snapshot is read and checked before this returns.
+*/
+func readBackup(body io.Reader, namespace string) (map[string]*Trie, error) {
+	reader := bufio.NewReader(body)
+	tries := make(map[string]*Trie)
+
+	if magic, _ := reader.Peek(len(SNAPSHOT_MAGIC)); string(magic) == SNAPSHOT_MAGIC {
+		if namespace == "" {
+			return nil, &CodedError{Code: ERR_CODE_INVALID, Message: "restoring a single snapshot needs a namespace"}
+		}
+		trie, err := ReadSnapshot(reader)
+		if err != nil {
+			return nil, &CodedError{Code: ERR_CODE_INVALID, Message: "invalid snapshot: " + err.Error()}
+		}
+		tries[namespace] = trie
+		return tries, nil
+	}
+
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &CodedError{Code: ERR_CODE_INVALID, Message: "invalid backup archive: " + err.Error()}
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := strings.TrimSuffix(header.Name, SNAPSHOT_SUFFIX)
+		if name == header.Name || validateNamespaceName(name) != nil {
+			return nil, &CodedError{Code: ERR_CODE_INVALID, Message: fmt.Sprintf("unexpected file %q in backup", header.Name)}
+		}
+		if namespace != "" && name != namespace {
+			continue
+		}
+
+		trie, err := ReadSnapshot(archive)
+		if err != nil {
+			return nil, &CodedError{Code: ERR_CODE_INVALID, Message: fmt.Sprintf("invalid snapshot of namespace %q: %v", name, err)}
+		}
+		tries[name] = trie
+	}
+
+	if len(tries) == 0 {
+		return nil, &CodedError{Code: ERR_CODE_INVALID, Message: "the backup has no snapshot to restore"}
+	}
+	return tries, nil
+}
+
+func sortedTrieNames(tries map[string]*Trie) []string {
+	names := make([]string, 0, len(tries))
+	for name := range tries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+EncodeSnapshot returns a snapshot of the trie, encoded in memory. Changes wait while
+it is encoded.
+*/
+func (s *ThreadSafeDispatcher) EncodeSnapshot() []byte {
+	s.dispatcherMutex.RLock()
+	defer s.dispatcherMutex.RUnlock()
+
+	var buffer bytes.Buffer
+	// Writing to memory never fails
+	WriteSnapshot(&buffer, s.trie)
+	return buffer.Bytes()
+}
+
+/*
+Load replaces the trie with another, such as one restored from a backup. The keys keep
+their versions, and the change is recorded as a "load" at a revision after both tries'
+clocks. The new trie's snapshot is written before the write lock is taken, and only put
+in place while the load is recorded, so that a restart never finds the snapshot of a
+load that failed, and the write-ahead log can be replayed on top of it.
+*/
+func (s *ThreadSafeDispatcher) Load(trie *Trie) (RestoreResult, error) {
+	clock := trie.Clock
+	return s.loadWith(func(uint64) *Trie {
+		// An earlier attempt may have moved the clock on
+		trie.Clock = clock
+		return trie
+	})
+}
+
+/*
+Loads the trie returned by `build`, which is given the current clock. The trie is built
+and its snapshot written while changes go on; if one was made meanwhile, the load is
+tried again, and the last attempt holds the write lock throughout.
+*/
+func (s *ThreadSafeDispatcher) loadWith(build func(clock uint64) *Trie) (RestoreResult, error) {
+	if s.dictionary != nil {
+		return RestoreResult{}, s.readOnlyError()
+	}
+
+	for attempt := 1; attempt < LOAD_ATTEMPTS; attempt++ {
+		s.dispatcherMutex.RLock()
+		clock := s.trie.Clock
+		trie := build(clock)
+		s.dispatcherMutex.RUnlock()
+
+		trie.Clock = loadRevision(clock, trie.Clock)
+		snapshot, err := s.prepareSnapshot(trie)
+		if err != nil {
+			return RestoreResult{}, err
+		}
+
+		var result RestoreResult
+		retry := false
+		position, failed := s.change(func() {
+			if s.trie.Clock != clock {
+				retry = true
+				return
+			}
+			result, err = s.load(trie, snapshot)
+		})
+		if failed != nil || retry {
+			discardSnapshot(snapshot)
+		}
+		if failed != nil {
+			return RestoreResult{}, failed
+		}
+		if !retry {
+			if err := s.finishLoad(err, position, snapshot, result.Revision); err != nil {
+				return RestoreResult{}, err
+			}
+			return result, nil
+		}
+	}
+
+	var result RestoreResult
+	var snapshot *PendingSnapshot
+	var err error
+	position, failed := s.change(func() {
+		trie := build(s.trie.Clock)
+		trie.Clock = loadRevision(s.trie.Clock, trie.Clock)
+		if snapshot, err = s.prepareSnapshot(trie); err != nil {
+			return
+		}
+		result, err = s.load(trie, snapshot)
+	})
+	if failed != nil {
+		return RestoreResult{}, failed
+	}
+	if err := s.finishLoad(err, position, snapshot, result.Revision); err != nil {
+		return RestoreResult{}, err
+	}
+	return result, nil
+}
+
+// The revision of a "load" of a trie whose clock is `loaded` into one whose clock is `clock`
+func loadRevision(clock uint64, loaded uint64) uint64 {
+	if loaded > clock {
+		clock = loaded
+	}
+	return clock + 1
+}
+
+// Swaps in a trie, whose clock is the revision of the load. The caller must hold the write lock.
+func (s *ThreadSafeDispatcher) load(trie *Trie, snapshot *PendingSnapshot) (RestoreResult, error) {
+	if err := s.recordLoad(trie.Clock, trie.Clock, snapshot); err != nil {
+		return RestoreResult{}, err
+	}
+	s.restore(trie)
+
+	keys := s.trie.Size()
+	logger.Infof("loaded %d keys into namespace %s at revision %d", keys, s.name, trie.Clock)
+	return RestoreResult{Namespace: s.name, Revision: trie.Clock, Keys: keys}, nil
+}
+
+// Writes the snapshot a load puts in place, if the namespace keeps snapshots
+func (s *ThreadSafeDispatcher) prepareSnapshot(trie *Trie) (*PendingSnapshot, error) {
+	if s.snapshots == nil {
+		return nil, nil
+	}
+	return s.snapshots.Prepare(trie)
+}
+
+func discardSnapshot(snapshot *PendingSnapshot) {
+	if snapshot == nil {
+		return
+	}
+	if err := snapshot.Discard(); err != nil {
+		logger.Errorf("Error deleting snapshot: %v", err)
+	}
+}
+
+/*
+Records a load at `revision`, starting a write-ahead log file at `walRevision`. The load's
+snapshot is put in place first, so that the log is never replayed onto an older trie,
+and deleted again if the load can't be recorded; if that fails too, the namespace is
+stopped, since a restart would load the snapshot. The caller must hold the write lock,
+and swaps in the trie once this returns.
+*/
+func (s *ThreadSafeDispatcher) recordLoad(revision uint64, walRevision uint64, snapshot *PendingSnapshot) error {
+	if snapshot != nil {
+		if err := snapshot.Install(); err != nil {
+			discardSnapshot(snapshot)
+			return err
+		}
+	}
+
+	// A crash from here on leaves the snapshot newer than every record before the load
+	var err error
+	if s.wal != nil {
+		err = s.wal.Rotate(walRevision)
+	}
+	if err == nil {
+		err = s.trie.notify(CHANGE_LOAD, "", revision)
+	}
+	if err != nil {
+		if snapshot != nil {
+			if discardErr := snapshot.Discard(); discardErr != nil {
+				s.stop(discardErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+/*
+Makes a load durable, then keeps its snapshot and deletes the write-ahead log files it
+replaces. If the load can't be made durable, its snapshot is deleted, so that a restart
+replays the log instead.
+*/
+func (s *ThreadSafeDispatcher) finishLoad(err error, position uint64, snapshot *PendingSnapshot, walRevision uint64) error {
+	if err != nil {
+		return err
+	}
+	if err := s.commit(position); err != nil {
+		discardSnapshot(snapshot)
+		return err
+	}
+	if snapshot != nil {
+		snapshot.Keep()
+	}
+
+	if s.wal != nil {
+		// The snapshot holds everything in the older files now
+		if _, err := s.wal.RemoveBefore(walRevision); err != nil {
+			logger.Errorf("Error deleting write-ahead log files: %v", err)
+		}
+	}
+	return nil
+}
+
+/*
+Load replaces a namespace's trie with another, creating the namespace if needed.
+*/
+func (n *Namespaces) Load(name string, trie *Trie) (RestoreResult, error) {
+	if n.replication.IsReplica() {
+		return RestoreResult{}, n.replication.readOnlyError()
+	}
+
+	dispatcher, err := n.Get(name)
+	if err != nil {
+		if dispatcher, err = n.Create(name); err != nil {
+			return RestoreResult{}, err
+		}
+	}
+	return dispatcher.Load(trie)
+}
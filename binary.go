@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/google/logger"
+)
+
+/*
+A compact, length-prefixed binary protocol for high-throughput callers, served over
+TCP and/or Unix domain sockets. All integers are big-endian.
+
+Request frame:
+
+	uint32  length of the rest of the frame
+	uint8   opcode: a legacy command code, or BINARY_OP_NAMED
+	uint32  request id, echoed in the response
+	uint8   flags (BINARY_FLAG_*)
+	uint16  key length
+	[]byte  key
+	[]byte  payload: the command's other arguments as a JSON object (may be empty)
+
+For commands built around one key (insert, delete, completions, ...) the key is sent
+raw, so it may contain any bytes. For BINARY_OP_NAMED, the key is the command's name
+and the payload holds all of its arguments. A "namespace" member of the payload picks
+the namespace the command runs in.
+
+If the server has API tokens, a connection must first send the named op "auth", with a
+payload of {"token": "..."}, and every request after that is checked against the token.
+
+Response frame:
+
+	uint32  length of the rest of the frame
+	uint8   status (BINARY_STATUS_*)
+	uint32  request id
+	[]byte  the JSON result, or a JSON error object ({"code": ..., "message": ...})
+
+Requests can be pipelined. They are answered in order, and replies are flushed once
+no more requests are waiting.
+*/
+const (
+	// Opcode of requests that name their command instead of using a legacy code
+	BINARY_OP_NAMED = 0xFF
+	// Don't send a response if the request succeeds
+	BINARY_FLAG_QUIET = 1 << 0
+
+	BINARY_STATUS_OK    = 0
+	BINARY_STATUS_ERROR = 1
+
+	// Size of the fixed part of a request, after the length
+	BINARY_REQUEST_HEADER_LENGTH = 1 + 4 + 1 + 2
+	// Largest frame a client may send
+	MAX_BINARY_FRAME_LENGTH = 16 << 20
+)
+
+/*
+ServeBinary accepts binary protocol connections on a listener until it fails.
+*/
+func (s *Server) ServeBinary(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handleBinaryConn(conn)
+	}
+}
+
+// A decoded binary request
+type binaryRequest struct {
+	opcode    byte
+	requestID uint32
+	flags     byte
+	key       []byte
+	payload   []byte
+}
+
+func (s *Server) handleBinaryConn(conn net.Conn) {
+	defer conn.Close()
+
+	logger.Infof("received binary connection from %s", conn.RemoteAddr())
+
+	// The token of the client's certificate, or the one set with the "auth" op
+	token, err := s.authenticateConn(conn)
+	if err != nil {
+		logger.Errorf("Error in TLS handshake: %v", err)
+		return
+	}
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	for {
+		request, err := readBinaryRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				logger.Errorf("Error reading binary request: %v", err)
+			}
+			writer.Flush()
+			return
+		}
+
+		var result []byte
+		if request.opcode == BINARY_OP_NAMED && string(request.key) == "auth" {
+			token, err = s.authenticateBinary(request.payload)
+			if err == nil {
+				result = []byte("true")
+			}
+		} else {
+			result, err = s.dispatchBinary(token, request)
+		}
+		if err != nil {
+			logger.Errorf("Error handling binary request: %v", err)
+			errorPayload, _ := json.Marshal(V2Error{Code: ErrorCode(err), Message: ErrorMessage(err)})
+			writeBinaryResponse(writer, BINARY_STATUS_ERROR, request.requestID, errorPayload)
+		} else if request.flags&BINARY_FLAG_QUIET == 0 {
+			writeBinaryResponse(writer, BINARY_STATUS_OK, request.requestID, result)
+		}
+
+		// Flush once the client has no more pipelined requests waiting
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				logger.Errorf("Error writing binary response: %v", err)
+				return
+			}
+		}
+	}
+}
+
+/*
+Reads and decodes one request frame.
+*/
+func readBinaryRequest(reader *bufio.Reader) (*binaryRequest, error) {
+	var length uint32
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length < BINARY_REQUEST_HEADER_LENGTH || length > MAX_BINARY_FRAME_LENGTH {
+		return nil, fmt.Errorf("invalid frame length %d", length)
+	}
+
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(reader, frame); err != nil {
+		return nil, err
+	}
+
+	keyLength := int(binary.BigEndian.Uint16(frame[6:8]))
+	if BINARY_REQUEST_HEADER_LENGTH+keyLength > len(frame) {
+		return nil, fmt.Errorf("key length %d overruns frame", keyLength)
+	}
+
+	keyEnd := BINARY_REQUEST_HEADER_LENGTH + keyLength
+	return &binaryRequest{
+		opcode:    frame[0],
+		requestID: binary.BigEndian.Uint32(frame[1:5]),
+		flags:     frame[5],
+		key:       frame[BINARY_REQUEST_HEADER_LENGTH:keyEnd],
+		payload:   frame[keyEnd:],
+	}, nil
+}
+
+/*
+Encodes a response frame.
+*/
+func writeBinaryResponse(writer *bufio.Writer, status byte, requestID uint32, payload []byte) {
+	header := make([]byte, 4+1+4)
+	binary.BigEndian.PutUint32(header[0:4], uint32(1+4+len(payload)))
+	header[4] = status
+	binary.BigEndian.PutUint32(header[5:9], requestID)
+
+	writer.Write(header)
+	writer.Write(payload)
+}
+
+// Arguments of the auth op
+type binaryAuthArgs struct {
+	Token string `json:"token"`
+}
+
+/*
+Finds the token named by the payload of an auth request.
+*/
+func (s *Server) authenticateBinary(payload []byte) (*Token, error) {
+	var args binaryAuthArgs
+	if err := decodeV2Args(payload, &args); err != nil {
+		return nil, err
+	}
+	return s.authenticateSecret(args.Token)
+}
+
+/*
+Runs the command of a binary request, returning its JSON-encoded result.
+*/
+func (s *Server) dispatchBinary(token *Token, request *binaryRequest) ([]byte, error) {
+	if err := s.requireToken(token); err != nil {
+		return nil, err
+	}
+
+	namespace, payload, err := splitNamespaceArg(request.payload)
+	if err != nil {
+		return nil, err
+	}
+	dispatcher, err := s.namespaces.Get(namespace)
+	if err != nil {
+		return nil, err
+	}
+	commands := dispatcher.Commands()
+
+	var command *Command
+	var ok bool
+	if request.opcode == BINARY_OP_NAMED {
+		command, ok = commands.Lookup(string(request.key))
+		if !ok {
+			return nil, &CodedError{Code: ERR_CODE_UNKNOWN_COMMAND, Message: fmt.Sprintf("unknown command %q", request.key)}
+		}
+	} else {
+		command, ok = commands.LookupCode(int(request.opcode))
+		if !ok {
+			return nil, &CodedError{Code: ERR_CODE_UNKNOWN_COMMAND, Message: fmt.Sprintf("unknown opcode %d", request.opcode)}
+		}
+	}
+
+	args, err := command.ParseArgs(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.opcode != BINARY_OP_NAMED {
+		keyed, ok := args.(keyedArgs)
+		if ok {
+			keyed.setPrimaryKey(string(request.key))
+		} else if len(request.key) > 0 {
+			return nil, &CodedError{Code: ERR_CODE_INVALID, Message: command.Name + " takes no key"}
+		}
+	}
+
+	result, err := dispatcher.DispatchAs(token, command, args)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(result)
+}
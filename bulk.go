@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/logger"
+)
+
+/*
+The "import" and "export" commands move many keys in and out of a namespace at once,
+in one of these formats:
+
+	lines   one key per line
+	ndjson  one JSON object per line, such as {"key": "apple"}
+	csv     one record per line, whose key is in the first column, or in the column
+	        named "key" if the first record is a header that has one. Quoted fields
+	        may span lines.
+
+NDJSON records may also have "value", "score" and "ttl" fields, for compatibility with
+other stores. The trie only holds keys, so these are accepted and ignored. Blank lines
+are skipped. Keys containing line breaks only make the trip through NDJSON and CSV.
+
+An import parses its data before taking the dispatcher's lock, then applies every key
+while holding it once. In "merge" mode (the default) the keys are inserted among the
+existing ones. In "replace" mode they replace the namespace's contents, which is
+recorded as a "load" change, as with a restore (see backup.go). Lines that can't be
+imported are skipped, and reported with their line numbers (for CSV, the line the
+record starts on).
+
+Importing needs a token without namespace or prefix limits, with the readwrite scope.
+*/
+const (
+	BULK_FORMAT_LINES  = "lines"
+	BULK_FORMAT_NDJSON = "ndjson"
+	BULK_FORMAT_CSV    = "csv"
+
+	IMPORT_MODE_MERGE   = "merge"
+	IMPORT_MODE_REPLACE = "replace"
+
+	// Most rejected lines reported by an import. The others are only counted.
+	IMPORT_MAX_REJECTED_LINES = 100
+)
+
+// Arguments of the import command
+type importArgs struct {
+	Format string `json:"format"`
+	Mode   string `json:"mode"`
+	Data   string `json:"data"`
+
+	// The keys found in the data, and the lines that were rejected
+	keys     []string
+	rejected []RejectedLine
+}
+
+// Arguments of the export command
+type exportArgs struct {
+	Format string `json:"format"`
+	Prefix string `json:"prefix"`
+}
+
+func (a *exportArgs) primaryKey() string          { return a.Prefix }
+func (a *exportArgs) setPrimaryKey(prefix string) { a.Prefix = prefix }
+
+// A record of the NDJSON format. Only the key is used.
+type bulkRecord struct {
+	Key   *string         `json:"key"`
+	Value json.RawMessage `json:"value,omitempty"`
+	Score *float64        `json:"score,omitempty"`
+	TTL   json.RawMessage `json:"ttl,omitempty"`
+}
+
+/*
+RejectedLine is a line that an import skipped.
+*/
+type RejectedLine struct {
+	// Line is the line number, starting at 1
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+/*
+ImportResult describes an import.
+*/
+type ImportResult struct {
+	Mode string `json:"mode"`
+	// Inserted is the number of keys that weren't in the namespace before
+	Inserted int `json:"inserted"`
+	// Existing is the number of keys that were already present (in merge mode)
+	Existing int `json:"existing"`
+	// Revision is the revision of the "load" change (in replace mode)
+	Revision uint64 `json:"revision,omitempty"`
+	// RejectedCount is the number of rejected lines, of which up to
+	// IMPORT_MAX_REJECTED_LINES are in Rejected
+	RejectedCount int            `json:"rejected_count"`
+	Rejected      []RejectedLine `json:"rejected"`
+}
+
+/*
+ExportResult holds the keys of a namespace, in one of the import formats.
+*/
+type ExportResult struct {
+	Format string `json:"format"`
+	Keys   int    `json:"keys"`
+	Data   string `json:"data"`
+}
+
+/*
+Import adds keys to the namespace or replaces its contents with them, while holding
+the lock once.
+*/
+func (s *ThreadSafeDispatcher) Import(keys []string, mode string) (ImportResult, error) {
+	if mode == IMPORT_MODE_REPLACE {
+		load, err := s.loadWith(func(clock uint64) *Trie {
+			// The keys get versions after every existing one
+			trie := NewTrie()
+			trie.Clock = clock
+			for _, key := range keys {
+				trie.Add(key)
+			}
+			return trie
+		})
+		if err != nil {
+			return ImportResult{}, err
+		}
+		return ImportResult{Mode: mode, Inserted: load.Keys, Revision: load.Revision}, nil
+	}
+
+	result := ImportResult{Mode: IMPORT_MODE_MERGE}
+	var err error
+	position, failed := s.change(func() {
+		for _, key := range keys {
+			// Every key was checked when the data was parsed, so only recording it can fail
+			var inserted bool
+			if inserted, err = s.trie.Add(key); err != nil {
+				return
+			}
+			if inserted {
+				result.Inserted++
+			} else {
+				result.Existing++
+			}
+		}
+	})
+	if failed != nil {
+		return ImportResult{}, failed
+	}
+	if err != nil {
+		// The keys added before the failure stay, like those of a batch
+		if commitErr := s.commit(position); commitErr != nil {
+			return ImportResult{}, commitErr
+		}
+		return ImportResult{}, err
+	}
+	if err := s.commit(position); err != nil {
+		return ImportResult{}, err
+	}
+	return result, nil
+}
+
+/*
+Reads the keys of an import, and the lines that can't be imported.
+*/
+func parseImport(format string, data string) ([]string, []RejectedLine, error) {
+	switch format {
+	case BULK_FORMAT_LINES, BULK_FORMAT_NDJSON, BULK_FORMAT_CSV, "":
+	default:
+		return nil, nil, &CodedError{Code: ERR_CODE_INVALID, Message: fmt.Sprintf("unknown format %q (expected lines, ndjson or csv)", format)}
+	}
+
+	if format == BULK_FORMAT_CSV {
+		keys, rejected := parseCSVImport(data)
+		return keys, rejected, nil
+	}
+
+	var keys []string
+	var rejected []RejectedLine
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+
+		key := line
+		var err error
+		if format == BULK_FORMAT_NDJSON {
+			key, err = parseNDJSONLine(line)
+		}
+		if err == nil {
+			err = checkImportKey(key)
+		}
+
+		if err != nil {
+			rejected = append(rejected, RejectedLine{Line: i + 1, Reason: err.Error()})
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, rejected, nil
+}
+
+func parseNDJSONLine(line string) (string, error) {
+	var record bulkRecord
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		return "", fmt.Errorf("invalid JSON: %v", err)
+	}
+	if record.Key == nil {
+		return "", errors.New("the record has no key")
+	}
+	return *record.Key, nil
+}
+
+/*
+Reads the keys of CSV data. If the first record has a column named "key", it is a header,
+which sets the column of the keys; otherwise they are in the first column.
+*/
+func parseCSVImport(data string) ([]string, []RejectedLine) {
+	reader := csv.NewReader(strings.NewReader(data))
+	reader.FieldsPerRecord = -1
+
+	lines := csvRecordLines(data)
+	var keys []string
+	var rejected []RejectedLine
+	column := 0
+	for i := 0; ; i++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line := 0
+		if i < len(lines) {
+			line = lines[i]
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				line = parseErr.StartLine
+			}
+			rejected = append(rejected, RejectedLine{Line: line, Reason: fmt.Sprintf("invalid CSV: %v", err)})
+			continue
+		}
+
+		if i == 0 {
+			if header := csvKeyColumn(record); header >= 0 {
+				column = header
+				continue
+			}
+		}
+
+		if column >= len(record) {
+			rejected = append(rejected, RejectedLine{Line: line, Reason: fmt.Sprintf("the record has no column %d", column+1)})
+			continue
+		}
+		key := record[column]
+		if err := checkImportKey(key); err != nil {
+			rejected = append(rejected, RejectedLine{Line: line, Reason: err.Error()})
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, rejected
+}
+
+/*
+Returns the line each record of CSV data starts on, in the order the CSV reader returns
+them. A record ends at a line break outside quotes, and empty lines hold no record.
+*/
+func csvRecordLines(data string) []int {
+	var lines []int
+	line := 1
+	start := 0
+	quoted := false
+	fieldStart := true
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if quoted {
+			if c == '"' {
+				if i+1 < len(data) && data[i+1] == '"' {
+					i++
+				} else {
+					quoted = false
+				}
+			} else if c == '\n' {
+				line++
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			// Quotes only open a quoted field at its start
+			quoted = fieldStart
+		case '\n':
+			if record := data[start:i]; record != "" && record != "\r" {
+				lines = append(lines, line-strings.Count(record, "\n"))
+			}
+			line++
+			start = i + 1
+		}
+		fieldStart = c == ',' || c == '\n'
+	}
+	if record := data[start:]; record != "" {
+		lines = append(lines, line-strings.Count(record, "\n"))
+	}
+	return lines
+}
+
+// Returns the index of the column named "key", or -1 if there is none
+func csvKeyColumn(record []string) int {
+	for i, field := range record {
+		if field == "key" {
+			return i
+		}
+	}
+	return -1
+}
+
+// Checks that a key can be inserted, so that applying an import can't fail halfway
+func checkImportKey(key string) error {
+	if key == "" {
+		return errors.New("the key is empty")
+	}
+	if len(key) >= MAX_KEY_LENGTH {
+		return fmt.Errorf("the key is longer than %d bytes", MAX_KEY_LENGTH-1)
+	}
+	return nil
+}
+
+// Returns the result of exporting some keys
+func exportKeys(format string, keys []string) (ExportResult, error) {
+	data, err := formatExport(format, keys)
+	if err != nil {
+		return ExportResult{}, err
+	}
+	if format == "" {
+		format = BULK_FORMAT_LINES
+	}
+	return ExportResult{Format: format, Keys: len(keys), Data: data}, nil
+}
+
+/*
+Writes keys in one of the import formats.
+*/
+func formatExport(format string, keys []string) (string, error) {
+	var buffer bytes.Buffer
+	switch format {
+	case BULK_FORMAT_LINES, "":
+		for _, key := range keys {
+			buffer.WriteString(key)
+			buffer.WriteByte('\n')
+		}
+	case BULK_FORMAT_NDJSON:
+		encoder := json.NewEncoder(&buffer)
+		for _, key := range keys {
+			encoder.Encode(bulkRecord{Key: &key})
+		}
+	case BULK_FORMAT_CSV:
+		writer := csv.NewWriter(&buffer)
+		writer.Write([]string{"key"})
+		for _, key := range keys {
+			writer.Write([]string{key})
+		}
+		writer.Flush()
+	default:
+		return "", &CodedError{Code: ERR_CODE_INVALID, Message: fmt.Sprintf("unknown format %q (expected lines, ndjson or csv)", format)}
+	}
+	return buffer.String(), nil
+}
+
+/*
+Returns the "import" and "export" commands of a dispatcher's namespace.
+Like "snapshot", "import" takes the dispatcher's lock itself.
+*/
+func bulkCommands(dispatcher *ThreadSafeDispatcher) []*Command {
+	return []*Command{
+		{
+			Name:     "import",
+			Code:     NO_LEGACY_CODE,
+			Unlocked: true,
+			// The data is parsed here, before the lock is taken
+			ParseArgs: func(raw json.RawMessage) (interface{}, error) {
+				args := &importArgs{}
+				if err := decodeV2Args(raw, args); err != nil {
+					return nil, err
+				}
+				switch args.Mode {
+				case "":
+					args.Mode = IMPORT_MODE_MERGE
+				case IMPORT_MODE_MERGE, IMPORT_MODE_REPLACE:
+				default:
+					return nil, &CodedError{Code: ERR_CODE_INVALID, Message: fmt.Sprintf("unknown mode %q (expected merge or replace)", args.Mode)}
+				}
+
+				var err error
+				args.keys, args.rejected, err = parseImport(args.Format, args.Data)
+				if err != nil {
+					return nil, err
+				}
+				return args, nil
+			},
+			// result: an ImportResult
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				importArgs := args.(*importArgs)
+				result, err := dispatcher.Import(importArgs.keys, importArgs.Mode)
+				if err != nil {
+					return nil, err
+				}
+
+				result.RejectedCount = len(importArgs.rejected)
+				result.Rejected = importArgs.rejected
+				if len(result.Rejected) > IMPORT_MAX_REJECTED_LINES {
+					result.Rejected = result.Rejected[:IMPORT_MAX_REJECTED_LINES]
+				}
+				if result.Rejected == nil {
+					result.Rejected = []RejectedLine{}
+				}
+
+				logger.Infof("imported %d keys into namespace %s (%s): %d new, %d lines rejected",
+					len(importArgs.keys), dispatcher.name, result.Mode, result.Inserted, result.RejectedCount)
+				return result, nil
+			},
+			Describe: func(args interface{}) string {
+				importArgs := args.(*importArgs)
+				return fmt.Sprintf("importing %d keys into namespace %s (%s)", len(importArgs.keys), dispatcher.name, importArgs.Mode)
+			},
+		},
+		{
+			Name:      "export",
+			Code:      NO_LEGACY_CODE,
+			ReadOnly:  true,
+			ParseArgs: argsParser(func() interface{} { return &exportArgs{} }),
+			// result: an ExportResult
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				exportArgs := args.(*exportArgs)
+				keys, _, _, err := trie.CompletionsFrom(exportArgs.Prefix, "", 0)
+				if err != nil {
+					return nil, err
+				}
+
+				return exportKeys(exportArgs.Format, keys)
+			},
+			Describe: func(args interface{}) string {
+				return "exporting keys starting with " + args.(*exportArgs).Prefix
+			},
+		},
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// Default number of changes buffered for each subscriber
+const SUBSCRIPTION_BUFFER_SIZE = 256
+
+// Largest buffer a subscriber may ask for
+const MAX_SUBSCRIPTION_BUFFER_SIZE = 65536
+
+// Op of the marker a subscription receives when its buffer overflows
+const CHANGE_OVERFLOW = "overflow"
+
+// Number of recent changes a hub keeps, so that subscribers can catch up after reconnecting
+const CHANGE_HISTORY_SIZE = 10000
+
+/*
+A ChangeHub fans the changes made to a trie out to subscribers, filtered by key prefix.
+
+Publishing never blocks. Each subscriber has a bounded buffer, and once it is full the
+subscriber is sent an overflow marker (a Change with Op CHANGE_OVERFLOW) and misses
+every change after it until it calls Resume. Slow subscribers therefore lose changes
+instead of holding up writers.
+
+The hub also remembers the last CHANGE_HISTORY_SIZE changes, so that a subscriber can
+pick up where it left off (see SubscribeFrom).
+*/
+type ChangeHub struct {
+	mutex       sync.Mutex
+	subscribers map[*Subscription]struct{}
+	// history is a ring of the most recent changes. Once it is full,
+	// historyStart is the index of the oldest one.
+	history      []Change
+	historyStart int
+	// closed is set by Close; later subscriptions start out closed
+	closed bool
+}
+
+/*
+A Subscription receives the changes to keys that start with any of its prefixes.
+*/
+type Subscription struct {
+	hub      *ChangeHub
+	prefixes []string
+	// capacity is the number of changes buffered before the subscription overflows
+	capacity int
+	// events has room for one more change than capacity, for the overflow marker
+	events chan Change
+
+	// The fields below are guarded by the hub's mutex
+	overflowed bool
+	dropped    int
+	closed     bool
+}
+
+/*
+Creates a hub with no subscribers.
+*/
+func NewChangeHub() *ChangeHub {
+	return &ChangeHub{subscribers: make(map[*Subscription]struct{})}
+}
+
+/*
+Subscribe starts delivering the changes to keys with any of the given prefixes.
+The empty prefix matches every key.
+*/
+func (h *ChangeHub) Subscribe(prefixes []string, capacity int) *Subscription {
+	subscription := h.newSubscription(prefixes, capacity)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.add(subscription)
+	return subscription
+}
+
+/*
+SubscribeFrom subscribes like Subscribe, and also returns the remembered changes
+to matching keys that came after the given version (of the trie's clock).
+No change is both in the backlog and delivered on the subscription, and none falls between them.
+
+`revision` is the trie's clock, read while no change could be published. The boolean result
+is false unless the backlog holds every change after `after` up to it. That isn't the case
+when some of them were already forgotten (or never published, as before a restart), or when
+`after` is newer than the trie.
+*/
+func (h *ChangeHub) SubscribeFrom(prefixes []string, capacity int, after uint64, revision uint64) (*Subscription, []Change, bool) {
+	subscription := h.newSubscription(prefixes, capacity)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	backlog := make([]Change, 0)
+	for i := range h.history {
+		change := h.history[(h.historyStart+i)%len(h.history)]
+		if change.Version > after && subscription.matches(change) {
+			backlog = append(backlog, change)
+		}
+	}
+
+	// Every change advances the clock by one, so nothing is missing as long as the oldest
+	// remembered change is at most the one right after `after`, and the newest is the clock's
+	complete := after == revision
+	if len(h.history) > 0 && after < revision {
+		oldest := h.history[h.historyStart]
+		newest := h.history[(h.historyStart+len(h.history)-1)%len(h.history)]
+		complete = oldest.Version <= after+1 && newest.Version >= revision
+	}
+
+	h.add(subscription)
+	return subscription, backlog, complete
+}
+
+// The caller must hold the mutex
+func (h *ChangeHub) add(subscription *Subscription) {
+	if h.closed {
+		subscription.closed = true
+		close(subscription.events)
+		return
+	}
+	h.subscribers[subscription] = struct{}{}
+}
+
+func (h *ChangeHub) newSubscription(prefixes []string, capacity int) *Subscription {
+	if capacity <= 0 {
+		capacity = SUBSCRIPTION_BUFFER_SIZE
+	}
+
+	return &Subscription{
+		hub:      h,
+		prefixes: prefixes,
+		capacity: capacity,
+		events:   make(chan Change, capacity+1),
+	}
+}
+
+/*
+Publish delivers a change to every matching subscriber, without blocking.
+*/
+func (h *ChangeHub) Publish(change Change) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.history) < CHANGE_HISTORY_SIZE {
+		h.history = append(h.history, change)
+	} else {
+		h.history[h.historyStart] = change
+		h.historyStart = (h.historyStart + 1) % CHANGE_HISTORY_SIZE
+	}
+
+	for subscription := range h.subscribers {
+		if !subscription.matches(change) {
+			continue
+		}
+
+		if subscription.overflowed {
+			subscription.dropped++
+			continue
+		}
+
+		if len(subscription.events) >= subscription.capacity {
+			// The last slot is kept free for this marker, so this never blocks
+			subscription.overflowed = true
+			subscription.dropped = 1
+			subscription.events <- Change{Op: CHANGE_OVERFLOW, Version: change.Version}
+			continue
+		}
+
+		subscription.events <- change
+	}
+}
+
+/*
+Close ends every subscription, closing their events channels, and those of any
+subscription made afterwards.
+*/
+func (h *ChangeHub) Close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.closed = true
+	for subscription := range h.subscribers {
+		subscription.closed = true
+		delete(h.subscribers, subscription)
+		close(subscription.events)
+	}
+}
+
+// Returns whether a change is to a key that starts with any of the subscription's prefixes.
+// Every subscription is told when the whole trie is replaced.
+func (s *Subscription) matches(change Change) bool {
+	if change.Op == CHANGE_LOAD {
+		return true
+	}
+	for _, prefix := range s.prefixes {
+		if strings.HasPrefix(change.Key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Events returns the channel changes are delivered on. It is closed by Close.
+*/
+func (s *Subscription) Events() <-chan Change {
+	return s.events
+}
+
+/*
+Resume restarts delivery after an overflow marker, returning how many changes were dropped.
+*/
+func (s *Subscription) Resume() int {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+
+	dropped := s.dropped
+	s.overflowed = false
+	s.dropped = 0
+	return dropped
+}
+
+/*
+Close stops delivery and closes the events channel. It is safe to call more than once.
+*/
+func (s *Subscription) Close() {
+	s.hub.mutex.Lock()
+	defer s.hub.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	s.closed = true
+	delete(s.hub.subscribers, s)
+	close(s.events)
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/logger"
+)
+
+/*
+The changelog records every change made to the trie on disk, so that other systems
+(search indexes, warehouses, ...) can follow the trie and pick up where they left off,
+even across restarts.
+
+Each change is identified by its revision, the trie's clock right after the change.
+Revisions start at 1 and increase by exactly one with every change.
+
+The log is split into segment files of CHANGELOG_SEGMENT_RECORDS changes, named after
+the first revision they hold. Only the newest `maxSegments` segments are kept. Reading
+from a revision that was already deleted fails with ERR_CODE_COMPACTED, and the client
+has to reload the whole trie before following the changelog again.
+
+Each line of a segment is one change, as JSON:
+
+	{"revision":7,"op":"insert","key":"foo"}
+
+or, if the changelog is encrypted, that line encrypted (see encryption.go).
+
+The changelog is synced to disk like the write-ahead log, following the same fsync policy
+(see wal.go), so that it doesn't lose changes the write-ahead log keeps.
+*/
+const (
+	// Number of changes per segment file
+	CHANGELOG_SEGMENT_RECORDS = 10000
+	// Default number of segment files kept
+	CHANGELOG_DEFAULT_SEGMENTS = 16
+
+	CHANGELOG_DEFAULT_PAGE_SIZE = 1000
+	CHANGELOG_MAX_PAGE_SIZE     = 10000
+
+	CHANGELOG_SEGMENT_SUFFIX = ".log"
+)
+
+/*
+A ChangeRecord is a change, as stored in the changelog.
+*/
+type ChangeRecord struct {
+	Revision uint64 `json:"revision"`
+	Op       string `json:"op"`
+	Key      string `json:"key"`
+}
+
+/*
+A Changelog is a bounded, on-disk log of changes. It is safe for concurrent use.
+*/
+type Changelog struct {
+	dir         string
+	maxSegments int
+	// policy is the fsync policy, or "" to leave syncing to the operating system
+	policy string
+	// keyring encrypts new changes, if set, binding them to the namespace, which is the
+	// name of the directory
+	keyring   *Keyring
+	namespace string
+
+	mutex sync.Mutex
+	// segments are the first revisions of the segment files, oldest first
+	segments []uint64
+	// current is the newest segment, which changes are appended to
+	current        *os.File
+	currentRecords int
+	currentBytes   int64
+	// revision is the revision of the last change appended
+	revision uint64
+	// failed is set if a partly written change couldn't be cut off, after which
+	// nothing more can be appended
+	failed error
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+/*
+Opens the changelog in a directory, creating the directory if needed. It is synced
+according to an fsync policy of the write-ahead log, or not at all if the policy is "".
+New changes are encrypted with the keyring's current key, unless the keyring is nil.
+*/
+func OpenChangelog(dir string, maxSegments int, policy string, keyring *Keyring) (*Changelog, error) {
+	switch policy {
+	case "", WAL_FSYNC_ALWAYS, WAL_FSYNC_EVERYSEC, WAL_FSYNC_NEVER:
+	default:
+		return nil, fmt.Errorf("the fsync policy must be %q, %q or %q", WAL_FSYNC_ALWAYS, WAL_FSYNC_EVERYSEC, WAL_FSYNC_NEVER)
+	}
+	if maxSegments < 1 {
+		maxSegments = CHANGELOG_DEFAULT_SEGMENTS
+	}
+
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	changelog := &Changelog{dir: dir, maxSegments: maxSegments, policy: policy, keyring: keyring, namespace: filepath.Base(dir), stop: make(chan struct{})}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, CHANGELOG_SEGMENT_SUFFIX) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, CHANGELOG_SEGMENT_SUFFIX), 10, 64)
+		if err != nil {
+			continue
+		}
+		changelog.segments = append(changelog.segments, first)
+	}
+	sort.Slice(changelog.segments, func(i, j int) bool { return changelog.segments[i] < changelog.segments[j] })
+
+	if len(changelog.segments) > 0 {
+		if err := changelog.openLastSegment(); err != nil {
+			return nil, err
+		}
+	}
+
+	if policy == WAL_FSYNC_EVERYSEC {
+		go changelog.syncEverySecond()
+	}
+	return changelog, nil
+}
+
+/*
+Reopens the newest segment for appending. A change that was only partly written
+before a crash is cut off, so that the next one starts on a fresh line.
+*/
+func (c *Changelog) openLastSegment() error {
+	first := c.segments[len(c.segments)-1]
+	path := c.segmentPath(first)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	complete := 0
+	if end := strings.LastIndexByte(string(data), '\n'); end >= 0 {
+		complete = end + 1
+	}
+	if complete < len(data) {
+		logger.Warningf("dropping a partly written change at the end of %s", path)
+		if err := os.Truncate(path, int64(complete)); err != nil {
+			return err
+		}
+	}
+
+	// Before the segment's first change, the clock was one behind it
+	c.revision = first - 1
+	offset := 0
+	for _, line := range strings.Split(string(data[:complete]), "\n") {
+		lineOffset := offset
+		offset += len(line) + 1
+		if line == "" {
+			continue
+		}
+		record, err := c.decode([]byte(line), first, int64(lineOffset))
+		if err != nil {
+			return fmt.Errorf("corrupt change in %s: %v", path, err)
+		}
+		c.revision = record.Revision
+		c.currentRecords++
+	}
+	c.currentBytes = int64(complete)
+
+	c.current, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0660)
+	return err
+}
+
+func (c *Changelog) segmentPath(first uint64) string {
+	return filepath.Join(c.dir, fmt.Sprintf("%020d%s", first, CHANGELOG_SEGMENT_SUFFIX))
+}
+
+/*
+Revision returns the revision of the last change in the log, or 0 if there are none.
+*/
+func (c *Changelog) Revision() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.revision
+}
+
+/*
+Oldest returns the oldest revision still in the log.
+If the log is empty, this is the revision the next change will have.
+*/
+func (c *Changelog) Oldest() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.oldest()
+}
+
+func (c *Changelog) oldest() uint64 {
+	if len(c.segments) == 0 {
+		return c.revision + 1
+	}
+	return c.segments[0]
+}
+
+/*
+Append adds a change to the log, starting a new segment (and deleting the oldest)
+when the current one is full. If the change can't be written, whatever part of it
+was written is cut off again.
+*/
+func (c *Changelog) Append(change Change) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.failed != nil {
+		return c.failed
+	}
+	if c.current == nil || c.currentRecords >= CHANGELOG_SEGMENT_RECORDS {
+		if err := c.rotate(change.Version); err != nil {
+			return err
+		}
+	}
+
+	// A record made of strings and numbers always encodes
+	encoded, _ := json.Marshal(ChangeRecord{Revision: change.Version, Op: change.Op, Key: change.Key})
+	if c.keyring != nil {
+		encoded = c.keyring.sealChangelogLine(encoded, c.namespace, c.segments[len(c.segments)-1], c.currentBytes)
+	}
+	line := append(encoded, '\n')
+	if _, err := c.current.Write(line); err != nil {
+		if truncateErr := c.current.Truncate(c.currentBytes); truncateErr != nil {
+			c.failed = fmt.Errorf("a partly written change couldn't be cut off: %v", truncateErr)
+		}
+		return err
+	}
+
+	c.currentRecords++
+	c.currentBytes += int64(len(line))
+	c.revision = change.Version
+	return nil
+}
+
+/*
+Starts a new segment whose first change has the given revision.
+*/
+func (c *Changelog) rotate(first uint64) error {
+	if c.current != nil {
+		// Nothing in the old segment may be left unsynced once it is closed
+		if c.policy == WAL_FSYNC_ALWAYS || c.policy == WAL_FSYNC_EVERYSEC {
+			if err := c.current.Sync(); err != nil {
+				return err
+			}
+		}
+		if err := c.current.Close(); err != nil {
+			return err
+		}
+		c.current = nil
+	}
+
+	file, err := os.OpenFile(c.segmentPath(first), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
+	if err != nil {
+		return err
+	}
+
+	c.current = file
+	c.currentRecords = 0
+	c.currentBytes = 0
+	c.segments = append(c.segments, first)
+
+	for len(c.segments) > c.maxSegments {
+		if err := os.Remove(c.segmentPath(c.segments[0])); err != nil {
+			logger.Errorf("Error deleting changelog segment: %v", err)
+		}
+		c.segments = c.segments[1:]
+	}
+
+	return nil
+}
+
+/*
+Since returns up to `limit` changes that came after the given revision, oldest first,
+and whether there are more. It fails with ERR_CODE_COMPACTED if some of those changes
+have already been deleted.
+*/
+func (c *Changelog) Since(after uint64, limit int) ([]ChangeRecord, bool, error) {
+	// The files are read without the mutex, so that appends don't wait for them.
+	// Changes appended meanwhile are left for the next call.
+	c.mutex.Lock()
+	segments := append([]uint64(nil), c.segments...)
+	oldest := c.oldest()
+	revision := c.revision
+	c.mutex.Unlock()
+
+	if after+1 < oldest {
+		return nil, false, compactedError(after, oldest)
+	}
+
+	records := make([]ChangeRecord, 0)
+	for i, first := range segments {
+		// Skip the segments that end before the requested revision
+		if i+1 < len(segments) && segments[i+1] <= after+1 {
+			continue
+		}
+
+		more, err := c.readSegment(first, after, revision, limit, &records)
+		if os.IsNotExist(err) {
+			// The segment was deleted since the list was copied
+			return nil, false, compactedError(after, c.Oldest())
+		}
+		if err != nil || more {
+			return records, more, err
+		}
+	}
+
+	return records, false, nil
+}
+
+func compactedError(after uint64, oldest uint64) error {
+	return &CodedError{
+		Code:    ERR_CODE_COMPACTED,
+		Message: fmt.Sprintf("revision %d has been compacted (oldest is %d), resync required", after+1, oldest),
+	}
+}
+
+/*
+Appends the changes of a segment that came after `after`, up to `revision`, to records,
+stopping once there are `limit`. It returns true if it stopped before `revision`.
+*/
+func (c *Changelog) readSegment(first uint64, after uint64, revision uint64, limit int, records *[]ChangeRecord) (bool, error) {
+	file, err := os.Open(c.segmentPath(first))
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		lineOffset := offset
+		line, err := reader.ReadBytes('\n')
+		offset += int64(len(line))
+		if err == io.EOF {
+			// A line without its newline is still being appended
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+
+		record, err := c.decode(line[:len(line)-1], first, lineOffset)
+		if err != nil {
+			return false, fmt.Errorf("corrupt change in %s: %v", file.Name(), err)
+		}
+		if record.Revision <= after {
+			continue
+		}
+		if record.Revision > revision {
+			return false, nil
+		}
+		if len(*records) == limit {
+			return true, nil
+		}
+		*records = append(*records, record)
+	}
+
+	// The last segment ends with the last change, so there's more if we stopped
+	// exactly at the limit with changes left in later segments
+	return len(*records) == limit && (*records)[limit-1].Revision < revision, nil
+}
+
+// Decodes a line at an offset of a segment, decrypting it if needed
+func (c *Changelog) decode(line []byte, first uint64, offset int64) (ChangeRecord, error) {
+	var record ChangeRecord
+	line, err := c.keyring.openChangelogLine(line, c.namespace, first, offset)
+	if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(line, &record)
+	return record, err
+}
+
+/*
+Sync writes the changes appended so far to disk.
+*/
+func (c *Changelog) Sync() error {
+	c.mutex.Lock()
+	file := c.current
+	c.mutex.Unlock()
+
+	if file == nil {
+		return nil
+	}
+	// Appends go on while the file syncs
+	err := file.Sync()
+	if errors.Is(err, os.ErrClosed) {
+		// The segment was synced before it was closed
+		return nil
+	}
+	return err
+}
+
+func (c *Changelog) syncEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			if err := c.Sync(); err != nil {
+				logger.Errorf("Error syncing changelog: %v", err)
+			}
+		}
+	}
+}
+
+/*
+Close syncs the current segment, unless the policy leaves that to the operating system,
+and closes it.
+*/
+func (c *Changelog) Close() error {
+	c.stopOnce.Do(func() { close(c.stop) })
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.current == nil {
+		return nil
+	}
+	if c.policy == WAL_FSYNC_ALWAYS || c.policy == WAL_FSYNC_EVERYSEC {
+		if err := c.current.Sync(); err != nil {
+			c.current.Close()
+			c.current = nil
+			return err
+		}
+	}
+	err := c.current.Close()
+	c.current = nil
+	return err
+}
+
+// Arguments of the changes command
+type changesArgs struct {
+	// Since is the revision of the last change the caller has seen (0 for all of them)
+	Since uint64 `json:"since"`
+	Limit int    `json:"limit"`
+}
+
+/*
+ChangesResult is a page of the changelog.
+*/
+type ChangesResult struct {
+	Changes []ChangeRecord `json:"changes"`
+	// More is true if there are changes after this page
+	More bool `json:"more"`
+	// Next is the revision to pass as `since` to get the next page
+	Next uint64 `json:"next"`
+	// Revision is the revision of the last change in the log
+	Revision uint64 `json:"revision"`
+}
+
+/*
+Returns the "changes" command, which pages through a changelog.
+*/
+func changesCommand(changelog *Changelog) *Command {
+	return &Command{
+		Name:      "changes",
+		Code:      NO_LEGACY_CODE,
+		ReadOnly:  true,
+		ParseArgs: argsParser(func() interface{} { return &changesArgs{} }),
+		// result: a ChangesResult
+		Run: func(trie *Trie, args interface{}) (interface{}, error) {
+			changesArgs := args.(*changesArgs)
+
+			limit := changesArgs.Limit
+			if limit == 0 {
+				limit = CHANGELOG_DEFAULT_PAGE_SIZE
+			}
+			if limit < 1 || limit > CHANGELOG_MAX_PAGE_SIZE {
+				return nil, &CodedError{
+					Code:    ERR_CODE_INVALID,
+					Message: fmt.Sprintf("limit must be between 1 and %d", CHANGELOG_MAX_PAGE_SIZE),
+				}
+			}
+
+			records, more, err := changelog.Since(changesArgs.Since, limit)
+			if err != nil {
+				return nil, err
+			}
+
+			next := changesArgs.Since
+			if len(records) > 0 {
+				next = records[len(records)-1].Revision
+			}
+
+			return ChangesResult{Changes: records, More: more, Next: next, Revision: changelog.Revision()}, nil
+		},
+		Describe: func(args interface{}) string {
+			return fmt.Sprintf("reading changes since %d", args.(*changesArgs).Since)
+		},
+	}
+}
+
+/*
+HandleChangelog serves GET /changelog?since=&limit=&namespace=, a page of a namespace's changelog.
+Compacted revisions are answered with 410 Gone.
+*/
+func (s *Server) HandleChangelog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, err := s.authenticate(r)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+
+	var args changesArgs
+	if since := query.Get("since"); since != "" {
+		if args.Since, err = strconv.ParseUint(since, 10, 64); err != nil {
+			writeRESTError(w, &CodedError{Code: ERR_CODE_INVALID, Message: "since must be a revision"})
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if args.Limit, err = strconv.Atoi(limit); err != nil || args.Limit < 1 {
+			writeRESTError(w, &CodedError{Code: ERR_CODE_INVALID, Message: "limit must be a positive number"})
+			return
+		}
+	}
+
+	result, err := s.RunAs(token, requestNamespace(r), "changes", &args)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	writeRESTJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,588 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+/*
+A Command describes one operation that a ThreadSafeDispatcher can run.
+Commands are looked up by name (version 2 protocol) or by code (legacy protocol)
+in a CommandRegistry, so new operations can be added without touching the dispatcher.
+*/
+type Command struct {
+	// Name is the command's name in the version 2 protocol
+	Name string
+	// Code is the command's code in the legacy protocol, or NO_LEGACY_CODE
+	Code int
+	// ReadOnly commands don't modify the trie, so they run under a shared lock
+	// and may run concurrently with each other
+	ReadOnly bool
+	// Unlocked commands don't touch the trie at all (they manage the server instead),
+	// so they run without taking the dispatcher's lock, and are given a nil trie
+	Unlocked bool
+	// ParseLegacy parses the argument of a legacy message (everything after the code).
+	// It is required if the command has a legacy code.
+	ParseLegacy func(argument []byte) (interface{}, error)
+	// ParseArgs parses the named arguments of a version 2 request
+	ParseArgs func(raw json.RawMessage) (interface{}, error)
+	// Run executes the command. The dispatcher holds the lock that ReadOnly asks for.
+	Run func(trie *Trie, args interface{}) (interface{}, error)
+	// Describe returns the line logged when the command is dispatched (optional)
+	Describe func(args interface{}) string
+}
+
+// Code of commands that can't be used from the legacy protocol
+const NO_LEGACY_CODE = -1
+
+/*
+A CommandRegistry holds the commands known to a dispatcher, by name and by legacy code.
+*/
+type CommandRegistry struct {
+	byName map[string]*Command
+	byCode map[int]*Command
+	mutex  sync.RWMutex
+}
+
+/*
+Creates a registry with no commands.
+*/
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{
+		byName: make(map[string]*Command),
+		byCode: make(map[int]*Command),
+	}
+}
+
+/*
+Creates a registry with all of the built-in commands.
+*/
+func NewDefaultCommandRegistry() *CommandRegistry {
+	registry := NewCommandRegistry()
+	for _, command := range builtinCommands() {
+		if err := registry.Register(command); err != nil {
+			// The built-in commands never clash with each other
+			panic(err)
+		}
+	}
+	return registry
+}
+
+/*
+Register adds a command to the registry.
+It fails if the command is incomplete, or if its name or code is already taken.
+*/
+func (r *CommandRegistry) Register(command *Command) error {
+	if command.Name == "" || command.Run == nil || command.ParseArgs == nil {
+		return errors.New("commands need a name, an argument parser and a handler")
+	}
+	if command.Code != NO_LEGACY_CODE && command.ParseLegacy == nil {
+		return fmt.Errorf("command %q has a legacy code but no legacy argument parser", command.Name)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.byName[command.Name]; ok {
+		return fmt.Errorf("command %q is already registered", command.Name)
+	}
+	if _, ok := r.byCode[command.Code]; ok && command.Code != NO_LEGACY_CODE {
+		return fmt.Errorf("legacy code %d is already registered", command.Code)
+	}
+
+	r.byName[command.Name] = command
+	if command.Code != NO_LEGACY_CODE {
+		r.byCode[command.Code] = command
+	}
+	return nil
+}
+
+/*
+Lookup finds a command by name.
+*/
+func (r *CommandRegistry) Lookup(name string) (*Command, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	command, ok := r.byName[name]
+	return command, ok
+}
+
+/*
+LookupCode finds a command by its legacy code.
+*/
+func (r *CommandRegistry) LookupCode(code int) (*Command, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	command, ok := r.byCode[code]
+	return command, ok
+}
+
+/*
+Names returns the names of all registered commands.
+*/
+func (r *CommandRegistry) Names() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	names := make([]string, 0, len(r.byName))
+	for name := range r.byName {
+		names = append(names, name)
+	}
+	return names
+}
+
+/*
+keyedArgs is implemented by arguments built around a single key (or prefix).
+Protocols that send the key outside of the other arguments, such as the binary
+protocol, use it to fill the key in. Access checks use it to find the key a command touches.
+*/
+type keyedArgs interface {
+	primaryKey() string
+	setPrimaryKey(key string)
+}
+
+// Arguments of commands that take a single key
+type keyArgs struct {
+	Key string `json:"key"`
+}
+
+func (a *keyArgs) primaryKey() string       { return a.Key }
+func (a *keyArgs) setPrimaryKey(key string) { a.Key = key }
+
+// Arguments of the conditional commands
+type versionedKeyArgs struct {
+	Key     string `json:"key"`
+	Version uint64 `json:"version"`
+}
+
+func (a *versionedKeyArgs) primaryKey() string       { return a.Key }
+func (a *versionedKeyArgs) setPrimaryKey(key string) { a.Key = key }
+
+// Arguments of the put command
+type putArgs struct {
+	Key string `json:"key"`
+	// MustExist makes the command fail with a conflict unless the key already exists
+	MustExist bool `json:"must_exist"`
+}
+
+func (a *putArgs) primaryKey() string       { return a.Key }
+func (a *putArgs) setPrimaryKey(key string) { a.Key = key }
+
+// PutResult is the outcome of the put command
+type PutResult struct {
+	// Created is whether the key was inserted, rather than already present
+	Created bool `json:"created"`
+	// Version is the key's version after the command
+	Version uint64 `json:"version"`
+}
+
+// Arguments of the completions command. A limit of 0 means no limit.
+type completionsArgs struct {
+	Prefix string `json:"prefix"`
+	Limit  int    `json:"limit"`
+}
+
+func (a *completionsArgs) primaryKey() string          { return a.Prefix }
+func (a *completionsArgs) setPrimaryKey(prefix string) { a.Prefix = prefix }
+
+// Arguments of the range command. A limit of 0 means no limit.
+type rangeArgs struct {
+	Prefix string `json:"prefix"`
+	Start  string `json:"start"`
+	Limit  int    `json:"limit"`
+}
+
+func (a *rangeArgs) primaryKey() string          { return a.Prefix }
+func (a *rangeArgs) setPrimaryKey(prefix string) { a.Prefix = prefix }
+
+// RangeResult is one page of keys
+type RangeResult struct {
+	Keys []string `json:"keys"`
+	// More is set if there are keys after this page
+	More bool `json:"more"`
+	// Next is the first key of the next page, if there is one
+	Next string `json:"next,omitempty"`
+}
+
+// Arguments of the keys command. A limit of 0 means no limit.
+type keysArgs struct {
+	Limit int `json:"limit"`
+}
+
+// Arguments of the batch command
+type batchArgs struct {
+	Op   string   `json:"op"`
+	Keys []string `json:"keys"`
+}
+
+// Arguments of commands that take a list of keys
+type keyListArgs struct {
+	Keys []string `json:"keys"`
+}
+
+// Arguments of the hello command
+type helloArgs struct {
+	Versions []int `json:"versions"`
+}
+
+// HelloResult is the outcome of protocol version negotiation
+type HelloResult struct {
+	// Version is the version the server picked
+	Version int `json:"version"`
+	// Versions are all versions the server supports
+	Versions []int `json:"versions"`
+}
+
+/*
+Returns an argument parser that decodes version 2 arguments into a fresh value from `newArgs`.
+*/
+func argsParser(newArgs func() interface{}) func(raw json.RawMessage) (interface{}, error) {
+	return func(raw json.RawMessage) (interface{}, error) {
+		args := newArgs()
+		if err := decodeV2Args(raw, args); err != nil {
+			return nil, err
+		}
+		return args, nil
+	}
+}
+
+// Parses the legacy argument of a command that takes a single key
+func parseLegacyKey(argument []byte) (interface{}, error) {
+	return &keyArgs{Key: string(argument)}, nil
+}
+
+// Parses the legacy argument of a conditional command
+func parseLegacyVersionedKey(argument []byte) (interface{}, error) {
+	expected, key, err := parseVersionedKey(argument)
+	if err != nil {
+		return nil, err
+	}
+	return &versionedKeyArgs{Key: key, Version: expected}, nil
+}
+
+// Error for a negative limit on the number of keys
+var errNegativeLimit = &CodedError{Code: ERR_CODE_INVALID, Message: "limit must not be negative"}
+
+// Maps the commands that can run in a batch to their implementations
+var batchOps = map[string]func(trie *Trie) func(key string) (bool, error){
+	"insert": func(trie *Trie) func(key string) (bool, error) { return trie.Add },
+	"delete": func(trie *Trie) func(key string) (bool, error) { return trie.Remove },
+	"exists": func(trie *Trie) func(key string) (bool, error) { return trie.Has },
+}
+
+// Error for a batch of a command that can't run in a batch
+var errBatchOp = &CodedError{Code: ERR_CODE_INVALID, Message: "batches only support insert, delete and exists"}
+
+// Maps the legacy codes of commands that can run in a batch to their names
+var batchOpsByCode = map[byte]string{
+	CMD_INSERT: "insert",
+	CMD_DELETE: "delete",
+	CMD_EXISTS: "exists",
+}
+
+/*
+The commands every dispatcher starts with.
+*/
+func builtinCommands() []*Command {
+	return []*Command{
+		{
+			Name:        "insert",
+			Code:        CMD_INSERT,
+			ParseLegacy: parseLegacyKey,
+			ParseArgs:   argsParser(func() interface{} { return &keyArgs{} }),
+			// result: true if the key was inserted, false if it was already present
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				return trie.Add(args.(*keyArgs).Key)
+			},
+			Describe: func(args interface{}) string {
+				return "inserting " + args.(*keyArgs).Key
+			},
+		},
+		{
+			Name:        "delete",
+			Code:        CMD_DELETE,
+			ParseLegacy: parseLegacyKey,
+			ParseArgs:   argsParser(func() interface{} { return &keyArgs{} }),
+			// result: true if the key was deleted, false if it was not present
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				return trie.Remove(args.(*keyArgs).Key)
+			},
+			Describe: func(args interface{}) string {
+				return "deleting " + args.(*keyArgs).Key
+			},
+		},
+		{
+			Name:      "put",
+			Code:      NO_LEGACY_CODE,
+			ParseArgs: argsParser(func() interface{} { return &putArgs{} }),
+			// result: whether the key was inserted, and its version, read under the same lock
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				putArgs := args.(*putArgs)
+				if putArgs.MustExist {
+					if exists, err := trie.Has(putArgs.Key); err != nil || !exists {
+						if err == nil {
+							err = &CodedError{Code: ERR_CODE_CONFLICT, Message: fmt.Sprintf("key %q doesn't exist", putArgs.Key)}
+						}
+						return nil, err
+					}
+				}
+
+				created, err := trie.Add(putArgs.Key)
+				if err != nil {
+					return nil, err
+				}
+				version, err := trie.GetVersion(putArgs.Key)
+				if err != nil {
+					return nil, err
+				}
+				return PutResult{Created: created, Version: version}, nil
+			},
+			Describe: func(args interface{}) string {
+				return "putting " + args.(*putArgs).Key
+			},
+		},
+		{
+			Name:        "exists",
+			Code:        CMD_EXISTS,
+			ReadOnly:    true,
+			ParseLegacy: parseLegacyKey,
+			ParseArgs:   argsParser(func() interface{} { return &keyArgs{} }),
+			// result: true if the key exists, false if it does not
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				return trie.Has(args.(*keyArgs).Key)
+			},
+			Describe: func(args interface{}) string {
+				return "checking if " + args.(*keyArgs).Key + " exists"
+			},
+		},
+		{
+			Name:     "completions",
+			Code:     CMD_COMPLETIONS,
+			ReadOnly: true,
+			ParseLegacy: func(argument []byte) (interface{}, error) {
+				return &completionsArgs{Prefix: string(argument)}, nil
+			},
+			ParseArgs: argsParser(func() interface{} { return &completionsArgs{} }),
+			// result: list of completions
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				completionsArgs := args.(*completionsArgs)
+				if completionsArgs.Limit < 0 {
+					return nil, errNegativeLimit
+				}
+
+				// Only the keys that fit are visited
+				completions, _, _, err := trie.CompletionsFrom(completionsArgs.Prefix, "", completionsArgs.Limit)
+				if err != nil {
+					return nil, err
+				}
+				return completions, nil
+			},
+			Describe: func(args interface{}) string {
+				return "completing " + args.(*completionsArgs).Prefix
+			},
+		},
+		{
+			Name:     "keys",
+			Code:     CMD_KEYS,
+			ReadOnly: true,
+			ParseLegacy: func(argument []byte) (interface{}, error) {
+				if len(argument) > 0 {
+					return nil, &CodedError{Code: ERR_CODE_INVALID, Message: "key listing command takes no arguments"}
+				}
+				return &keysArgs{}, nil
+			},
+			ParseArgs: argsParser(func() interface{} { return &keysArgs{} }),
+			// result: list of keys
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				limit := args.(*keysArgs).Limit
+				if limit < 0 {
+					return nil, errNegativeLimit
+				}
+
+				keys, _, _, err := trie.CompletionsFrom("", "", limit)
+				if err != nil {
+					return nil, err
+				}
+				return keys, nil
+			},
+			Describe: func(args interface{}) string {
+				return "listing keys"
+			},
+		},
+		{
+			Name:      "count",
+			Code:      NO_LEGACY_CODE,
+			ReadOnly:  true,
+			ParseArgs: argsParser(func() interface{} { return &struct{}{} }),
+			// result: the number of keys
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				return trie.Size(), nil
+			},
+			Describe: func(args interface{}) string {
+				return "counting keys"
+			},
+		},
+		{
+			Name:      "range",
+			Code:      NO_LEGACY_CODE,
+			ReadOnly:  true,
+			ParseArgs: argsParser(func() interface{} { return &rangeArgs{} }),
+			// result: a page of keys, and where the next page starts
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				rangeArgs := args.(*rangeArgs)
+				if rangeArgs.Limit < 0 {
+					return nil, errNegativeLimit
+				}
+
+				keys, next, more, err := trie.CompletionsFrom(rangeArgs.Prefix, rangeArgs.Start, rangeArgs.Limit)
+				if err != nil {
+					return nil, err
+				}
+				return RangeResult{Keys: keys, More: more, Next: next}, nil
+			},
+			Describe: func(args interface{}) string {
+				rangeArgs := args.(*rangeArgs)
+				return fmt.Sprintf("listing %d keys starting with %s from %s", rangeArgs.Limit, rangeArgs.Prefix, rangeArgs.Start)
+			},
+		},
+		{
+			Name:        "get",
+			Code:        CMD_GET,
+			ReadOnly:    true,
+			ParseLegacy: parseLegacyKey,
+			ParseArgs:   argsParser(func() interface{} { return &keyArgs{} }),
+			// result: whether the key exists, and its version
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				version, err := trie.GetVersion(args.(*keyArgs).Key)
+				if err != nil {
+					return nil, err
+				}
+				return KeyInfo{Exists: version != 0, Version: version}, nil
+			},
+			Describe: func(args interface{}) string {
+				return "getting " + args.(*keyArgs).Key
+			},
+		},
+		{
+			Name:        "insert_if",
+			Code:        CMD_INSERT_IF,
+			ParseLegacy: parseLegacyVersionedKey,
+			ParseArgs:   argsParser(func() interface{} { return &versionedKeyArgs{} }),
+			// result: the new version of the key
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				versionedKeyArgs := args.(*versionedKeyArgs)
+				return trie.AddIfVersion(versionedKeyArgs.Key, versionedKeyArgs.Version)
+			},
+			Describe: func(args interface{}) string {
+				versionedKeyArgs := args.(*versionedKeyArgs)
+				return fmt.Sprintf("inserting %s if version is %d", versionedKeyArgs.Key, versionedKeyArgs.Version)
+			},
+		},
+		{
+			Name:        "delete_if",
+			Code:        CMD_DELETE_IF,
+			ParseLegacy: parseLegacyVersionedKey,
+			ParseArgs:   argsParser(func() interface{} { return &versionedKeyArgs{} }),
+			// result: true if the key was deleted, false if it was not present
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				versionedKeyArgs := args.(*versionedKeyArgs)
+				return trie.RemoveIfVersion(versionedKeyArgs.Key, versionedKeyArgs.Version)
+			},
+			Describe: func(args interface{}) string {
+				versionedKeyArgs := args.(*versionedKeyArgs)
+				return fmt.Sprintf("deleting %s if version is %d", versionedKeyArgs.Key, versionedKeyArgs.Version)
+			},
+		},
+		{
+			Name:        "update_if",
+			Code:        CMD_UPDATE_IF,
+			ParseLegacy: parseLegacyVersionedKey,
+			ParseArgs:   argsParser(func() interface{} { return &versionedKeyArgs{} }),
+			// result: the new version of the key
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				versionedKeyArgs := args.(*versionedKeyArgs)
+				return trie.UpdateIfVersion(versionedKeyArgs.Key, versionedKeyArgs.Version)
+			},
+			Describe: func(args interface{}) string {
+				versionedKeyArgs := args.(*versionedKeyArgs)
+				return fmt.Sprintf("updating %s if version is %d", versionedKeyArgs.Key, versionedKeyArgs.Version)
+			},
+		},
+		{
+			Name: "batch",
+			Code: CMD_BATCH,
+			ParseLegacy: func(argument []byte) (interface{}, error) {
+				if len(argument) < 1 {
+					return nil, &CodedError{Code: ERR_CODE_INVALID, Message: "batch command takes a command code"}
+				}
+
+				op, ok := batchOpsByCode[argument[0]-ASCII_0]
+				if !ok {
+					return nil, errBatchOp
+				}
+
+				keys, err := parseKeyList(argument[1:])
+				if err != nil {
+					return nil, err
+				}
+
+				return &batchArgs{Op: op, Keys: keys}, nil
+			},
+			ParseArgs: argsParser(func() interface{} { return &batchArgs{} }),
+			// result: per-key results and summary counts
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				batchArgs := args.(*batchArgs)
+				op, ok := batchOps[batchArgs.Op]
+				if !ok {
+					return nil, errBatchOp
+				}
+				return runBatch(op(trie), batchArgs.Keys), nil
+			},
+			Describe: func(args interface{}) string {
+				batchArgs := args.(*batchArgs)
+				return fmt.Sprintf("running batch of %d %s commands", len(batchArgs.Keys), batchArgs.Op)
+			},
+		},
+		{
+			Name:      "exists_many",
+			Code:      NO_LEGACY_CODE,
+			ReadOnly:  true,
+			ParseArgs: argsParser(func() interface{} { return &keyListArgs{} }),
+			// result: per-key results and summary counts, like a batch of exists
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				return runBatch(trie.Has, args.(*keyListArgs).Keys), nil
+			},
+			Describe: func(args interface{}) string {
+				return fmt.Sprintf("checking if %d keys exist", len(args.(*keyListArgs).Keys))
+			},
+		},
+		{
+			Name:      "hello",
+			Code:      NO_LEGACY_CODE,
+			ReadOnly:  true,
+			ParseArgs: argsParser(func() interface{} { return &helloArgs{} }),
+			// result: the negotiated protocol version
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				versions := args.(*helloArgs).Versions
+
+				// Pick the highest version both sides support
+				for i := len(SUPPORTED_PROTOCOL_VERSIONS) - 1; i >= 0; i-- {
+					for _, version := range versions {
+						if version == SUPPORTED_PROTOCOL_VERSIONS[i] {
+							return HelloResult{Version: version, Versions: SUPPORTED_PROTOCOL_VERSIONS}, nil
+						}
+					}
+				}
+
+				return nil, &CodedError{
+					Code:    ERR_CODE_UNSUPPORTED_VERSION,
+					Message: fmt.Sprintf("no common protocol version (server supports %v)", SUPPORTED_PROTOCOL_VERSIONS),
+				}
+			},
+		},
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/logger"
+)
+
+/*
+Compaction keeps the write-ahead log from growing forever. It saves a snapshot of the
+trie, then deletes the log files that the snapshot covers:
+
+ 1. Under the read lock, the trie is copied and the log moves on to a new file. Reads go
+    on, but changes wait for the copy, which takes time in proportion to the keys.
+ 2. The changes in the copy are committed, and the copy is saved as a snapshot, while
+    changes go on (into the new file).
+ 3. The log files before the new one are deleted.
+
+If the server stops halfway, it restarts from the previous snapshot and all the log
+files, which still hold every change.
+
+A namespace is compacted in the background once its log reaches
+CompactionPolicy.MinBytes and has grown by CompactionPolicy.GrowthPercent since the
+last compaction. The "compact" command compacts it on demand, and "compaction_status"
+describes the last compaction.
+*/
+const (
+	// Default size of the log before it is compacted
+	COMPACTION_DEFAULT_MIN_BYTES = 64 << 20
+	// Default growth of the log, as a percentage of the snapshot's size, before it is compacted
+	COMPACTION_DEFAULT_GROWTH_PERCENT = 100
+)
+
+/*
+A CompactionPolicy says when a namespace is compacted on its own.
+*/
+type CompactionPolicy struct {
+	// MinBytes is the size the log must reach (0 turns automatic compaction off)
+	MinBytes int64
+	// GrowthPercent is how large the log must also be, relative to the last snapshot
+	GrowthPercent int
+}
+
+/*
+CompactionStatus describes a namespace's compactions.
+*/
+type CompactionStatus struct {
+	Namespace string `json:"namespace"`
+	// Running is true while a compaction is in progress
+	Running bool `json:"running"`
+	// Compactions is the number of compactions that succeeded since the server started
+	Compactions int `json:"compactions"`
+	// LogBytes and LogFiles describe the write-ahead log now
+	LogBytes int64 `json:"log_bytes"`
+	LogFiles int   `json:"log_files"`
+
+	// The last compaction, if any
+	LastStarted    *time.Time `json:"last_started,omitempty"`
+	LastDurationMs int64      `json:"last_duration_ms"`
+	// LastRevision is the revision of the last compaction's snapshot
+	LastRevision uint64 `json:"last_revision"`
+	// LastSnapshotBytes is the size of the last compaction's snapshot
+	LastSnapshotBytes int64  `json:"last_snapshot_bytes"`
+	LastError         string `json:"last_error,omitempty"`
+}
+
+// The compactions of a dispatcher
+type compactor struct {
+	policy CompactionPolicy
+
+	mutex  sync.Mutex
+	status CompactionStatus
+}
+
+// Arguments of the compact command
+type compactArgs struct {
+	// Wait makes the command return once the compaction is done, instead of right away
+	Wait bool `json:"wait"`
+}
+
+/*
+UseCompaction compacts the write-ahead log according to a policy, and registers the
+"compact" and "compaction_status" commands. It must be called after UseSnapshots and
+UseWriteAheadLog.
+*/
+func (s *ThreadSafeDispatcher) UseCompaction(policy CompactionPolicy) error {
+	s.compactor = &compactor{policy: policy, status: CompactionStatus{Namespace: s.name}}
+
+	for _, command := range compactionCommands(s) {
+		if err := s.commands.Register(command); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+CompactionStatus describes the dispatcher's compactions.
+*/
+func (s *ThreadSafeDispatcher) CompactionStatus() CompactionStatus {
+	if s.compactor == nil {
+		return CompactionStatus{Namespace: s.name}
+	}
+
+	s.compactor.mutex.Lock()
+	status := s.compactor.status
+	s.compactor.mutex.Unlock()
+
+	status.LogBytes, status.LogFiles = s.wal.Size()
+	return status
+}
+
+/*
+Compact saves a snapshot and deletes the write-ahead log files it covers. It fails with
+ERR_CODE_CONFLICT if a compaction is already running.
+*/
+func (s *ThreadSafeDispatcher) Compact() error {
+	if err := s.startCompaction(); err != nil {
+		return err
+	}
+	return s.compact()
+}
+
+/*
+Starts compacting in the background, if the log has grown enough.
+Called after every change.
+*/
+func (s *ThreadSafeDispatcher) maybeCompact() {
+	if s.compactor == nil || s.compactor.policy.MinBytes <= 0 {
+		return
+	}
+
+	logBytes, _ := s.wal.Size()
+	if logBytes < s.compactor.policy.MinBytes {
+		return
+	}
+
+	s.compactor.mutex.Lock()
+	growth := s.compactor.status.LastSnapshotBytes * int64(s.compactor.policy.GrowthPercent) / 100
+	s.compactor.mutex.Unlock()
+	if logBytes < growth {
+		return
+	}
+
+	if s.startCompaction() == nil {
+		logger.Infof("compacting namespace %s, whose log has reached %d bytes", s.name, logBytes)
+		go s.compact()
+	}
+}
+
+// Marks a compaction as running, failing if one already is
+func (s *ThreadSafeDispatcher) startCompaction() error {
+	if s.compactor == nil {
+		return &CodedError{Code: ERR_CODE_INVALID, Message: "compaction needs snapshots and the write-ahead log"}
+	}
+
+	s.compactor.mutex.Lock()
+	defer s.compactor.mutex.Unlock()
+
+	if s.compactor.status.Running {
+		return &CodedError{Code: ERR_CODE_CONFLICT, Message: "namespace " + s.name + " is already being compacted"}
+	}
+	now := time.Now()
+	s.compactor.status.Running = true
+	s.compactor.status.LastStarted = &now
+	return nil
+}
+
+/*
+Runs a compaction marked as running by startCompaction.
+*/
+func (s *ThreadSafeDispatcher) compact() error {
+	start := time.Now()
+	info, removed, err := s.compactSteps()
+
+	s.compactor.mutex.Lock()
+	status := &s.compactor.status
+	status.Running = false
+	status.LastDurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		status.LastError = err.Error()
+	} else {
+		status.Compactions++
+		status.LastError = ""
+		status.LastRevision = info.Revision
+		status.LastSnapshotBytes = info.Bytes
+	}
+	s.compactor.mutex.Unlock()
+
+	if err != nil {
+		logger.Errorf("Error compacting namespace %s: %v", s.name, err)
+		return err
+	}
+
+	logger.Infof("compacted namespace %s at revision %d in %v: %d keys, %d bytes of snapshot, %d log files deleted",
+		s.name, info.Revision, time.Since(start), info.Keys, info.Bytes, removed)
+	return nil
+}
+
+func (s *ThreadSafeDispatcher) compactSteps() (SnapshotInfo, int, error) {
+	// Only copying the trie and switching files holds up changes. No change can be made
+	// under the read lock, so the copy and the switch agree.
+	s.dispatcherMutex.RLock()
+	if s.failed != nil {
+		s.dispatcherMutex.RUnlock()
+		return SnapshotInfo{}, 0, s.failed
+	}
+	trie := s.trie.Clone()
+	position := s.wal.Position()
+	err := s.wal.Rotate(trie.Clock + 1)
+	s.dispatcherMutex.RUnlock()
+	if err != nil {
+		return SnapshotInfo{}, 0, err
+	}
+
+	// The snapshot may only hold durable changes
+	if err := s.commit(position); err != nil {
+		return SnapshotInfo{}, 0, err
+	}
+
+	info, err := s.snapshots.Save(trie)
+	if err != nil {
+		return SnapshotInfo{}, 0, err
+	}
+
+	removed, err := s.wal.RemoveBefore(trie.Clock + 1)
+	return info, removed, err
+}
+
+/*
+Returns the "compact" and "compaction_status" commands of a dispatcher's namespace.
+Like "snapshot", they take the dispatcher's lock themselves.
+*/
+func compactionCommands(dispatcher *ThreadSafeDispatcher) []*Command {
+	return []*Command{
+		{
+			Name:      "compact",
+			Code:      NO_LEGACY_CODE,
+			Unlocked:  true,
+			ParseArgs: argsParser(func() interface{} { return &compactArgs{} }),
+			// result: the CompactionStatus, once the compaction started (or finished, with wait)
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				if err := dispatcher.startCompaction(); err != nil {
+					return nil, err
+				}
+
+				if args.(*compactArgs).Wait {
+					if err := dispatcher.compact(); err != nil {
+						return nil, err
+					}
+				} else {
+					go dispatcher.compact()
+				}
+				return dispatcher.CompactionStatus(), nil
+			},
+			Describe: func(args interface{}) string {
+				return "compacting namespace " + dispatcher.name
+			},
+		},
+		{
+			Name:      "compaction_status",
+			Code:      NO_LEGACY_CODE,
+			ReadOnly:  true,
+			Unlocked:  true,
+			ParseArgs: argsParser(func() interface{} { return &struct{}{} }),
+			// result: a CompactionStatus
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				return dispatcher.CompactionStatus(), nil
+			},
+		},
+	}
+}
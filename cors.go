@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/*
+Browsers only let pages use the server from other origins if the server allows it.
+An OriginPolicy lists the origins that may, each in one of these forms:
+
+	https://app.example.com    exactly this origin
+	https://*.example.com      any subdomain of example.com, over https
+	*.example.com              any subdomain of example.com, over any scheme
+	~https://[a-z]+\.dev:\d+   any origin that the regular expression matches in full
+	*                          any origin
+
+Wildcards match the origin's host name, whatever its port. A policy that allows any origin
+can't also allow credentials, just as browsers refuse a literal "*" with credentials:
+every website could then act as its visitors.
+
+The policy decides both which pages may open WebSockets and which may read HTTP responses
+through CORS. Without a policy, WebSockets may be opened from any origin, and HTTP responses
+carry no CORS headers, so only pages on the server's own origin can read them.
+*/
+const (
+	CORS_ALLOWED_METHODS = "GET, HEAD, POST, PUT, DELETE"
+	CORS_ALLOWED_HEADERS = "Authorization, Content-Type, If-Match, If-None-Match, Last-Event-ID"
+	CORS_EXPOSED_HEADERS = "ETag"
+	// How long browsers may cache the answer to a preflight request
+	CORS_MAX_AGE_SECONDS = 600
+)
+
+/*
+An OriginPolicy decides which origins may use the server from a browser.
+*/
+type OriginPolicy struct {
+	// allowCredentials lets pages send cookies and client certificates with their requests
+	allowCredentials bool
+
+	anyOrigin bool
+	exact     map[string]bool
+	wildcards []originWildcard
+	patterns  []*regexp.Regexp
+}
+
+// An origin pattern of the form [scheme://]*.domain
+type originWildcard struct {
+	// scheme is empty if any scheme matches
+	scheme string
+	// suffix is the domain, with a leading "."
+	suffix string
+}
+
+/*
+NewOriginPolicy parses a list of allowed origins, and whether pages on them may send credentials.
+*/
+func NewOriginPolicy(origins []string, allowCredentials bool) (*OriginPolicy, error) {
+	policy := &OriginPolicy{exact: make(map[string]bool), allowCredentials: allowCredentials}
+
+	for _, origin := range origins {
+		origin = strings.TrimSpace(origin)
+
+		switch {
+		case origin == "":
+			continue
+
+		case origin == "*":
+			policy.anyOrigin = true
+
+		case strings.HasPrefix(origin, "~"):
+			pattern, err := regexp.Compile("^(?:" + origin[1:] + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("origin pattern %q: %v", origin, err)
+			}
+			policy.patterns = append(policy.patterns, pattern)
+
+		case strings.Contains(origin, "*"):
+			scheme := ""
+			host := origin
+			if i := strings.Index(origin, "://"); i >= 0 {
+				scheme = strings.ToLower(origin[:i])
+				host = origin[i+3:]
+			}
+			if !strings.HasPrefix(host, "*.") || strings.Contains(host[1:], "*") {
+				return nil, fmt.Errorf("origin %q may only have a wildcard in place of its subdomain", origin)
+			}
+			policy.wildcards = append(policy.wildcards, originWildcard{scheme: scheme, suffix: strings.ToLower(host[1:])})
+
+		default:
+			policy.exact[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+		}
+	}
+
+	if policy.anyOrigin && allowCredentials {
+		return nil, errors.New("credentials can't be allowed from any origin (\"*\"); list the origins instead")
+	}
+	return policy, nil
+}
+
+/*
+Allows returns whether pages on an origin (the value of an Origin header) may use the server.
+*/
+func (p *OriginPolicy) Allows(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+
+	normalized := strings.ToLower(origin)
+	if p.exact[normalized] {
+		return true
+	}
+
+	if len(p.wildcards) > 0 {
+		if parsed, err := url.Parse(normalized); err == nil && parsed.Host != "" {
+			// The pattern is a domain, so the port doesn't matter
+			hostname := parsed.Hostname()
+			for _, wildcard := range p.wildcards {
+				if wildcard.scheme != "" && wildcard.scheme != parsed.Scheme {
+					continue
+				}
+				// The subdomain must not be empty
+				if strings.HasSuffix(hostname, wildcard.suffix) && len(hostname) > len(wildcard.suffix) {
+					return true
+				}
+			}
+		}
+	}
+
+	for _, pattern := range p.patterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+UseOrigins restricts browsers to the origins a policy allows, and lets them make
+cross-origin HTTP requests from those origins.
+*/
+func (s *Server) UseOrigins(policy *OriginPolicy) {
+	s.origins = policy
+}
+
+/*
+The upgrader's CheckOrigin. Requests without an Origin header don't come from
+browsers, and pages can always connect to their own origin.
+*/
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || s.origins == nil {
+		return true
+	}
+
+	if parsed, err := url.Parse(origin); err == nil && strings.EqualFold(parsed.Host, r.Host) {
+		return true
+	}
+	return s.origins.Allows(origin)
+}
+
+/*
+Adds CORS headers to the responses of a handler, and answers preflight requests.
+Requests from origins the policy doesn't allow are still served, but without the
+headers, so the browser won't let the page read the response.
+*/
+func (s *Server) withCORS(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || s.origins == nil {
+			handler(w, r)
+			return
+		}
+
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+
+		// The response depends on the origin, so caches must keep one per origin
+		w.Header().Add("Vary", "Origin")
+
+		if !s.origins.Allows(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			handler(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if s.origins.allowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", CORS_ALLOWED_METHODS)
+			w.Header().Set("Access-Control-Allow-Headers", CORS_ALLOWED_HEADERS)
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(CORS_MAX_AGE_SECONDS))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		w.Header().Set("Access-Control-Expose-Headers", CORS_EXPOSED_HEADERS)
+		handler(w, r)
+	}
+}
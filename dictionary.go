@@ -0,0 +1,653 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/logger"
+)
+
+/*
+A dictionary is a read-only trie stored in a file, which is mapped into memory and
+queried in place. Opening one takes no time at all, however large it is: pages are
+only read from disk as lookups reach them, and processes mapping the same file share
+them. Dictionaries are built ahead of time from a list of keys:
+
+	trie build-dictionary [-format lines|ndjson|csv] words.txt words.dict
+
+The input takes the formats of the "import" command (see bulk.go). Files named
+[NAMESPACE].dict in the dictionary directory are served as read-only namespaces, and
+more can be added while the server runs with the mount_dictionary command.
+unmount_dictionary removes one until the server restarts; to remove it for good, also
+remove its file. drop_namespace refuses dictionaries, since their files would bring them back.
+
+A dictionary namespace answers exists, get, completions, keys, range, export and
+batches of exists like any other. Its keys all have version DICTIONARY_KEY_VERSION.
+Commands that change keys fail with ERR_CODE_READ_ONLY, and the namespace isn't
+included in backups. To update a dictionary, mount a new file under another name and
+move an alias to it.
+
+The file is laid out as follows, with numbers in big-endian order:
+
+	magic         [8]byte   "TRIEDICT"
+	version       uint16    DICTIONARY_FORMAT_VERSION
+	flags         uint16    reserved, 0
+	reserved      uint32    0
+	keys          uint64    number of keys
+	nodes         uint64    number of nodes, including the root
+
+	nodes times, in breadth-first order (the root is node 0):
+		first edge  uint32    index of the node's first edge
+		edge count  uint16    number of edges, which follow the first one
+		flags       byte      1 if a key ends at this node
+		reserved    byte      0
+
+	nodes-1 labels, one per edge:  byte    the character leading to the edge's child
+	nodes-1 children, one per edge: uint32  the index of the edge's child
+
+A node's edges are sorted by label, so a lookup takes one binary search per character,
+and listing keys in order is a depth-first walk. Every child comes after its parent.
+*/
+const (
+	DICTIONARY_MAGIC          = "TRIEDICT"
+	DICTIONARY_FORMAT_VERSION = 1
+	DICTIONARY_SUFFIX         = ".dict"
+	// Version of every key of a dictionary, and the revision of its namespace
+	DICTIONARY_KEY_VERSION = 1
+
+	dictionaryHeaderSize = 32
+	dictionaryNodeSize   = 8
+	dictionaryFlagEnd    = 1
+)
+
+var errDictionaryCorrupt = errors.New("dictionary file is corrupt")
+var errDictionaryClosed = errors.New("dictionary is closed")
+
+/*
+A Dictionary is a read-only trie mapped from a file.
+*/
+type Dictionary struct {
+	path string
+	data []byte
+	keys uint64
+	// The sections of the file
+	nodes    []byte
+	labels   []byte
+	children []byte
+}
+
+/*
+OpenDictionary maps a dictionary file into memory. Only its header is read.
+*/
+func OpenDictionary(path string) (*Dictionary, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, dictionaryHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return nil, fmt.Errorf("%s is not a dictionary", path)
+	}
+	if string(header[:8]) != DICTIONARY_MAGIC {
+		return nil, fmt.Errorf("%s is not a dictionary", path)
+	}
+	if version := binary.BigEndian.Uint16(header[8:]); version != DICTIONARY_FORMAT_VERSION {
+		return nil, fmt.Errorf("%s has dictionary format version %d, but only version %d is supported", path, version, DICTIONARY_FORMAT_VERSION)
+	}
+	keys := binary.BigEndian.Uint64(header[16:])
+	nodes := binary.BigEndian.Uint64(header[24:])
+	if nodes == 0 || nodes > 1<<32 {
+		return nil, fmt.Errorf("%s: %v", path, errDictionaryCorrupt)
+	}
+
+	edges := nodes - 1
+	size := dictionaryHeaderSize + nodes*dictionaryNodeSize + edges + edges*4
+	if uint64(stat.Size()) != size {
+		return nil, fmt.Errorf("%s should be %d bytes long, but is %d", path, size, stat.Size())
+	}
+
+	// Reading started at the beginning of the file, where the fallback reads from too
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := mapFile(file, int(size))
+	if err != nil {
+		return nil, fmt.Errorf("mapping %s: %v", path, err)
+	}
+
+	nodesEnd := dictionaryHeaderSize + nodes*dictionaryNodeSize
+	labelsEnd := nodesEnd + edges
+	return &Dictionary{
+		path:     path,
+		data:     data,
+		keys:     keys,
+		nodes:    data[dictionaryHeaderSize:nodesEnd],
+		labels:   data[nodesEnd:labelsEnd],
+		children: data[labelsEnd:],
+	}, nil
+}
+
+/*
+Close unmaps the dictionary. It can't be used afterwards.
+*/
+func (d *Dictionary) Close() error {
+	data := d.data
+	d.data, d.nodes, d.labels, d.children = nil, nil, nil, nil
+	if data == nil {
+		return nil
+	}
+	return unmapFile(data)
+}
+
+// Size returns the number of keys in the dictionary
+func (d *Dictionary) Size() int {
+	return int(d.keys)
+}
+
+// Has returns whether the dictionary contains a key
+func (d *Dictionary) Has(key string) (bool, error) {
+	version, err := d.GetVersion(key)
+	return version != 0, err
+}
+
+// GetVersion returns DICTIONARY_KEY_VERSION if the dictionary contains a key, or 0
+func (d *Dictionary) GetVersion(key string) (uint64, error) {
+	if len(key) >= MAX_KEY_LENGTH {
+		return 0, errKeyTooLong
+	}
+
+	node, ok, err := d.walk(key)
+	if err != nil || !ok {
+		return 0, err
+	}
+	_, _, end, err := d.node(node)
+	if err != nil || !end {
+		return 0, err
+	}
+	return DICTIONARY_KEY_VERSION, nil
+}
+
+/*
+CompletionsFrom is like Trie.CompletionsFrom: it returns up to `limit` keys that begin
+with `prefix` and sort at or after `start`, and the first key that didn't fit.
+*/
+func (d *Dictionary) CompletionsFrom(prefix string, start string, limit int) ([]string, string, bool, error) {
+	if len(prefix) >= MAX_KEY_LENGTH {
+		return nil, "", false, errPrefixTooLong
+	}
+
+	node, ok, err := d.walk(prefix)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if !ok {
+		return []string{}, "", false, nil
+	}
+
+	page := &keyPage{start: start, limit: limit, keys: make([]string, 0)}
+	if _, err := d.collectPage(node, []byte(prefix), page); err != nil {
+		return nil, "", false, err
+	}
+	return page.keys, page.next, page.more, nil
+}
+
+// Like Trie.collectPage, for the node at index `node`
+func (d *Dictionary) collectPage(node uint32, path []byte, page *keyPage) (bool, error) {
+	current := string(path)
+	if current < page.start && !strings.HasPrefix(page.start, current) {
+		return false, nil
+	}
+
+	first, count, end, err := d.node(node)
+	if err != nil {
+		return false, err
+	}
+
+	if end && current >= page.start {
+		if page.limit > 0 && len(page.keys) == page.limit {
+			page.next = current
+			page.more = true
+			return true, nil
+		}
+		page.keys = append(page.keys, current)
+	}
+
+	for edge := first; edge < first+count; edge++ {
+		child, err := d.child(node, edge)
+		if err != nil {
+			return false, err
+		}
+		if full, err := d.collectPage(child, append(path, d.labels[edge]), page); full || err != nil {
+			return full, err
+		}
+	}
+	return false, nil
+}
+
+// Follows the edges for the characters of a key from the root, returning the node reached
+func (d *Dictionary) walk(key string) (uint32, bool, error) {
+	if d.data == nil {
+		return 0, false, errDictionaryClosed
+	}
+
+	var node uint32
+	for i := 0; i < len(key); i++ {
+		first, count, _, err := d.node(node)
+		if err != nil {
+			return 0, false, err
+		}
+
+		labels := d.labels[first : first+count]
+		index := sort.Search(len(labels), func(j int) bool { return labels[j] >= key[i] })
+		if index == len(labels) || labels[index] != key[i] {
+			return 0, false, nil
+		}
+		if node, err = d.child(node, first+uint32(index)); err != nil {
+			return 0, false, err
+		}
+	}
+	return node, true, nil
+}
+
+// Reads a node's entry: the indexes of its edges, and whether a key ends there
+func (d *Dictionary) node(node uint32) (uint32, uint32, bool, error) {
+	offset := uint64(node) * dictionaryNodeSize
+	entry := d.nodes[offset : offset+dictionaryNodeSize]
+	first := binary.BigEndian.Uint32(entry)
+	count := uint32(binary.BigEndian.Uint16(entry[4:]))
+	if uint64(first)+uint64(count) > uint64(len(d.labels)) {
+		return 0, 0, false, errDictionaryCorrupt
+	}
+	return first, count, entry[6]&dictionaryFlagEnd != 0, nil
+}
+
+// Reads the child of an edge, making sure that walks can't loop
+func (d *Dictionary) child(parent uint32, edge uint32) (uint32, error) {
+	child := binary.BigEndian.Uint32(d.children[uint64(edge)*4:])
+	if child <= parent || uint64(child)*dictionaryNodeSize >= uint64(len(d.nodes)) {
+		return 0, errDictionaryCorrupt
+	}
+	return child, nil
+}
+
+/*
+WriteDictionary writes the keys of a trie in the dictionary format.
+*/
+func WriteDictionary(w io.Writer, trie *Trie) error {
+	// Number the nodes breadth-first, laying out each node's edges as it is reached
+	queue := []*TrieNode{trie.TrieNode}
+	var nodes, labels, children []byte
+	var keys uint64
+	for i := 0; i < len(queue); i++ {
+		node := queue[i]
+
+		var flags byte
+		if node.IsEndOfWord {
+			flags |= dictionaryFlagEnd
+			keys++
+		}
+		nodes = appendUint32(nodes, uint32(len(labels)))
+		nodes = appendUint16(nodes, uint16(len(node.Subtries)))
+		nodes = append(nodes, flags, 0)
+
+		for _, character := range node.sortedCharacters() {
+			if uint64(len(queue)) >= 1<<32 {
+				return errors.New("too many nodes for a dictionary")
+			}
+			labels = append(labels, character)
+			children = appendUint32(children, uint32(len(queue)))
+			queue = append(queue, node.Subtries[character])
+		}
+	}
+
+	header := []byte(DICTIONARY_MAGIC)
+	header = appendUint16(header, DICTIONARY_FORMAT_VERSION)
+	header = appendUint16(header, 0)
+	header = appendUint32(header, 0)
+	header = appendUint64(header, keys)
+	header = appendUint64(header, uint64(len(queue)))
+
+	for _, section := range [][]byte{header, nodes, labels, children} {
+		if _, err := w.Write(section); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+BuildDictionary writes a dictionary file holding some keys, replacing the file at once.
+It returns the size of the file.
+*/
+func BuildDictionary(path string, keys []string) (int64, error) {
+	trie := NewTrie()
+	for _, key := range keys {
+		if _, err := trie.Add(key); err != nil {
+			return 0, fmt.Errorf("adding %q: %v", key, err)
+		}
+	}
+	return writeFileAtomically(path, func(w io.Writer) error {
+		return WriteDictionary(w, trie)
+	})
+}
+
+/*
+Runs the build-dictionary command line, returning the exit code.
+*/
+func buildDictionaryMain(arguments []string) int {
+	flags := flag.NewFlagSet("build-dictionary", flag.ContinueOnError)
+	format := flags.String("format", BULK_FORMAT_LINES, "format of the input: lines, ndjson or csv")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: trie build-dictionary [-format lines|ndjson|csv] INPUT OUTPUT")
+		fmt.Fprintln(flags.Output(), "Builds a dictionary file from a list of keys. An INPUT of - reads standard input.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(arguments); err != nil {
+		return 2
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+	input, output := flags.Arg(0), flags.Arg(1)
+
+	var data []byte
+	var err error
+	if input == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(input)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "reading %s: %v\n", input, err)
+		return 1
+	}
+
+	keys, rejected, err := parseImport(*format, string(data))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, ErrorMessage(err))
+		return 1
+	}
+	for _, line := range rejected {
+		fmt.Fprintf(os.Stderr, "%s:%d: %s\n", input, line.Line, line.Reason)
+	}
+
+	size, err := BuildDictionary(output, keys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "building %s: %v\n", output, err)
+		return 1
+	}
+	fmt.Printf("wrote %s: %d keys, %d lines rejected, %d bytes\n", output, len(keys), len(rejected), size)
+	return 0
+}
+
+/*
+Creates a dispatcher that serves a dictionary, with read-only commands.
+*/
+func newDictionaryDispatcher(dictionary *Dictionary) *ThreadSafeDispatcher {
+	dispatcher := &ThreadSafeDispatcher{
+		trie:       NewTrie(),
+		commands:   NewCommandRegistry(),
+		changes:    NewChangeHub(),
+		dictionary: dictionary,
+	}
+	dispatcher.trie.Clock = DICTIONARY_KEY_VERSION
+
+	for _, command := range dictionaryCommands(dispatcher) {
+		if err := dispatcher.commands.Register(command); err != nil {
+			// They are the built-in commands, which never clash
+			panic(err)
+		}
+	}
+	return dispatcher
+}
+
+// The error of commands that would change a dictionary
+func (s *ThreadSafeDispatcher) readOnlyError() error {
+	return &CodedError{Code: ERR_CODE_READ_ONLY, Message: fmt.Sprintf("namespace %q is a read-only dictionary", s.name)}
+}
+
+/*
+Returns the built-in commands and "import" and "export", answered from a dispatcher's
+dictionary. The ones that would change it fail.
+*/
+func dictionaryCommands(dispatcher *ThreadSafeDispatcher) []*Command {
+	dictionary := dispatcher.dictionary
+	readOnly := func(trie *Trie, args interface{}) (interface{}, error) {
+		return nil, dispatcher.readOnlyError()
+	}
+
+	runs := map[string]func(trie *Trie, args interface{}) (interface{}, error){
+		"exists": func(trie *Trie, args interface{}) (interface{}, error) {
+			return dictionary.Has(args.(*keyArgs).Key)
+		},
+		"get": func(trie *Trie, args interface{}) (interface{}, error) {
+			version, err := dictionary.GetVersion(args.(*keyArgs).Key)
+			if err != nil {
+				return nil, err
+			}
+			return KeyInfo{Exists: version != 0, Version: version}, nil
+		},
+		"completions": func(trie *Trie, args interface{}) (interface{}, error) {
+			completionsArgs := args.(*completionsArgs)
+			if completionsArgs.Limit < 0 {
+				return nil, errNegativeLimit
+			}
+			// Only the keys that fit are read
+			completions, _, _, err := dictionary.CompletionsFrom(completionsArgs.Prefix, "", completionsArgs.Limit)
+			if err != nil {
+				return nil, err
+			}
+			return completions, nil
+		},
+		"keys": func(trie *Trie, args interface{}) (interface{}, error) {
+			limit := args.(*keysArgs).Limit
+			if limit < 0 {
+				return nil, errNegativeLimit
+			}
+			keys, _, _, err := dictionary.CompletionsFrom("", "", limit)
+			if err != nil {
+				return nil, err
+			}
+			return keys, nil
+		},
+		"count": func(trie *Trie, args interface{}) (interface{}, error) {
+			return dictionary.Size(), nil
+		},
+		"range": func(trie *Trie, args interface{}) (interface{}, error) {
+			rangeArgs := args.(*rangeArgs)
+			if rangeArgs.Limit < 0 {
+				return nil, errNegativeLimit
+			}
+
+			keys, next, more, err := dictionary.CompletionsFrom(rangeArgs.Prefix, rangeArgs.Start, rangeArgs.Limit)
+			if err != nil {
+				return nil, err
+			}
+			return RangeResult{Keys: keys, More: more, Next: next}, nil
+		},
+		"batch": func(trie *Trie, args interface{}) (interface{}, error) {
+			batchArgs := args.(*batchArgs)
+			if batchArgs.Op != "exists" {
+				return nil, dispatcher.readOnlyError()
+			}
+			return runBatch(dictionary.Has, batchArgs.Keys), nil
+		},
+		"exists_many": func(trie *Trie, args interface{}) (interface{}, error) {
+			return runBatch(dictionary.Has, args.(*keyListArgs).Keys), nil
+		},
+		"export": func(trie *Trie, args interface{}) (interface{}, error) {
+			exportArgs := args.(*exportArgs)
+			keys, _, _, err := dictionary.CompletionsFrom(exportArgs.Prefix, "", 0)
+			if err != nil {
+				return nil, err
+			}
+			return exportKeys(exportArgs.Format, keys)
+		},
+		// Negotiating a protocol version doesn't touch any key
+		"hello": nil,
+	}
+
+	commands := append(builtinCommands(), bulkCommands(dispatcher)...)
+	for _, command := range commands {
+		run, ok := runs[command.Name]
+		if !ok {
+			command.Run = readOnly
+		} else if run != nil {
+			command.Run = run
+		}
+	}
+	return commands
+}
+
+/*
+Mount adds a namespace that serves a dictionary. The namespace owns the dictionary,
+and closes it when it is dropped.
+*/
+func (n *Namespaces) Mount(name string, dictionary *Dictionary) (*ThreadSafeDispatcher, error) {
+	if err := validateNamespaceName(name); err != nil {
+		return nil, err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if err := n.checkNameIsFree(name); err != nil {
+		return nil, err
+	}
+
+	dispatcher := newDictionaryDispatcher(dictionary)
+	dispatcher.name = name
+	dispatcher.namespaces = n
+	for _, command := range namespaceCommands(n) {
+		if err := dispatcher.commands.Register(command); err != nil {
+			return nil, err
+		}
+	}
+
+	n.dispatchers[name] = dispatcher
+	logger.Infof("mounted dictionary %s as namespace %s (%d keys)", dictionary.path, name, dictionary.Size())
+	return dispatcher, nil
+}
+
+/*
+MountFile opens a file of the dictionary directory and mounts it as a namespace.
+The file is named [NAME].dict unless another name is given.
+*/
+func (n *Namespaces) MountFile(name string, file string) (*ThreadSafeDispatcher, error) {
+	if n.dictionaryDir == "" {
+		return nil, &CodedError{Code: ERR_CODE_INVALID, Message: "the server has no dictionary directory"}
+	}
+	if file == "" {
+		file = name + DICTIONARY_SUFFIX
+	}
+	if file != filepath.Base(file) || strings.HasPrefix(file, ".") {
+		return nil, &CodedError{Code: ERR_CODE_INVALID, Message: "dictionaries must be files of the dictionary directory"}
+	}
+
+	dictionary, err := OpenDictionary(filepath.Join(n.dictionaryDir, file))
+	if err != nil {
+		return nil, &CodedError{Code: ERR_CODE_INVALID, Message: err.Error()}
+	}
+	dispatcher, err := n.Mount(name, dictionary)
+	if err != nil {
+		dictionary.Close()
+		return nil, err
+	}
+	return dispatcher, nil
+}
+
+/*
+UseDictionaries mounts every [NAMESPACE].dict file of a directory as a namespace, and
+lets mount_dictionary mount the files added to it later.
+*/
+func (n *Namespaces) UseDictionaries(dir string) error {
+	n.dictionaryDir = dir
+
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), DICTIONARY_SUFFIX)
+		if entry.IsDir() || name == entry.Name() {
+			continue
+		}
+		if _, err := n.MountFile(name, entry.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+Returns the "mount_dictionary" command, which mounts a file of the dictionary directory.
+*/
+func mountDictionaryCommand(namespaces *Namespaces) *Command {
+	return &Command{
+		Name:      "mount_dictionary",
+		Code:      NO_LEGACY_CODE,
+		Unlocked:  true,
+		ParseArgs: argsParser(func() interface{} { return &mountDictionaryArgs{} }),
+		// result: the new namespace's NamespaceInfo
+		Run: func(trie *Trie, args interface{}) (interface{}, error) {
+			mountArgs := args.(*mountDictionaryArgs)
+			dispatcher, err := namespaces.MountFile(mountArgs.Name, mountArgs.File)
+			if err != nil {
+				return nil, err
+			}
+			return dispatcher.Info(), nil
+		},
+		Describe: func(args interface{}) string {
+			return "mounting dictionary " + args.(*mountDictionaryArgs).Name
+		},
+	}
+}
+
+/*
+Returns the "unmount_dictionary" command, which unmounts a dictionary namespace.
+*/
+func unmountDictionaryCommand(namespaces *Namespaces) *Command {
+	return &Command{
+		Name:      "unmount_dictionary",
+		Code:      NO_LEGACY_CODE,
+		Unlocked:  true,
+		ParseArgs: argsParser(func() interface{} { return &namespaceArgs{} }),
+		// result: true
+		Run: func(trie *Trie, args interface{}) (interface{}, error) {
+			if err := namespaces.Unmount(args.(*namespaceArgs).Name); err != nil {
+				return nil, err
+			}
+			return true, nil
+		},
+		Describe: func(args interface{}) string {
+			return "unmounting dictionary " + args.(*namespaceArgs).Name
+		},
+	}
+}
+
+// Arguments of the mount_dictionary command
+type mountDictionaryArgs struct {
+	Name string `json:"name"`
+	// File is the dictionary's file name in the dictionary directory ([NAME].dict by default)
+	File string `json:"file"`
+}
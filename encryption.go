@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/google/logger"
+)
+
+/*
+Snapshots, write-ahead logs and changelogs can be encrypted at rest with AES-GCM, which
+also detects any change made to them. The keys come from a keyring, given either as a
+file (ENCRYPTION_KEY_FILE) or in the environment (ENCRYPTION_KEYS). The keyring lists
+keys one per line, or separated by commas, as an id and the base64 of a 16, 24 or
+32-byte AES key:
+
+	# id:key
+	2024-01:3q2+7wAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=
+	2024-07:q83vASNFZ4mrze8BI0VniavN7wEjRWeJq83vASNFZ4k=
+
+Files are encrypted with the last key, and record the id of the key they were encrypted
+with, so they can be read with any key of the keyring. To rotate keys, add a new key at
+the end and restart: new snapshots, log files and changelog lines use it, while the old
+ones stay readable with the previous key. Snapshots are rewritten as they are taken, and
+old log files are deleted by compaction (which the "compact" command starts at once) and
+changelog retention. The previous key can be removed once no file uses it.
+
+Once there is a keyring, files written without encryption are refused, so that whoever
+can write to the disk can't slip in changes. To turn encryption on for existing data,
+start once with ENCRYPTION_ALLOW_PLAINTEXT=1, which reads them, then compact every
+namespace and let the changelog's old segments go. Dictionaries and backups aren't
+encrypted.
+
+An encrypted snapshot or write-ahead log file starts with:
+
+	"TRIESEAL"            magic (8 bytes)
+	key id length         1 byte
+	key id
+
+An encrypted snapshot follows it with a nonce and the snapshot, sealed along with the
+namespace and the revision, so that snapshots can't be swapped. In an encrypted
+write-ahead log file, the payload of every record is a nonce and the plain payload,
+sealed along with the file's first revision and the record's offset, so that records
+can't be moved around. An encrypted changelog line is "!", the key id, ":" and the
+base64 of a nonce and the plain line, sealed along with the namespace, the segment's
+first revision and the line's offset, for the same reason.
+*/
+const (
+	ENCRYPTION_MAGIC = "TRIESEAL"
+	// Prefix of encrypted changelog lines
+	ENCRYPTION_CHANGELOG_PREFIX = "!"
+)
+
+// Ids of keys must match this
+var ENCRYPTION_KEY_ID_PATTERN = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+/*
+A Keyring holds the keys that files are encrypted with, by id.
+*/
+type Keyring struct {
+	ciphers map[string]cipher.AEAD
+	// current is the id of the key new files are encrypted with
+	current string
+	// allowPlaintext lets files that aren't encrypted be read, while migrating to encryption
+	allowPlaintext bool
+}
+
+/*
+ParseKeyring reads a keyring, made of "[ID]:[BASE64 KEY]" entries separated by new lines
+or commas. Blank lines and lines starting with "#" are skipped. The last key is current.
+*/
+func ParseKeyring(text string) (*Keyring, error) {
+	keyring := &Keyring{ciphers: make(map[string]cipher.AEAD)}
+
+	entries := strings.FieldsFunc(text, func(r rune) bool { return r == '\n' || r == ',' })
+	for i, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		colon := strings.IndexByte(entry, ':')
+		if colon < 0 {
+			return nil, fmt.Errorf("entry %d of the keyring should be [ID]:[BASE64 KEY]", i+1)
+		}
+		id := entry[:colon]
+		if !ENCRYPTION_KEY_ID_PATTERN.MatchString(id) {
+			return nil, fmt.Errorf("invalid key id %q (ids are 1 to 64 letters, digits, '.', '_' or '-')", id)
+		}
+		if _, ok := keyring.ciphers[id]; ok {
+			return nil, fmt.Errorf("key id %q appears twice", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(entry[colon+1:])
+		if err != nil {
+			return nil, fmt.Errorf("key %q isn't valid base64: %v", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q must be 16, 24 or 32 bytes long, not %d", id, len(key))
+		}
+		// NewGCM only fails for block sizes other than AES's
+		keyring.ciphers[id], _ = cipher.NewGCM(block)
+		keyring.current = id
+	}
+
+	if keyring.current == "" {
+		return nil, errors.New("the keyring has no keys")
+	}
+	return keyring, nil
+}
+
+/*
+LoadKeyring reads a keyring from a file.
+*/
+func LoadKeyring(path string) (*Keyring, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		logger.Warningf("the keyring %s can be read by other users (mode %v)", path, info.Mode().Perm())
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(string(data))
+}
+
+/*
+AllowPlaintext lets files written without encryption be read, so that encryption can be
+turned on for existing data. New files are encrypted all the same.
+*/
+func (k *Keyring) AllowPlaintext() {
+	k.allowPlaintext = true
+}
+
+// Fails if a file that isn't encrypted may not be read
+func (k *Keyring) checkPlaintext() error {
+	if k == nil || k.allowPlaintext {
+		return nil
+	}
+	return errors.New("data isn't encrypted, though there are encryption keys (set ENCRYPTION_ALLOW_PLAINTEXT=1 to read it while turning encryption on)")
+}
+
+/*
+Current returns the id of the key that new files are encrypted with.
+*/
+func (k *Keyring) Current() string {
+	return k.current
+}
+
+// Encrypts data with a key, returning a random nonce followed by the sealed data
+func (k *Keyring) seal(id string, plaintext []byte, additional []byte) []byte {
+	aead := k.ciphers[id]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		// The system's source of randomness never fails
+		panic(err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional)
+}
+
+// Decrypts data returned by seal, failing if it was changed
+func (k *Keyring) open(id string, sealed []byte, additional []byte) ([]byte, error) {
+	if k == nil {
+		return nil, fmt.Errorf("data is encrypted with key %q, but there are no encryption keys", id)
+	}
+	aead, ok := k.ciphers[id]
+	if !ok {
+		return nil, fmt.Errorf("data is encrypted with key %q, which isn't in the keyring", id)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is cut off")
+	}
+
+	nonce := sealed[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, sealed[aead.NonceSize():], additional)
+	if err != nil {
+		return nil, errors.New("encrypted data doesn't match its key or was changed")
+	}
+	return plaintext, nil
+}
+
+// Writes a snapshot of a namespace's trie, encrypted with the current key
+func (k *Keyring) writeSnapshot(w io.Writer, namespace string, trie *Trie) error {
+	var buffer bytes.Buffer
+	// Writing to memory never fails
+	WriteSnapshot(&buffer, trie)
+
+	header := encryptionHeader(k.current)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(k.seal(k.current, buffer.Bytes(), snapshotAdditionalData(header, namespace, trie.Clock)))
+	return err
+}
+
+/*
+Decrypts the file of a namespace's snapshot at a revision, returning the snapshot and the
+id of the key it was encrypted with. Snapshots that aren't encrypted are returned as they
+are, with an empty id, unless they may not be read (see checkPlaintext).
+*/
+func (k *Keyring) openSnapshot(data []byte, namespace string, revision uint64) ([]byte, string, error) {
+	id, size, err := parseEncryptionHeader(data)
+	if err != nil {
+		return nil, "", err
+	}
+	if id == "" {
+		return data, "", k.checkPlaintext()
+	}
+	snapshot, err := k.open(id, data[size:], snapshotAdditionalData(data[:size], namespace, revision))
+	return snapshot, id, err
+}
+
+// Returns the header of a file encrypted with a key
+func encryptionHeader(id string) []byte {
+	header := []byte(ENCRYPTION_MAGIC)
+	header = append(header, byte(len(id)))
+	return append(header, id...)
+}
+
+/*
+Reads the header of a file, returning the id of the key it was encrypted with and the
+header's size. Files that aren't encrypted have no header, and an empty id.
+*/
+func parseEncryptionHeader(data []byte) (string, int, error) {
+	if !bytes.HasPrefix(data, []byte(ENCRYPTION_MAGIC)) {
+		return "", 0, nil
+	}
+	if len(data) <= len(ENCRYPTION_MAGIC) {
+		return "", 0, errors.New("encryption header is cut off")
+	}
+
+	size := len(ENCRYPTION_MAGIC) + 1 + int(data[len(ENCRYPTION_MAGIC)])
+	if len(data) < size {
+		return "", 0, errors.New("encryption header is cut off")
+	}
+	id := string(data[len(ENCRYPTION_MAGIC)+1 : size])
+	if !ENCRYPTION_KEY_ID_PATTERN.MatchString(id) {
+		return "", 0, fmt.Errorf("invalid key id %q in encryption header", id)
+	}
+	return id, size, nil
+}
+
+// The additional data of an encrypted snapshot
+func snapshotAdditionalData(header []byte, namespace string, revision uint64) []byte {
+	additional := append([]byte("snapshot:"), header...)
+	additional = appendUvarint(additional, uint64(len(namespace)))
+	additional = append(additional, namespace...)
+	return appendUint64(additional, revision)
+}
+
+// The additional data of a record of an encrypted write-ahead log file
+func walAdditionalData(first uint64, offset int64) []byte {
+	additional := []byte("wal:")
+	additional = appendUint64(additional, first)
+	return appendUint64(additional, uint64(offset))
+}
+
+// The additional data of an encrypted changelog line, at an offset of a namespace's segment
+func changelogAdditionalData(namespace string, first uint64, offset int64) []byte {
+	additional := []byte("changelog:")
+	additional = appendUvarint(additional, uint64(len(namespace)))
+	additional = append(additional, namespace...)
+	additional = appendUint64(additional, first)
+	return appendUint64(additional, uint64(offset))
+}
+
+// Encrypts a changelog line (without its line break), to be written at an offset of a segment
+func (k *Keyring) sealChangelogLine(line []byte, namespace string, first uint64, offset int64) []byte {
+	sealed := k.seal(k.current, line, changelogAdditionalData(namespace, first, offset))
+	encoded := ENCRYPTION_CHANGELOG_PREFIX + k.current + ":" + base64.StdEncoding.EncodeToString(sealed)
+	return []byte(encoded)
+}
+
+// Decrypts a changelog line read at an offset of a segment, if it is encrypted
+func (k *Keyring) openChangelogLine(line []byte, namespace string, first uint64, offset int64) ([]byte, error) {
+	if !bytes.HasPrefix(line, []byte(ENCRYPTION_CHANGELOG_PREFIX)) {
+		return line, k.checkPlaintext()
+	}
+
+	colon := bytes.IndexByte(line, ':')
+	if colon < 0 {
+		return nil, errors.New("encrypted change has no key id")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(line[colon+1:]))
+	if err != nil {
+		return nil, fmt.Errorf("encrypted change isn't valid base64: %v", err)
+	}
+	return k.open(string(line[len(ENCRYPTION_CHANGELOG_PREFIX):colon]), sealed, changelogAdditionalData(namespace, first, offset))
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Returns the text of a keyring with a 32-byte key for each id, the last one current
+func testKeyringText(ids ...string) string {
+	entries := make([]string, len(ids))
+	for i, id := range ids {
+		entries[i] = id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{byte(i + 1)}, 32))
+	}
+	return strings.Join(entries, "\n")
+}
+
+func testKeyring(t *testing.T, ids ...string) *Keyring {
+	t.Helper()
+
+	keyring, err := ParseKeyring(testKeyringText(ids...))
+	if err != nil {
+		t.Fatalf("ParseKeyring: %v", err)
+	}
+	return keyring
+}
+
+func TestParseKeyring(t *testing.T) {
+	key16 := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	key20 := base64.StdEncoding.EncodeToString(make([]byte, 20))
+
+	tests := []struct {
+		name        string
+		text        string
+		wantCurrent string
+		wantErr     bool
+	}{
+		{name: "one key", text: "a:" + key16, wantCurrent: "a"},
+		{name: "lines and comments", text: "# keys\n\na:" + key16 + "\n  b:" + key16 + "  \n", wantCurrent: "b"},
+		{name: "commas", text: "a:" + key16 + ",b-2.c_d:" + key16, wantCurrent: "b-2.c_d"},
+		{name: "no keys", text: "# nothing\n", wantErr: true},
+		{name: "no colon", text: key16, wantErr: true},
+		{name: "invalid id", text: "a b:" + key16, wantErr: true},
+		{name: "repeated id", text: "a:" + key16 + "\na:" + key16, wantErr: true},
+		{name: "invalid base64", text: "a:not base64!", wantErr: true},
+		{name: "wrong key size", text: "a:" + key20, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			keyring, err := ParseKeyring(test.text)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("ParseKeyring succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseKeyring: %v", err)
+			}
+			if keyring.Current() != test.wantCurrent {
+				t.Errorf("current key is %q, want %q", keyring.Current(), test.wantCurrent)
+			}
+		})
+	}
+}
+
+func TestEncryptedSnapshots(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "default")
+	store, err := OpenSnapshotStore(dir, 0, testKeyring(t, "old"))
+	if err != nil {
+		t.Fatalf("OpenSnapshotStore: %v", err)
+	}
+	trie := testSnapshotTrie(t)
+	info, err := store.Save(trie)
+	if err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if info.Key != "old" {
+		t.Errorf("snapshot is encrypted with key %q, want %q", info.Key, "old")
+	}
+
+	data, err := ioutil.ReadFile(store.path(trie.Clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(ENCRYPTION_MAGIC)) || bytes.Contains(data, []byte(SNAPSHOT_MAGIC)) {
+		t.Fatal("the snapshot file isn't encrypted")
+	}
+
+	// After rotating keys, the snapshot is still read with the previous key
+	rotated, err := OpenSnapshotStore(dir, 0, testKeyring(t, "old", "new"))
+	if err != nil {
+		t.Fatalf("OpenSnapshotStore: %v", err)
+	}
+	latest, err := rotated.Latest()
+	if err != nil {
+		t.Fatalf("Latest: %v", err)
+	}
+	checkSameTrie(t, latest, trie)
+
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-1] ^= 0x01
+
+	tests := []struct {
+		name      string
+		namespace string
+		revision  uint64
+		data      []byte
+		keyring   *Keyring
+	}{
+		{name: "tampered", namespace: "default", revision: trie.Clock, data: tampered, keyring: testKeyring(t, "old")},
+		{name: "other namespace", namespace: "other", revision: trie.Clock, data: data, keyring: testKeyring(t, "old")},
+		{name: "other revision", namespace: "default", revision: trie.Clock + 1, data: data, keyring: testKeyring(t, "old")},
+		{name: "missing key", namespace: "default", revision: trie.Clock, data: data, keyring: testKeyring(t, "new")},
+		{name: "no keyring", namespace: "default", revision: trie.Clock, data: data, keyring: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store, err := OpenSnapshotStore(filepath.Join(t.TempDir(), test.namespace), 0, test.keyring)
+			if err != nil {
+				t.Fatalf("OpenSnapshotStore: %v", err)
+			}
+			if err := ioutil.WriteFile(store.path(test.revision), test.data, 0660); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.read(test.revision); err == nil {
+				t.Fatal("read the snapshot, want an error")
+			}
+		})
+	}
+}
+
+func TestPlaintextSnapshots(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "default")
+	plain, err := OpenSnapshotStore(dir, 0, nil)
+	if err != nil {
+		t.Fatalf("OpenSnapshotStore: %v", err)
+	}
+	trie := testSnapshotTrie(t)
+	if _, err := plain.Save(trie); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	keyring := testKeyring(t, "key")
+	store, err := OpenSnapshotStore(dir, 0, keyring)
+	if err != nil {
+		t.Fatalf("OpenSnapshotStore: %v", err)
+	}
+	if _, err := store.read(trie.Clock); err == nil {
+		t.Error("read a snapshot that isn't encrypted, want an error")
+	}
+
+	keyring.AllowPlaintext()
+	latest, err := store.Latest()
+	if err != nil {
+		t.Fatalf("Latest while allowing plaintext: %v", err)
+	}
+	checkSameTrie(t, latest, trie)
+}
+
+func TestEncryptedWriteAheadLog(t *testing.T) {
+	dir := t.TempDir()
+	wal, _, err := openTestWAL(t, dir, WAL_FSYNC_NEVER, testKeyring(t, "key"), NewTrie())
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	appendTestChanges(t, wal, 0, "apple", "berry")
+	path := wal.path(1)
+	wal.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(ENCRYPTION_MAGIC)) || bytes.Contains(data, []byte("apple")) {
+		t.Fatal("the log file isn't encrypted")
+	}
+
+	trie := NewTrie()
+	wal, applied, err := openTestWAL(t, dir, WAL_FSYNC_NEVER, testKeyring(t, "key", "next"), trie)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	wal.Close()
+	if want := []string{"apple", "berry"}; applied != 2 || !reflect.DeepEqual(trie.Keys(), want) {
+		t.Errorf("Replay applied %d changes with keys %v, want 2 with %v", applied, trie.Keys(), want)
+	}
+
+	// Records keep valid checksums when they are swapped, but are bound to their offsets
+	header := len(encryptionHeader("key"))
+	_, size, err := readWALRecord(data[header:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	swapped := append([]byte(nil), data[:header]...)
+	swapped = append(swapped, data[header+size:]...)
+	swapped = append(swapped, data[header:header+size]...)
+	if err := ioutil.WriteFile(path, swapped, 0660); err != nil {
+		t.Fatal(err)
+	}
+	wal, _, err = openTestWAL(t, dir, WAL_FSYNC_NEVER, testKeyring(t, "key"), NewTrie())
+	wal.Close()
+	if err == nil {
+		t.Error("replayed records that were swapped, want an error")
+	}
+}
+
+func TestPlaintextWriteAheadLog(t *testing.T) {
+	dir := t.TempDir()
+	wal, _, err := openTestWAL(t, dir, WAL_FSYNC_NEVER, nil, NewTrie())
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	appendTestChanges(t, wal, 0, "apple")
+	wal.Close()
+
+	keyring := testKeyring(t, "key")
+	wal, _, err = openTestWAL(t, dir, WAL_FSYNC_NEVER, keyring, NewTrie())
+	wal.Close()
+	if err == nil {
+		t.Fatal("replayed a log that isn't encrypted, want an error")
+	}
+
+	keyring.AllowPlaintext()
+	trie := NewTrie()
+	wal, applied, err := openTestWAL(t, dir, WAL_FSYNC_NEVER, keyring, trie)
+	if err != nil {
+		t.Fatalf("Replay while allowing plaintext: %v", err)
+	}
+	defer wal.Close()
+	if applied != 1 {
+		t.Errorf("Replay applied %d changes, want 1", applied)
+	}
+
+	// New changes go to a new, encrypted file
+	appendTestChanges(t, wal, 1, "berry")
+	data, err := ioutil.ReadFile(wal.path(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(ENCRYPTION_MAGIC)) {
+		t.Error("a change made while allowing plaintext isn't encrypted")
+	}
+}
+
+func TestEncryptedChangelog(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "default")
+	changelog, err := OpenChangelog(dir, 0, "", testKeyring(t, "key"))
+	if err != nil {
+		t.Fatalf("OpenChangelog: %v", err)
+	}
+	defer changelog.Close()
+
+	changes := []Change{
+		{Op: CHANGE_INSERT, Key: "apple", Version: 1},
+		{Op: CHANGE_DELETE, Key: "apple", Version: 2},
+	}
+	for _, change := range changes {
+		if err := changelog.Append(change); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(changelog.segmentPath(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("apple")) {
+		t.Fatal("the changelog isn't encrypted")
+	}
+
+	records, more, err := changelog.Since(0, 10)
+	if err != nil {
+		t.Fatalf("Since: %v", err)
+	}
+	want := []ChangeRecord{{Revision: 1, Op: CHANGE_INSERT, Key: "apple"}, {Revision: 2, Op: CHANGE_DELETE, Key: "apple"}}
+	if more || !reflect.DeepEqual(records, want) {
+		t.Errorf("Since returned %v (more: %v), want %v", records, more, want)
+	}
+}
+
+func TestChangelogLineBinding(t *testing.T) {
+	keyring := testKeyring(t, "key")
+	plain := []byte(`{"revision":1,"op":"insert","key":"apple"}`)
+	sealed := keyring.sealChangelogLine(plain, "default", 1, 0)
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-2] ^= 0x01
+
+	tests := []struct {
+		name      string
+		line      []byte
+		namespace string
+		first     uint64
+		offset    int64
+		keyring   *Keyring
+		wantErr   bool
+	}{
+		{name: "sealed", line: sealed, namespace: "default", first: 1, keyring: keyring},
+		{name: "other namespace", line: sealed, namespace: "other", first: 1, keyring: keyring, wantErr: true},
+		{name: "other segment", line: sealed, namespace: "default", first: 2, keyring: keyring, wantErr: true},
+		{name: "other offset", line: sealed, namespace: "default", first: 1, offset: 100, keyring: keyring, wantErr: true},
+		{name: "tampered", line: tampered, namespace: "default", first: 1, keyring: keyring, wantErr: true},
+		{name: "missing key", line: sealed, namespace: "default", first: 1, keyring: testKeyring(t, "other"), wantErr: true},
+		{name: "plaintext", line: plain, namespace: "default", first: 1, keyring: keyring, wantErr: true},
+		{name: "plaintext without keys", line: plain, namespace: "default", first: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			line, err := test.keyring.openChangelogLine(test.line, test.namespace, test.first, test.offset)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("openChangelogLine succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("openChangelogLine: %v", err)
+			}
+			if !bytes.Equal(line, plain) {
+				t.Errorf("openChangelogLine returned %q, want %q", line, plain)
+			}
+		})
+	}
+
+	migrating := testKeyring(t, "key")
+	migrating.AllowPlaintext()
+	if _, err := migrating.openChangelogLine(plain, "default", 1, 0); err != nil {
+		t.Errorf("openChangelogLine refused plaintext while allowing it: %v", err)
+	}
+}
+
+func TestParseEncryptionHeader(t *testing.T) {
+	header := encryptionHeader("key")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantID   string
+		wantSize int
+		wantErr  bool
+	}{
+		{name: "plaintext", data: []byte(SNAPSHOT_MAGIC)},
+		{name: "header", data: append(append([]byte(nil), header...), 1, 2, 3), wantID: "key", wantSize: len(header)},
+		{name: "cut off magic", data: []byte(ENCRYPTION_MAGIC), wantErr: true},
+		{name: "cut off id", data: header[:len(header)-1], wantErr: true},
+		{name: "invalid id", data: append([]byte(ENCRYPTION_MAGIC), 1, ' '), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id, size, err := parseEncryptionHeader(test.data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseEncryptionHeader returned error %v, want an error: %v", err, test.wantErr)
+			}
+			if id != test.wantID || size != test.wantSize {
+				t.Errorf("parseEncryptionHeader returned %q, %d; want %q, %d", id, size, test.wantID, test.wantSize)
+			}
+		})
+	}
+}
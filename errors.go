@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// enum for error codes that clients can match on
+const (
+	// The request was malformed, or one of its arguments was invalid
+	ERR_CODE_INVALID = "invalid"
+	// The caller's expected version did not match the key's current version
+	ERR_CODE_CONFLICT = "conflict"
+	// The requested key doesn't exist
+	ERR_CODE_NOT_FOUND = "not_found"
+	// The requested command doesn't exist
+	ERR_CODE_UNKNOWN_COMMAND = "unknown_command"
+	// The client and server have no protocol version in common
+	ERR_CODE_UNSUPPORTED_VERSION = "unsupported_version"
+	// The requested revisions are no longer in the changelog, so the client must resync
+	ERR_CODE_COMPACTED = "compacted"
+	// The request carried no token, or a token the server doesn't know
+	ERR_CODE_UNAUTHORIZED = "unauthorized"
+	// The request's token doesn't allow what it asked for
+	ERR_CODE_FORBIDDEN = "forbidden"
+	// The namespace can't be changed, such as a dictionary
+	ERR_CODE_READ_ONLY = "read_only"
+	// The request was valid, but the server failed to carry it out, such as when writing to disk failed
+	ERR_CODE_INTERNAL = "internal"
+)
+
+/*
+A CodedError is an error that carries a machine-readable code.
+Its Error() is formatted as "[CODE]: [MESSAGE]", for logs. Protocols with a field for the
+code send the two apart; legacy replies only send the message (see ErrorMessage).
+*/
+type CodedError struct {
+	// Code is one of the ERR_CODE_* constants
+	Code string
+	// Message is a human-readable description of the error
+	Message string
+}
+
+func (e *CodedError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// ErrorCode returns the code of an error, treating errors without one as internal failures.
+// Errors caused by the request itself must therefore carry ERR_CODE_INVALID.
+func ErrorCode(err error) string {
+	var coded *CodedError
+	if errors.As(err, &coded) {
+		return coded.Code
+	}
+	return ERR_CODE_INTERNAL
+}
+
+// ErrorMessage returns the message of an error, without its code
+func ErrorMessage(err error) string {
+	var coded *CodedError
+	if errors.As(err, &coded) {
+		return coded.Message
+	}
+	return err.Error()
+}
+
+// Creates an error for a compare-and-set whose expected version didn't match
+func NewVersionConflictError(key string, expected uint64, current uint64) *CodedError {
+	return &CodedError{
+		Code:    ERR_CODE_CONFLICT,
+		Message: fmt.Sprintf("version mismatch for %q (expected %d, current %d)", key, expected, current),
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+/*
+JSON-RPC 2.0 support (https://www.jsonrpc.org/specification).
+
+Every registered command is exposed as a method of the same name, taking its
+arguments as named params:
+
+	{"jsonrpc": "2.0", "id": 1, "method": "completions", "params": {"prefix": "fo"}}
+	{"jsonrpc": "2.0", "id": 1, "result": ["foo", "fox"]}
+
+Batches (arrays of requests) and notifications (requests without an id) are supported.
+Errors from the dispatcher are reported with the codes below, and the dispatcher's own
+error code is included in the error's data.
+*/
+const JSONRPC_VERSION = "2.0"
+
+// enum for JSON-RPC error codes
+const (
+	// Codes defined by the specification
+	JSONRPC_PARSE_ERROR      = -32700
+	JSONRPC_INVALID_REQUEST  = -32600
+	JSONRPC_METHOD_NOT_FOUND = -32601
+	JSONRPC_INVALID_PARAMS   = -32602
+	JSONRPC_INTERNAL_ERROR   = -32603
+	// Codes for the dispatcher's errors, in the range reserved for implementations
+	JSONRPC_CONFLICT            = -32001
+	JSONRPC_UNSUPPORTED_VERSION = -32002
+	JSONRPC_NOT_FOUND           = -32003
+	JSONRPC_COMPACTED           = -32004
+	JSONRPC_UNAUTHORIZED        = -32005
+	JSONRPC_FORBIDDEN           = -32006
+	JSONRPC_READ_ONLY           = -32007
+)
+
+// Maps the dispatcher's error codes to JSON-RPC error codes
+var jsonRPCErrorCodes = map[string]int{
+	ERR_CODE_INVALID:             JSONRPC_INVALID_PARAMS,
+	ERR_CODE_UNKNOWN_COMMAND:     JSONRPC_METHOD_NOT_FOUND,
+	ERR_CODE_CONFLICT:            JSONRPC_CONFLICT,
+	ERR_CODE_UNSUPPORTED_VERSION: JSONRPC_UNSUPPORTED_VERSION,
+	ERR_CODE_NOT_FOUND:           JSONRPC_NOT_FOUND,
+	ERR_CODE_COMPACTED:           JSONRPC_COMPACTED,
+	ERR_CODE_UNAUTHORIZED:        JSONRPC_UNAUTHORIZED,
+	ERR_CODE_FORBIDDEN:           JSONRPC_FORBIDDEN,
+	ERR_CODE_READ_ONLY:           JSONRPC_READ_ONLY,
+	ERR_CODE_INTERNAL:            JSONRPC_INTERNAL_ERROR,
+}
+
+/*
+JSONRPCRequest is a single JSON-RPC request or notification.
+*/
+type JSONRPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	// ID is nil for notifications, which get no response
+	ID json.RawMessage `json:"id,omitempty"`
+}
+
+/*
+JSONRPCError is the error object of a failed JSON-RPC request.
+*/
+type JSONRPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+/*
+JSONRPCResponse is the response to a single JSON-RPC request.
+*/
+type JSONRPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// Data attached to errors that came from the dispatcher
+type jsonRPCErrorData struct {
+	Code string `json:"code"`
+}
+
+/*
+DispatchJSONRPC handles a JSON-RPC request or batch, returning the encoded response.
+The response is nil if there is nothing to send back, which happens when the message
+only contained notifications.
+*/
+func (s *ThreadSafeDispatcher) DispatchJSONRPC(message []byte) []byte {
+	return s.DispatchJSONRPCAs(nil, message)
+}
+
+/*
+DispatchJSONRPCAs is like DispatchJSONRPC, but only runs methods that a token allows.
+*/
+func (s *ThreadSafeDispatcher) DispatchJSONRPCAs(token *Token, message []byte) []byte {
+	trimmed := bytes.TrimLeft(message, " \t\r\n")
+
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(trimmed, &batch); err != nil {
+			return encodeJSONRPCResponse(newJSONRPCErrorResponse(nil, JSONRPC_PARSE_ERROR, "parse error"))
+		}
+		if len(batch) == 0 {
+			return encodeJSONRPCResponse(newJSONRPCErrorResponse(nil, JSONRPC_INVALID_REQUEST, "empty batch"))
+		}
+
+		responses := make([]*JSONRPCResponse, 0, len(batch))
+		for _, request := range batch {
+			if response := s.dispatchJSONRPCRequest(token, request); response != nil {
+				responses = append(responses, response)
+			}
+		}
+
+		// A batch of notifications gets no response at all
+		if len(responses) == 0 {
+			return nil
+		}
+
+		encoded, _ := json.Marshal(responses)
+		return encoded
+	}
+
+	response := s.dispatchJSONRPCRequest(token, trimmed)
+	if response == nil {
+		return nil
+	}
+	return encodeJSONRPCResponse(response)
+}
+
+/*
+Handles a single request of a JSON-RPC message, returning nil for notifications.
+*/
+func (s *ThreadSafeDispatcher) dispatchJSONRPCRequest(token *Token, message json.RawMessage) *JSONRPCResponse {
+	if !json.Valid(message) {
+		return newJSONRPCErrorResponse(nil, JSONRPC_PARSE_ERROR, "parse error")
+	}
+
+	// Valid JSON that isn't shaped like a request (e.g. a number) is an invalid request
+	var request JSONRPCRequest
+	if err := json.Unmarshal(message, &request); err != nil {
+		return newJSONRPCErrorResponse(nil, JSONRPC_INVALID_REQUEST, "invalid request")
+	}
+
+	if request.JSONRPC != JSONRPC_VERSION || request.Method == "" || !isValidJSONRPCID(request.ID) {
+		return newJSONRPCErrorResponse(request.ID, JSONRPC_INVALID_REQUEST, "invalid request")
+	}
+
+	result, err := s.callJSONRPCMethod(token, &request)
+
+	// Notifications never get a response, even if they fail
+	if request.ID == nil {
+		return nil
+	}
+
+	if err != nil {
+		return newJSONRPCDispatchErrorResponse(request.ID, err)
+	}
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return newJSONRPCErrorResponse(request.ID, JSONRPC_INTERNAL_ERROR, err.Error())
+	}
+
+	return &JSONRPCResponse{JSONRPC: JSONRPC_VERSION, Result: encoded, ID: request.ID}
+}
+
+/*
+Runs the command named by a request's method.
+*/
+func (s *ThreadSafeDispatcher) callJSONRPCMethod(token *Token, request *JSONRPCRequest) (interface{}, error) {
+	// Commands take named arguments, so positional params can't be mapped onto them
+	params := bytes.TrimLeft(request.Params, " \t\r\n")
+	if len(params) > 0 && params[0] == '[' {
+		return nil, &CodedError{Code: ERR_CODE_INVALID, Message: "params must be an object"}
+	}
+
+	// The namespace is sent along with the command's arguments
+	namespace, params, err := splitNamespaceArg(params)
+	if err != nil {
+		return nil, err
+	}
+	target, err := s.resolve(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	command, ok := target.commands.Lookup(request.Method)
+	if !ok {
+		return nil, &CodedError{Code: ERR_CODE_UNKNOWN_COMMAND, Message: fmt.Sprintf("method %q not found", request.Method)}
+	}
+
+	args, err := command.ParseArgs(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return target.DispatchAs(token, command, args)
+}
+
+/*
+Returns whether an id is allowed by the specification: absent, null, a string or a number.
+*/
+func isValidJSONRPCID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(id, &value); err != nil {
+		return false
+	}
+
+	switch value.(type) {
+	case nil, string, float64:
+		return true
+	}
+	return false
+}
+
+func newJSONRPCErrorResponse(id json.RawMessage, code int, message string) *JSONRPCResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+
+	return &JSONRPCResponse{
+		JSONRPC: JSONRPC_VERSION,
+		Error:   &JSONRPCError{Code: code, Message: message},
+		ID:      id,
+	}
+}
+
+// Describes an error from the dispatcher, keeping its code in the error's data
+func newJSONRPCDispatchErrorResponse(id json.RawMessage, err error) *JSONRPCResponse {
+	code, ok := jsonRPCErrorCodes[ErrorCode(err)]
+	if !ok {
+		code = JSONRPC_INTERNAL_ERROR
+	}
+
+	response := newJSONRPCErrorResponse(id, code, ErrorMessage(err))
+	response.Error.Data = jsonRPCErrorData{Code: ErrorCode(err)}
+	return response
+}
+
+func encodeJSONRPCResponse(response *JSONRPCResponse) []byte {
+	// A response made of strings, numbers and raw JSON always encodes
+	encoded, _ := json.Marshal(response)
+	return encoded
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"crypto/tls"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/logger"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "build-dictionary" {
+		os.Exit(buildDictionaryMain(os.Args[2:]))
+	}
+
 	// Initialize logger
 	output, err := os.OpenFile("output.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0660)
 	if err != nil {
@@ -26,6 +35,173 @@ func main() {
 
 	server := NewServer()
 
+	// Encrypt the snapshots, write-ahead logs and changelogs if there are keys (see encryption.go)
+	var keyring *Keyring
+	if keyFile := os.Getenv("ENCRYPTION_KEY_FILE"); keyFile != "" {
+		keyring, err = LoadKeyring(keyFile)
+	} else if keys := os.Getenv("ENCRYPTION_KEYS"); keys != "" {
+		keyring, err = ParseKeyring(keys)
+	}
+	if err != nil {
+		logger.Fatalf("loading encryption keys: %v", err)
+	}
+	if keyring != nil {
+		if os.Getenv("ENCRYPTION_ALLOW_PLAINTEXT") == "1" {
+			// Files written before encryption was turned on are read until they are replaced
+			keyring.AllowPlaintext()
+		}
+		server.UseEncryption(keyring)
+		logger.Infof("encryption at rest enabled, with key %s", keyring.Current())
+	}
+
+	// Restore the namespaces from their snapshots and write-ahead logs, and keep taking snapshots
+	dataDir := os.Getenv("DATA_DIR")
+	if dataDir == "" {
+		dataDir = "data"
+	}
+	storage := StorageOptions{
+		SnapshotRetain: SNAPSHOT_DEFAULT_RETAIN,
+		Fsync:          os.Getenv("WAL_FSYNC"),
+		Compaction: CompactionPolicy{
+			MinBytes:      COMPACTION_DEFAULT_MIN_BYTES,
+			GrowthPercent: COMPACTION_DEFAULT_GROWTH_PERCENT,
+		},
+	}
+	if retain := os.Getenv("SNAPSHOT_RETAIN"); retain != "" {
+		if storage.SnapshotRetain, err = strconv.Atoi(retain); err != nil {
+			logger.Fatalf("$SNAPSHOT_RETAIN must be a number: %v", err)
+		}
+	}
+	if minBytes := os.Getenv("COMPACTION_MIN_BYTES"); minBytes != "" {
+		if storage.Compaction.MinBytes, err = strconv.ParseInt(minBytes, 10, 64); err != nil {
+			logger.Fatalf("$COMPACTION_MIN_BYTES must be a number: %v", err)
+		}
+	}
+	if growth := os.Getenv("COMPACTION_GROWTH_PERCENT"); growth != "" {
+		if storage.Compaction.GrowthPercent, err = strconv.Atoi(growth); err != nil {
+			logger.Fatalf("$COMPACTION_GROWTH_PERCENT must be a number: %v", err)
+		}
+	}
+	switch storage.Fsync {
+	case "":
+		storage.Fsync = WAL_FSYNC_EVERYSEC
+	case "off":
+		// Only keep snapshots
+		storage.Fsync = ""
+	}
+	if err := server.UseStorage(dataDir, storage); err != nil {
+		logger.Fatalf("restoring namespaces from %s: %v", dataDir, err)
+	}
+	snapshotInterval := SNAPSHOT_DEFAULT_INTERVAL
+	if interval := os.Getenv("SNAPSHOT_INTERVAL"); interval != "" {
+		if snapshotInterval, err = time.ParseDuration(interval); err != nil {
+			logger.Fatalf("$SNAPSHOT_INTERVAL must be a duration, such as 5m: %v", err)
+		}
+	}
+	if snapshotInterval > 0 {
+		server.ScheduleSnapshots(snapshotInterval)
+	}
+
+	// Serve the dictionaries of a directory as read-only namespaces (see dictionary.go)
+	dictionaryDir := os.Getenv("DICTIONARY_DIR")
+	if dictionaryDir == "" {
+		dictionaryDir = "dictionaries"
+	}
+	if err := server.UseDictionaries(dictionaryDir); err != nil {
+		logger.Fatalf("mounting dictionaries from %s: %v", dictionaryDir, err)
+	}
+
+	// Record every change on disk, so that other systems can follow the trie
+	changelogDir := os.Getenv("CHANGELOG_DIR")
+	if changelogDir == "" {
+		changelogDir = "changelog"
+	}
+	changelogSegments := CHANGELOG_DEFAULT_SEGMENTS
+	if segments := os.Getenv("CHANGELOG_SEGMENTS"); segments != "" {
+		if changelogSegments, err = strconv.Atoi(segments); err != nil {
+			logger.Fatalf("$CHANGELOG_SEGMENTS must be a number: %v", err)
+		}
+	}
+	if err := server.UseChangelogs(changelogDir, changelogSegments); err != nil {
+		logger.Fatalf("opening changelogs in %s: %v", changelogDir, err)
+	}
+
+	// Require API tokens if there is a token file
+	if tokenFile := os.Getenv("AUTH_TOKENS_FILE"); tokenFile != "" {
+		tokens, err := LoadTokens(tokenFile)
+		if err != nil {
+			logger.Fatalf("loading API tokens: %v", err)
+		}
+		server.UseTokens(tokens)
+		logger.Infof("authentication enabled, with tokens from %s", tokenFile)
+	}
+
+	// Follow a leader's namespaces, if this server is a replica (see replication.go)
+	if leader := os.Getenv("REPLICA_OF"); leader != "" {
+		if err := server.Follow(leader, os.Getenv("REPLICA_TOKEN")); err != nil {
+			logger.Fatalf("following %s: %v", leader, err)
+		}
+		logger.Infof("replicating the namespaces of %s", leader)
+	}
+
+	// Restrict browsers to some origins, as a comma-separated list (see cors.go)
+	if allowedOrigins := os.Getenv("ALLOWED_ORIGINS"); allowedOrigins != "" {
+		origins, err := NewOriginPolicy(strings.Split(allowedOrigins, ","), os.Getenv("CORS_ALLOW_CREDENTIALS") == "true")
+		if err != nil {
+			logger.Fatalf("parsing $ALLOWED_ORIGINS: %v", err)
+		}
+		server.UseOrigins(origins)
+	}
+
+	// Serve every TCP listener over TLS if there is a certificate
+	var tlsConfig *tls.Config
+	if certFile := os.Getenv("TLS_CERT_FILE"); certFile != "" {
+		certificates, err := NewCertificateReloader(certFile, os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CLIENT_CA_FILE"), os.Getenv("TLS_CLIENT_AUTH"))
+		if err != nil {
+			logger.Fatalf("loading TLS certificates: %v", err)
+		}
+		certificates.Watch(TLS_RELOAD_INTERVAL)
+		tlsConfig = certificates.TLSConfig()
+		logger.Infof("TLS enabled, with the certificate in %s", certFile)
+	}
+
+	// Optionally speak the Redis protocol and the binary protocol on separate listeners
+	if respPort := os.Getenv("RESP_PORT"); respPort != "" {
+		serveListener("RESP", "tcp", ":"+respPort, tlsConfig, server.ServeRESP)
+	}
+	if binaryPort := os.Getenv("BINARY_PORT"); binaryPort != "" {
+		serveListener("binary", "tcp", ":"+binaryPort, tlsConfig, server.ServeBinary)
+	}
+	if binarySocket := os.Getenv("BINARY_SOCKET"); binarySocket != "" {
+		// Remove the socket left behind by a previous run, if any
+		os.Remove(binarySocket)
+		// Only local processes can reach the socket, so it doesn't need TLS
+		serveListener("binary", "unix", binarySocket, nil, server.ServeBinary)
+	}
+
 	logger.Infof("server starting on :%s", port)
-	http.ListenAndServe(":"+port, server.HttpServeMux())
+	httpServer := &http.Server{Addr: ":" + port, Handler: server.HttpServeMux(), TLSConfig: tlsConfig}
+	if tlsConfig != nil {
+		// The certificates come from the TLS configuration
+		err = httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = httpServer.ListenAndServe()
+	}
+	logger.Errorf("server stopped: %v", err)
+}
+
+// Listens on an address and serves it in the background, over TLS if tlsConfig isn't nil
+func serveListener(name string, network string, address string, tlsConfig *tls.Config, serve func(net.Listener) error) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		logger.Fatalf("listening for %s connections on %s: %v", name, address, err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	logger.Infof("%s listener starting on %s", name, address)
+	go func() {
+		logger.Errorf("%s listener stopped: %v", name, serve(listener))
+	}()
 }
@@ -0,0 +1,26 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package main
+
+import (
+	"io"
+	"os"
+)
+
+/*
+Reads a file into memory, on systems where mapFile can't use mmap.
+Opening the file takes as long as reading it, but queries behave the same.
+*/
+func mapFile(file *os.File, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(file, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Releases memory returned by mapFile
+func unmapFile(data []byte) error {
+	return nil
+}
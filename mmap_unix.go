@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+/*
+Maps a file into memory, read-only. Pages are read from disk as they are touched,
+and can be shared with other processes mapping the same file.
+*/
+func mapFile(file *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(file.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+// Releases memory returned by mapFile
+func unmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/google/logger"
+)
+
+/*
+Namespaces are independent tries, each with its own dispatcher, so that a busy
+namespace never holds the lock of another. Every server has the DEFAULT_NAMESPACE,
+which is used by requests that don't name one.
+
+Requests pick their namespace in a way that suits each protocol:
+
+	legacy       an "@[NAMESPACE] " prefix              @team 0foo
+	version 2    the envelope's "namespace" field      {"namespace": "team", "op": "insert", ...}
+	JSON-RPC     a "namespace" member in params         {"method": "insert", "params": {"namespace": "team", ...}}
+	binary       a "namespace" member in the payload
+	REST/SSE     a "namespace" query parameter          /keys/foo?namespace=team
+	RESP         the NAMESPACE command, per connection  NAMESPACE team
+
+Namespaces are managed with the create_namespace, drop_namespace, list_namespaces,
+describe_namespace, mount_dictionary and unmount_dictionary commands, which are available in
+every namespace, along with replication_status (see replication.go).
+
+An alias is another name for a namespace, which can be used anywhere a namespace's name
+can. Aliases can be re-pointed at once with set_alias, so a fresh namespace can be filled
+while clients keep reading the old one through the alias, and then swapped in:
+
+	{"op": "create_namespace", "args": {"name": "words-v2"}}
+	... insert the new keys into words-v2 ...
+	{"op": "set_alias", "args": {"alias": "words", "namespace": "words-v2"}}
+	{"op": "drop_namespace", "args": {"name": "words-v1"}}
+
+Requests already running on the old namespace finish there. Subscriptions stay on the
+namespace they were made on, and end when it is dropped. A namespace can't be dropped
+while an alias points at it. If the namespaces are kept on disk (see UseStorage), the
+aliases are saved along with them, in ALIASES_FILE, so that they survive a restart.
+*/
+const DEFAULT_NAMESPACE = "default"
+
+// Name of the file in the data directory that holds the aliases
+const ALIASES_FILE = "aliases.json"
+
+// Names of namespaces must match this, so that they are safe to use as file names
+var NAMESPACE_NAME_PATTERN = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+/*
+Namespaces holds the dispatchers of a server's namespaces, by name.
+*/
+type Namespaces struct {
+	mutex       sync.RWMutex
+	dispatchers map[string]*ThreadSafeDispatcher
+	// aliases maps each alias to the name of the namespace it points at
+	aliases map[string]string
+
+	// If changelogDir is set, each namespace keeps a changelog in a subdirectory of it
+	changelogDir      string
+	changelogSegments int
+	// If dataDir is set, each namespace keeps its snapshots and write-ahead log
+	// in a subdirectory of it
+	dataDir string
+	storage StorageOptions
+	// dictionaryDir holds the files that mount_dictionary can mount
+	dictionaryDir string
+	// keyring encrypts the snapshots, write-ahead logs and changelogs, if set
+	keyring *Keyring
+	// replication follows a leader's namespaces, and tracks the replicas following these
+	replication *Replication
+}
+
+/*
+StorageOptions say how namespaces are kept on disk.
+*/
+type StorageOptions struct {
+	// SnapshotRetain is the number of snapshots kept per namespace
+	SnapshotRetain int
+	// Fsync is the write-ahead log's fsync policy (see wal.go), or "" for no log
+	Fsync string
+	// Compaction says when the write-ahead log is compacted
+	Compaction CompactionPolicy
+}
+
+/*
+NamespaceInfo describes a namespace.
+*/
+type NamespaceInfo struct {
+	Name string `json:"name"`
+	// Keys is the number of keys in the namespace
+	Keys int `json:"keys"`
+	// Revision is the namespace's clock, which advances with every change
+	Revision uint64 `json:"revision"`
+	// Dictionary is the file of a dictionary namespace (see dictionary.go)
+	Dictionary string `json:"dictionary,omitempty"`
+}
+
+// Arguments of the commands that take a namespace's name
+type namespaceArgs struct {
+	Name string `json:"name"`
+}
+
+// Arguments of set_alias and drop_alias
+type aliasArgs struct {
+	Alias     string `json:"alias"`
+	Namespace string `json:"namespace"`
+}
+
+/*
+Creates a set of namespaces holding only an empty default namespace.
+*/
+func NewNamespaces() *Namespaces {
+	namespaces := &Namespaces{
+		dispatchers: make(map[string]*ThreadSafeDispatcher),
+		aliases:     make(map[string]string),
+	}
+	namespaces.replication = newReplication(namespaces)
+
+	// The default namespace's name is valid, and there's no changelog to open yet
+	namespaces.Create(DEFAULT_NAMESPACE)
+	return namespaces
+}
+
+/*
+Default returns the dispatcher of the default namespace.
+*/
+func (n *Namespaces) Default() *ThreadSafeDispatcher {
+	dispatcher, _ := n.Get(DEFAULT_NAMESPACE)
+	return dispatcher
+}
+
+/*
+Get returns the dispatcher of a namespace, or of the namespace an alias points at.
+The empty name stands for the default namespace.
+*/
+func (n *Namespaces) Get(name string) (*ThreadSafeDispatcher, error) {
+	if name == "" {
+		name = DEFAULT_NAMESPACE
+	}
+
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	if target, ok := n.aliases[name]; ok {
+		name = target
+	}
+
+	dispatcher, ok := n.dispatchers[name]
+	if !ok {
+		return nil, &CodedError{Code: ERR_CODE_NOT_FOUND, Message: fmt.Sprintf("namespace %q not found", name)}
+	}
+	return dispatcher, nil
+}
+
+/*
+Create adds an empty namespace.
+*/
+func (n *Namespaces) Create(name string) (*ThreadSafeDispatcher, error) {
+	if err := validateNamespaceName(name); err != nil {
+		return nil, err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if err := n.checkNameIsFree(name); err != nil {
+		return nil, err
+	}
+
+	dispatcher := NewThreadSafeDispatcher(NewTrie())
+	dispatcher.name = name
+	dispatcher.namespaces = n
+	for _, command := range namespaceCommands(n) {
+		if err := dispatcher.commands.Register(command); err != nil {
+			return nil, err
+		}
+	}
+
+	// The snapshot and the write-ahead log go first, so that the changelog moves the clock on from them
+	if n.dataDir != "" {
+		if err := n.openStorage(dispatcher); err != nil {
+			return nil, err
+		}
+	}
+	if n.changelogDir != "" {
+		if err := n.openChangelog(dispatcher); err != nil {
+			return nil, err
+		}
+	}
+
+	n.dispatchers[name] = dispatcher
+	logger.Infof("created namespace %s", name)
+	return dispatcher, nil
+}
+
+/*
+Drop deletes a namespace, with its keys and changelog. The default namespace can't be dropped,
+and dictionaries are unmounted instead (see Unmount).
+*/
+func (n *Namespaces) Drop(name string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if err := n.remove(name, false); err != nil {
+		return err
+	}
+
+	if n.changelogDir != "" {
+		if err := os.RemoveAll(filepath.Join(n.changelogDir, name)); err != nil {
+			logger.Errorf("Error deleting changelog of namespace %s: %v", name, err)
+		}
+	}
+	if n.dataDir != "" {
+		if err := os.RemoveAll(filepath.Join(n.dataDir, name)); err != nil {
+			logger.Errorf("Error deleting data of namespace %s: %v", name, err)
+		}
+	}
+
+	logger.Infof("dropped namespace %s", name)
+	return nil
+}
+
+/*
+Unmount removes a dictionary namespace and closes its file. The file stays in the
+dictionary directory, so if it is named [NAME].dict, it is mounted again on restart
+unless it is removed.
+*/
+func (n *Namespaces) Unmount(name string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if err := n.remove(name, true); err != nil {
+		return err
+	}
+	logger.Infof("unmounted dictionary namespace %s", name)
+	return nil
+}
+
+/*
+Removes a namespace that no alias points at and closes it, if it is a dictionary exactly
+when `dictionary` is set. The caller must hold the write lock.
+*/
+func (n *Namespaces) remove(name string, dictionary bool) error {
+	if name == DEFAULT_NAMESPACE {
+		return &CodedError{Code: ERR_CODE_INVALID, Message: "the default namespace can't be dropped"}
+	}
+
+	dispatcher, ok := n.dispatchers[name]
+	if !ok {
+		return &CodedError{Code: ERR_CODE_NOT_FOUND, Message: fmt.Sprintf("namespace %q not found", name)}
+	}
+	if dictionary && dispatcher.dictionary == nil {
+		return &CodedError{Code: ERR_CODE_INVALID, Message: fmt.Sprintf("namespace %q isn't a dictionary; drop it instead", name)}
+	}
+	if !dictionary && dispatcher.dictionary != nil {
+		// Dropping it would only last until its file is mounted again on restart
+		return &CodedError{Code: ERR_CODE_INVALID, Message: fmt.Sprintf("namespace %q is a dictionary; unmount it with unmount_dictionary, and remove its file to keep it from being mounted on restart", name)}
+	}
+	for alias, target := range n.aliases {
+		if target == name {
+			return &CodedError{
+				Code:    ERR_CODE_CONFLICT,
+				Message: fmt.Sprintf("namespace %q is still the target of alias %q", name, alias),
+			}
+		}
+	}
+
+	delete(n.dispatchers, name)
+	dispatcher.close()
+	return nil
+}
+
+/*
+Names returns the names of all namespaces, in lexicographic order.
+*/
+func (n *Namespaces) Names() []string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	names := make([]string, 0, len(n.dispatchers))
+	for name := range n.dispatchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+SetAlias points an alias at a namespace, creating the alias or re-pointing it.
+Every request made through the alias after this returns runs in the new namespace.
+*/
+func (n *Namespaces) SetAlias(alias string, namespace string) error {
+	if err := validateNamespaceName(alias); err != nil {
+		return err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, ok := n.dispatchers[namespace]; !ok {
+		return &CodedError{Code: ERR_CODE_NOT_FOUND, Message: fmt.Sprintf("namespace %q not found", namespace)}
+	}
+	if _, ok := n.dispatchers[alias]; ok {
+		return &CodedError{Code: ERR_CODE_CONFLICT, Message: fmt.Sprintf("%q is already a namespace", alias)}
+	}
+
+	previous, existed := n.aliases[alias]
+	n.aliases[alias] = namespace
+	if err := n.saveAliases(); err != nil {
+		if existed {
+			n.aliases[alias] = previous
+		} else {
+			delete(n.aliases, alias)
+		}
+		return err
+	}
+
+	if existed {
+		logger.Infof("alias %s moved from namespace %s to %s", alias, previous, namespace)
+	} else {
+		logger.Infof("alias %s created for namespace %s", alias, namespace)
+	}
+	return nil
+}
+
+/*
+DropAlias deletes an alias. The namespace it pointed at is left alone.
+*/
+func (n *Namespaces) DropAlias(alias string) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	target, ok := n.aliases[alias]
+	if !ok {
+		return &CodedError{Code: ERR_CODE_NOT_FOUND, Message: fmt.Sprintf("alias %q not found", alias)}
+	}
+
+	delete(n.aliases, alias)
+	if err := n.saveAliases(); err != nil {
+		n.aliases[alias] = target
+		return err
+	}
+
+	logger.Infof("dropped alias %s", alias)
+	return nil
+}
+
+/*
+Saves the aliases in the data directory, replacing the file at once, if the namespaces
+are kept on disk. The caller must hold the write lock.
+*/
+func (n *Namespaces) saveAliases() error {
+	if n.dataDir == "" {
+		return nil
+	}
+
+	// A map of strings always encodes
+	encoded, _ := json.Marshal(n.aliases)
+	_, err := writeFileAtomically(filepath.Join(n.dataDir, ALIASES_FILE), func(w io.Writer) error {
+		_, err := w.Write(encoded)
+		return err
+	})
+	return err
+}
+
+/*
+Restores the aliases saved in the data directory. Dictionaries are mounted after this,
+so an alias may point at a namespace that doesn't exist yet; it isn't found until it does.
+*/
+func (n *Namespaces) loadAliases() error {
+	path := filepath.Join(n.dataDir, ALIASES_FILE)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var aliases map[string]string
+	if err := json.Unmarshal(data, &aliases); err != nil {
+		return fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for alias, target := range aliases {
+		if validateNamespaceName(alias) != nil || validateNamespaceName(target) != nil {
+			logger.Warningf("skipping invalid alias %q of namespace %q", alias, target)
+			continue
+		}
+		if err := n.checkNameIsFree(alias); err != nil {
+			logger.Warningf("skipping alias %s: %v", alias, err)
+			continue
+		}
+		n.aliases[alias] = target
+	}
+	return nil
+}
+
+/*
+Aliases returns a copy of the aliases, mapped to the namespaces they point at.
+*/
+func (n *Namespaces) Aliases() map[string]string {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	aliases := make(map[string]string, len(n.aliases))
+	for alias, target := range n.aliases {
+		aliases[alias] = target
+	}
+	return aliases
+}
+
+// Fails if a name is already used by a namespace or an alias
+func (n *Namespaces) checkNameIsFree(name string) error {
+	if _, ok := n.dispatchers[name]; ok {
+		return &CodedError{Code: ERR_CODE_CONFLICT, Message: fmt.Sprintf("namespace %q already exists", name)}
+	}
+	if _, ok := n.aliases[name]; ok {
+		return &CodedError{Code: ERR_CODE_CONFLICT, Message: fmt.Sprintf("%q is already an alias", name)}
+	}
+	return nil
+}
+
+// Checks that a name can be used for a namespace or an alias
+func validateNamespaceName(name string) error {
+	if !NAMESPACE_NAME_PATTERN.MatchString(name) {
+		return &CodedError{
+			Code:    ERR_CODE_INVALID,
+			Message: "namespace and alias names must be 1 to 64 letters, digits, '_' or '-'",
+		}
+	}
+	return nil
+}
+
+/*
+UseEncryption encrypts the files of every namespace with a keyring (see encryption.go).
+It must be called before UseStorage and UseChangelogs.
+*/
+func (n *Namespaces) UseEncryption(keyring *Keyring) {
+	n.keyring = keyring
+}
+
+/*
+UseChangelogs gives every namespace, now and in the future, a changelog in a
+subdirectory of dir named after the namespace.
+*/
+func (n *Namespaces) UseChangelogs(dir string, maxSegments int) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.changelogDir = dir
+	n.changelogSegments = maxSegments
+
+	for _, dispatcher := range n.dispatchers {
+		if err := n.openChangelog(dispatcher); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+UseStorage keeps the snapshots and write-ahead log of every namespace, now and in the
+future, in a subdirectory of dir named after the namespace. Existing namespaces are
+restored from them, and namespaces that are on disk but don't exist yet are created,
+along with the aliases saved there, so that a restarted server picks up where it left off.
+It must be called before UseChangelogs.
+*/
+func (n *Namespaces) UseStorage(dir string, options StorageOptions) error {
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	n.mutex.Lock()
+	n.dataDir = dir
+	n.storage = options
+	for _, dispatcher := range n.dispatchers {
+		if err := n.openStorage(dispatcher); err != nil {
+			n.mutex.Unlock()
+			return err
+		}
+	}
+	n.mutex.Unlock()
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !NAMESPACE_NAME_PATTERN.MatchString(name) {
+			continue
+		}
+		if _, err := n.Get(name); err == nil {
+			continue
+		}
+		if _, err := n.Create(name); err != nil {
+			return err
+		}
+	}
+	return n.loadAliases()
+}
+
+func (n *Namespaces) openStorage(dispatcher *ThreadSafeDispatcher) error {
+	dir := filepath.Join(n.dataDir, dispatcher.name)
+
+	store, err := OpenSnapshotStore(dir, n.storage.SnapshotRetain, n.keyring)
+	if err != nil {
+		return err
+	}
+	if err := dispatcher.UseSnapshots(store); err != nil {
+		return err
+	}
+
+	if n.storage.Fsync == "" {
+		return nil
+	}
+	wal, err := OpenWriteAheadLog(dir, n.storage.Fsync, n.keyring)
+	if err != nil {
+		return err
+	}
+	if err := dispatcher.UseWriteAheadLog(wal); err != nil {
+		return err
+	}
+	return dispatcher.UseCompaction(n.storage.Compaction)
+}
+
+/*
+SnapshotAll saves a snapshot of every namespace that changed since its last one.
+*/
+func (n *Namespaces) SnapshotAll() {
+	n.mutex.RLock()
+	dispatchers := make([]*ThreadSafeDispatcher, 0, len(n.dispatchers))
+	for _, dispatcher := range n.dispatchers {
+		dispatchers = append(dispatchers, dispatcher)
+	}
+	n.mutex.RUnlock()
+
+	for _, dispatcher := range dispatchers {
+		if dispatcher.snapshots == nil || dispatcher.snapshots.Revision() == dispatcher.Revision() {
+			continue
+		}
+		if _, err := dispatcher.Snapshot(); err != nil {
+			logger.Errorf("Error saving snapshot of namespace %s: %v", dispatcher.name, err)
+		}
+	}
+}
+
+func (n *Namespaces) openChangelog(dispatcher *ThreadSafeDispatcher) error {
+	changelog, err := OpenChangelog(filepath.Join(n.changelogDir, dispatcher.name), n.changelogSegments, n.storage.Fsync, n.keyring)
+	if err != nil {
+		return err
+	}
+	return dispatcher.UseChangelog(changelog)
+}
+
+/*
+Returns the commands that manage namespaces. They don't touch the trie of the
+namespace they are sent to, so they run without its lock.
+*/
+func namespaceCommands(namespaces *Namespaces) []*Command {
+	return []*Command{
+		{
+			Name:      "create_namespace",
+			Code:      NO_LEGACY_CODE,
+			Unlocked:  true,
+			ParseArgs: argsParser(func() interface{} { return &namespaceArgs{} }),
+			// result: the new namespace's NamespaceInfo
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				dispatcher, err := namespaces.Create(args.(*namespaceArgs).Name)
+				if err != nil {
+					return nil, err
+				}
+				return dispatcher.Info(), nil
+			},
+			Describe: func(args interface{}) string {
+				return "creating namespace " + args.(*namespaceArgs).Name
+			},
+		},
+		{
+			Name:      "drop_namespace",
+			Code:      NO_LEGACY_CODE,
+			Unlocked:  true,
+			ParseArgs: argsParser(func() interface{} { return &namespaceArgs{} }),
+			// result: true
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				if err := namespaces.Drop(args.(*namespaceArgs).Name); err != nil {
+					return nil, err
+				}
+				return true, nil
+			},
+			Describe: func(args interface{}) string {
+				return "dropping namespace " + args.(*namespaceArgs).Name
+			},
+		},
+		{
+			Name:      "list_namespaces",
+			Code:      NO_LEGACY_CODE,
+			ReadOnly:  true,
+			Unlocked:  true,
+			ParseArgs: argsParser(func() interface{} { return &struct{}{} }),
+			// result: the names of all namespaces
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				return namespaces.Names(), nil
+			},
+		},
+		{
+			Name:      "describe_namespace",
+			Code:      NO_LEGACY_CODE,
+			ReadOnly:  true,
+			Unlocked:  true,
+			ParseArgs: argsParser(func() interface{} { return &namespaceArgs{} }),
+			// result: the namespace's NamespaceInfo
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				dispatcher, err := namespaces.Get(args.(*namespaceArgs).Name)
+				if err != nil {
+					return nil, err
+				}
+				return dispatcher.Info(), nil
+			},
+			Describe: func(args interface{}) string {
+				return "describing namespace " + args.(*namespaceArgs).Name
+			},
+		},
+		{
+			Name:      "set_alias",
+			Code:      NO_LEGACY_CODE,
+			Unlocked:  true,
+			ParseArgs: argsParser(func() interface{} { return &aliasArgs{} }),
+			// result: true
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				aliasArgs := args.(*aliasArgs)
+				if err := namespaces.SetAlias(aliasArgs.Alias, aliasArgs.Namespace); err != nil {
+					return nil, err
+				}
+				return true, nil
+			},
+			Describe: func(args interface{}) string {
+				aliasArgs := args.(*aliasArgs)
+				return "pointing alias " + aliasArgs.Alias + " at namespace " + aliasArgs.Namespace
+			},
+		},
+		{
+			Name:      "drop_alias",
+			Code:      NO_LEGACY_CODE,
+			Unlocked:  true,
+			ParseArgs: argsParser(func() interface{} { return &aliasArgs{} }),
+			// result: true
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				if err := namespaces.DropAlias(args.(*aliasArgs).Alias); err != nil {
+					return nil, err
+				}
+				return true, nil
+			},
+			Describe: func(args interface{}) string {
+				return "dropping alias " + args.(*aliasArgs).Alias
+			},
+		},
+		{
+			Name:      "list_aliases",
+			Code:      NO_LEGACY_CODE,
+			ReadOnly:  true,
+			Unlocked:  true,
+			ParseArgs: argsParser(func() interface{} { return &struct{}{} }),
+			// result: an object mapping each alias to its namespace
+			Run: func(trie *Trie, args interface{}) (interface{}, error) {
+				return namespaces.Aliases(), nil
+			},
+		},
+		mountDictionaryCommand(namespaces),
+		unmountDictionaryCommand(namespaces),
+		replicationStatusCommand(namespaces.replication),
+	}
+}
+
+/*
+Removes the "namespace" member from a JSON object of arguments, for the protocols
+that send the namespace along with the command's own arguments.
+*/
+func splitNamespaceArg(raw json.RawMessage) (string, json.RawMessage, error) {
+	if len(raw) == 0 || !IsV2Message(raw) {
+		return "", raw, nil
+	}
+
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &members); err != nil {
+		return "", nil, &CodedError{Code: ERR_CODE_INVALID, Message: "invalid arguments: " + err.Error()}
+	}
+
+	encodedNamespace, ok := members["namespace"]
+	if !ok {
+		return "", raw, nil
+	}
+
+	var namespace string
+	if err := json.Unmarshal(encodedNamespace, &namespace); err != nil {
+		return "", nil, &CodedError{Code: ERR_CODE_INVALID, Message: "namespace must be a string"}
+	}
+
+	delete(members, "namespace")
+	// Re-encoding decoded JSON never fails
+	rest, _ := json.Marshal(members)
+	return namespace, rest, nil
+}
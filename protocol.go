@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+/*
+Protocol versions understood by the server.
+
+Version 1 is the legacy format handled by DispatchRaw: a single ASCII command code
+followed by the command's argument.
+
+Version 2 wraps every request in a JSON envelope, so that commands have names
+and can take any number of structured arguments:
+
+	{"v": 2, "id": 7, "op": "completions", "args": {"prefix": "fo", "limit": 10}}
+
+and every response in a matching envelope, echoing the request's id:
+
+	{"v": 2, "id": 7, "ok": true, "result": ["foo", "fox"]}
+	{"v": 2, "id": 8, "ok": false, "error": {"code": "conflict", "message": "..."}}
+
+Clients negotiate a version with the "hello" op, sending the versions they support.
+The server answers with the highest version they have in common.
+
+	{"op": "hello", "args": {"versions": [1, 2]}}
+
+Requests run in the default namespace unless the envelope names another one:
+
+	{"namespace": "team", "op": "insert", "args": {"key": "foo"}}
+*/
+const (
+	PROTOCOL_VERSION_LEGACY = 1
+	PROTOCOL_VERSION_V2     = 2
+)
+
+// Protocol versions this server speaks, in ascending order
+var SUPPORTED_PROTOCOL_VERSIONS = []int{PROTOCOL_VERSION_LEGACY, PROTOCOL_VERSION_V2}
+
+/*
+V2Request is the envelope of a version 2 request.
+*/
+type V2Request struct {
+	// Version is the protocol version of the envelope (defaults to 2)
+	Version int `json:"v"`
+	// ID is an opaque, client-chosen value echoed in the response
+	ID json.RawMessage `json:"id,omitempty"`
+	// Namespace is the namespace the command runs in (the default namespace if empty)
+	Namespace string `json:"namespace,omitempty"`
+	// Op is the name of the command
+	Op string `json:"op"`
+	// Args holds the command's named arguments
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+/*
+V2Error describes a failed version 2 request.
+*/
+type V2Error struct {
+	// Code is one of the ERR_CODE_* constants
+	Code string `json:"code"`
+	// Message is a human-readable description of the error
+	Message string `json:"message"`
+}
+
+/*
+V2Response is the envelope of a version 2 response.
+*/
+type V2Response struct {
+	Version int             `json:"v"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	OK      bool            `json:"ok"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *V2Error        `json:"error,omitempty"`
+}
+
+/*
+IsV2Message returns whether a message uses the version 2 envelope.
+Legacy messages always start with a digit, so they can never be mistaken for JSON objects.
+*/
+func IsV2Message(message []byte) bool {
+	trimmed := bytes.TrimLeft(message, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+/*
+DispatchV2 handles a version 2 request, returning the encoded response envelope.
+If the request failed, the error is returned as well, but it is already described in the envelope.
+*/
+func (s *ThreadSafeDispatcher) DispatchV2(message []byte) ([]byte, error) {
+	return s.dispatchV2(nil, message)
+}
+
+func (s *ThreadSafeDispatcher) dispatchV2(token *Token, message []byte) ([]byte, error) {
+	var request V2Request
+	if err := json.Unmarshal(message, &request); err != nil {
+		err = &CodedError{Code: ERR_CODE_INVALID, Message: "malformed request envelope"}
+		return encodeV2Response(nil, nil, err), err
+	}
+
+	result, err := s.dispatchV2Request(token, &request)
+	return encodeV2Response(request.ID, result, err), err
+}
+
+/*
+LookupMessageCommand finds the command a message would run, in either protocol,
+without running it. It fails if the message is malformed or names an unknown command.
+*/
+func (s *ThreadSafeDispatcher) LookupMessageCommand(message []byte) (*Command, bool) {
+	if IsV2Message(message) {
+		var request V2Request
+		if err := json.Unmarshal(message, &request); err != nil {
+			return nil, false
+		}
+		target, err := s.resolve(request.Namespace)
+		if err != nil {
+			return nil, false
+		}
+		return target.commands.Lookup(request.Op)
+	}
+
+	namespace, message := splitLegacyNamespace(message)
+	target, err := s.resolve(namespace)
+	if err != nil || len(message) == 0 {
+		return nil, false
+	}
+	return target.commands.LookupCode(int(message[0]) - ASCII_0)
+}
+
+func (s *ThreadSafeDispatcher) dispatchV2Request(token *Token, request *V2Request) (interface{}, error) {
+	if request.Version != 0 && request.Version != PROTOCOL_VERSION_V2 {
+		return nil, &CodedError{
+			Code:    ERR_CODE_UNSUPPORTED_VERSION,
+			Message: fmt.Sprintf("envelopes must use version %d", PROTOCOL_VERSION_V2),
+		}
+	}
+
+	target, err := s.resolve(request.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if target != s {
+		return target.dispatchV2Request(token, request)
+	}
+
+	command, ok := s.commands.Lookup(request.Op)
+	if !ok {
+		return nil, &CodedError{Code: ERR_CODE_UNKNOWN_COMMAND, Message: fmt.Sprintf("unknown op %q", request.Op)}
+	}
+
+	args, err := command.ParseArgs(request.Args)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.DispatchAs(token, command, args)
+}
+
+/*
+Encodes a response envelope for a request with the given id.
+*/
+func encodeV2Response(id json.RawMessage, result interface{}, err error) []byte {
+	response := V2Response{Version: PROTOCOL_VERSION_V2, ID: id}
+
+	if err == nil {
+		encoded, marshalErr := json.Marshal(result)
+		if marshalErr != nil {
+			err = marshalErr
+		} else {
+			response.OK = true
+			response.Result = encoded
+		}
+	}
+
+	if err != nil {
+		response.Error = &V2Error{Code: ErrorCode(err), Message: ErrorMessage(err)}
+	}
+
+	// A response made of strings, numbers and raw JSON always encodes
+	encoded, _ := json.Marshal(response)
+	return encoded
+}
+
+/*
+Decodes the named arguments of a version 2 request into `args`.
+Missing arguments take their zero value, and unknown arguments are rejected.
+*/
+func decodeV2Args(raw json.RawMessage, args interface{}) error {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(args); err != nil {
+		return &CodedError{Code: ERR_CODE_INVALID, Message: "invalid arguments: " + err.Error()}
+	}
+	return nil
+}
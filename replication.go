@@ -0,0 +1,868 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/logger"
+)
+
+/*
+A server started with REPLICA_OF set to another server's URL is a replica of that
+server, its leader. The replica copies every namespace of the leader, and follows
+its changes as they are made:
+
+	PORT=5001 ./trie
+	PORT=5002 REPLICA_OF=http://localhost:5001 ./trie
+
+Replicas serve reads like any server, and reject writes with ERR_CODE_READ_ONLY (clients
+should send them to the leader), as well as restores. Besides the read-only commands, a
+replica only runs "snapshot", "compact", and the commands for dictionaries and aliases,
+which are its own. Each replica's progress and lag are reported by the
+"replication_status" command, which also lists the replicas following a leader.
+
+The leader serves two routes, which need a token without namespace or prefix limits
+(REPLICA_TOKEN is sent as the replica's bearer token):
+
+	GET /replication/namespaces                    the namespaces to copy, as NamespaceInfo
+	GET /replication/stream?namespace=NAME[&after=REVISION]
+
+A stream starts with a snapshot of the namespace, taken along with the subscription to
+its changes so that no change falls between the two, and goes on with every change.
+A replica that reconnects passes the revision it reached as `after`, and gets the
+changes it missed instead of a snapshot, as long as the leader still remembers them
+(see ChangeHub). The stream is a sequence of frames, each framed like a write-ahead
+log record (see wal.go), whose payload is either a change, like a record's, or:
+
+	REPLICATION_OP_SNAPSHOT     1 byte, then the snapshot (see snapshot.go)
+	REPLICATION_OP_HEARTBEAT    1 byte, then the leader's revision as a uvarint
+
+Heartbeats are sent every REPLICATION_HEARTBEAT_INTERVAL, so the replica knows how far
+behind it is while nothing changes, and notices a dead connection. When a namespace of
+the leader is replaced (a "load" change), the stream ends and the replica starts over
+from a new snapshot.
+
+Replicas look for namespaces created or dropped on the leader every
+REPLICATION_DISCOVERY_INTERVAL. Aliases and dictionaries aren't copied.
+*/
+const (
+	REPLICATION_OP_SNAPSHOT  = 0x10
+	REPLICATION_OP_HEARTBEAT = 0x11
+
+	REPLICATION_HEARTBEAT_INTERVAL = time.Second
+	// A replica reconnects after this long without hearing from its leader, and gives up
+	// on listing the leader's namespaces after this long
+	REPLICATION_TIMEOUT = 5 * REPLICATION_HEARTBEAT_INTERVAL
+	// Time between attempts to reconnect to the leader
+	REPLICATION_RETRY_INTERVAL     = time.Second
+	REPLICATION_DISCOVERY_INTERVAL = 5 * time.Second
+
+	// The largest frame a replica accepts, which bounds the size of a snapshot
+	REPLICATION_MAX_FRAME_SIZE = 1 << 30
+
+	REPLICATION_CONTENT_TYPE = "application/octet-stream"
+)
+
+// Commands that a replica runs on its own, since they don't change its keys or aren't replicated
+var replicaLocalCommands = map[string]bool{
+	"snapshot":           true,
+	"compact":            true,
+	"mount_dictionary":   true,
+	"unmount_dictionary": true,
+	"set_alias":          true,
+	"drop_alias":         true,
+}
+
+/*
+ReplicationStatus describes a server's part in replication.
+*/
+type ReplicationStatus struct {
+	// Role is "replica" if the server follows a leader, and "leader" otherwise
+	Role string `json:"role"`
+	// Leader is the URL of the leader, on a replica
+	Leader string `json:"leader,omitempty"`
+	// Namespaces describes how far behind the leader each namespace is, on a replica
+	Namespaces []ReplicaNamespaceStatus `json:"namespaces,omitempty"`
+	// Followers are the streams this server sends to replicas
+	Followers []FollowerStatus `json:"followers"`
+}
+
+/*
+ReplicaNamespaceStatus describes how a replica follows one of the leader's namespaces.
+*/
+type ReplicaNamespaceStatus struct {
+	Namespace string `json:"namespace"`
+	Connected bool   `json:"connected"`
+	// Revision is the last revision copied from the leader
+	Revision uint64 `json:"revision"`
+	// LeaderRevision is the leader's revision, as of its last message
+	LeaderRevision uint64 `json:"leader_revision"`
+	// LagRevisions is the number of changes still to be copied
+	LagRevisions uint64 `json:"lag_revisions"`
+	// LagMs is how long ago the namespace was last caught up (0 if it is now)
+	LagMs int64 `json:"lag_ms"`
+	// Resyncs counts the snapshots copied from the leader
+	Resyncs     int        `json:"resyncs"`
+	LastContact *time.Time `json:"last_contact,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+/*
+FollowerStatus describes a stream sent to a replica.
+*/
+type FollowerStatus struct {
+	Namespace string    `json:"namespace"`
+	Address   string    `json:"address"`
+	Since     time.Time `json:"since"`
+	// Revision is the last revision sent
+	Revision uint64 `json:"revision"`
+	// LagRevisions is the number of changes the stream has yet to send
+	LagRevisions uint64 `json:"lag_revisions"`
+}
+
+/*
+Replication holds the replication state of a set of namespaces: the streams sent to
+replicas, and, on a replica, the streams received from the leader.
+*/
+type Replication struct {
+	namespaces *Namespaces
+
+	mutex     sync.Mutex
+	followers map[*FollowerStatus]*ThreadSafeDispatcher
+
+	// The fields below are only set on a replica
+	leader string
+	token  string
+	client *http.Client
+	// streams are the namespaces being copied, by name
+	streams map[string]*replicaStream
+	// stopped is closed by Stop
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// The copy of one of the leader's namespaces
+type replicaStream struct {
+	cancel context.CancelFunc
+
+	// status is guarded by the Replication's mutex
+	status ReplicaNamespaceStatus
+	// caughtUp is when the namespace last had every change the leader had
+	caughtUp time.Time
+	// synced is set once a snapshot was copied, after which reconnecting resumes from it
+	synced bool
+}
+
+// Creates the replication state of a set of namespaces
+func newReplication(namespaces *Namespaces) *Replication {
+	return &Replication{
+		namespaces: namespaces,
+		followers:  make(map[*FollowerStatus]*ThreadSafeDispatcher),
+		streams:    make(map[string]*replicaStream),
+		stopped:    make(chan struct{}),
+	}
+}
+
+/*
+IsReplica returns whether the server follows a leader.
+*/
+func (r *Replication) IsReplica() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.leader != ""
+}
+
+// The error of writes sent to a replica
+func (r *Replication) readOnlyError() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return &CodedError{Code: ERR_CODE_READ_ONLY, Message: fmt.Sprintf("this server is a replica of %s, which takes the writes", r.leader)}
+}
+
+/*
+Status describes the server's part in replication.
+*/
+func (r *Replication) Status() ReplicationStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	status := ReplicationStatus{Role: "leader", Followers: make([]FollowerStatus, 0, len(r.followers))}
+	for follower, dispatcher := range r.followers {
+		copied := *follower
+		if revision := dispatcher.Revision(); revision > copied.Revision {
+			copied.LagRevisions = revision - copied.Revision
+		}
+		status.Followers = append(status.Followers, copied)
+	}
+
+	if r.leader != "" {
+		status.Role = "replica"
+		status.Leader = r.leader
+		status.Namespaces = make([]ReplicaNamespaceStatus, 0, len(r.streams))
+		for _, name := range sortedStreamNames(r.streams) {
+			stream := r.streams[name]
+			namespace := stream.status
+			if namespace.LeaderRevision > namespace.Revision {
+				namespace.LagRevisions = namespace.LeaderRevision - namespace.Revision
+				namespace.LagMs = time.Since(stream.caughtUp).Milliseconds()
+			}
+			status.Namespaces = append(status.Namespaces, namespace)
+		}
+	}
+	return status
+}
+
+/*
+HandleReplicationNamespaces serves GET /replication/namespaces, the namespaces replicas copy.
+*/
+func (s *Server) HandleReplicationNamespaces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, err := s.authenticate(r)
+	if err == nil {
+		err = token.AuthorizeAdmin("replicate", true)
+	}
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	infos := make([]NamespaceInfo, 0)
+	for _, name := range s.namespaces.Names() {
+		dispatcher, err := s.namespaces.Get(name)
+		if err != nil || dispatcher.dictionary != nil {
+			continue
+		}
+		infos = append(infos, dispatcher.Info())
+	}
+	writeRESTJSON(w, http.StatusOK, infos)
+}
+
+/*
+HandleReplicationStream serves GET /replication/stream, a namespace's snapshot followed by its changes.
+*/
+func (s *Server) HandleReplicationStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeRESTError(w, &CodedError{Code: ERR_CODE_INVALID, Message: "streaming is not supported"})
+		return
+	}
+
+	token, err := s.authenticate(r)
+	if err == nil {
+		err = token.AuthorizeAdmin("replicate", true)
+	}
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	dispatcher, err := s.namespaces.Get(query.Get("namespace"))
+	if err == nil && dispatcher.dictionary != nil {
+		err = &CodedError{Code: ERR_CODE_INVALID, Message: fmt.Sprintf("namespace %q is a dictionary, which isn't replicated", dispatcher.name)}
+	}
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	resume := query.Get("after") != ""
+	var after uint64
+	if resume {
+		if after, err = strconv.ParseUint(query.Get("after"), 10, 64); err != nil {
+			writeRESTError(w, &CodedError{Code: ERR_CODE_INVALID, Message: "after must be a revision"})
+			return
+		}
+	}
+
+	subscription, snapshot, backlog, err := dispatcher.subscribeForReplica(after, resume)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+	defer subscription.Close()
+
+	follower := &FollowerStatus{Namespace: dispatcher.name, Address: r.RemoteAddr, Since: time.Now(), Revision: after}
+	replication := s.namespaces.replication
+	replication.mutex.Lock()
+	replication.followers[follower] = dispatcher
+	replication.mutex.Unlock()
+	defer func() {
+		replication.mutex.Lock()
+		delete(replication.followers, follower)
+		replication.mutex.Unlock()
+	}()
+
+	// The revision sent so far, as seen by replication_status
+	sent := func(revision uint64) {
+		replication.mutex.Lock()
+		follower.Revision = revision
+		replication.mutex.Unlock()
+	}
+
+	w.Header().Set("Content-Type", REPLICATION_CONTENT_TYPE)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if snapshot != nil {
+		logger.Infof("replicating namespace %s to %s, from a snapshot", dispatcher.name, r.RemoteAddr)
+		if _, err := w.Write(encodeWALRecord(append([]byte{REPLICATION_OP_SNAPSHOT}, snapshot...))); err != nil {
+			return
+		}
+		sent(dispatcher.Revision())
+	} else {
+		logger.Infof("replicating namespace %s to %s, from revision %d", dispatcher.name, r.RemoteAddr, after)
+	}
+	for _, change := range backlog {
+		if _, err := w.Write(encodeWALRecord(encodeWALPayload(change))); err != nil {
+			return
+		}
+		sent(change.Version)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(REPLICATION_HEARTBEAT_INTERVAL)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			payload := appendUvarint([]byte{REPLICATION_OP_HEARTBEAT}, dispatcher.Revision())
+			if _, err := w.Write(encodeWALRecord(payload)); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case change, ok := <-subscription.Events():
+			if !ok {
+				// The namespace was dropped
+				return
+			}
+			if change.Op == CHANGE_OVERFLOW {
+				// The replica reconnects, and catches up from the hub's history
+				logger.Warningf("replica %s fell behind on namespace %s", r.RemoteAddr, dispatcher.name)
+				return
+			}
+
+			if _, err := w.Write(encodeWALRecord(encodeWALPayload(change))); err != nil {
+				return
+			}
+			sent(change.Version)
+			if change.Op == CHANGE_LOAD {
+				// The replica starts over from a snapshot of the new trie
+				flusher.Flush()
+				return
+			}
+			// Send everything that is already waiting before flushing
+			if len(subscription.Events()) == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+/*
+Subscribes to the changes for a replica, along with where the replica starts from: the
+changes after `after` if resume is set and they are all remembered, or a snapshot.
+Nothing changes in between, so the replica misses no change.
+*/
+func (s *ThreadSafeDispatcher) subscribeForReplica(after uint64, resume bool) (*Subscription, []byte, []Change, error) {
+	s.dispatcherMutex.RLock()
+	defer s.dispatcherMutex.RUnlock()
+
+	if resume {
+		s.publishMutex.Lock()
+		revision := s.publishedRevision()
+		if after <= revision {
+			subscription, backlog, complete := s.changes.SubscribeFrom([]string{""}, MAX_SUBSCRIPTION_BUFFER_SIZE, after, revision)
+			// Every change advances the clock by one, so the backlog must hold exactly the
+			// changes up to the published revision
+			if complete && uint64(len(backlog)) == revision-after && (len(backlog) == 0 || backlog[0].Version == after+1) {
+				s.publishMutex.Unlock()
+				return subscription, nil, backlog, nil
+			}
+			subscription.Close()
+		}
+		s.publishMutex.Unlock()
+	}
+
+	// The snapshot may only hold durable changes
+	if err := s.flush(); err != nil {
+		return nil, nil, nil, err
+	}
+	subscription := s.changes.Subscribe([]string{""}, MAX_SUBSCRIPTION_BUFFER_SIZE)
+	var buffer bytes.Buffer
+	// Writing to memory never fails
+	WriteSnapshot(&buffer, s.trie)
+	return subscription, buffer.Bytes(), nil, nil
+}
+
+/*
+Follow makes the namespaces a replica of the leader at a URL, such as http://localhost:5001.
+It copies the leader's namespaces in the background, and keeps looking for new ones.
+*/
+func (r *Replication) Follow(leader string, token string) error {
+	base, err := parseLeaderURL(leader)
+	if err != nil {
+		return err
+	}
+
+	r.mutex.Lock()
+	r.leader = base
+	r.token = token
+	r.client = &http.Client{}
+	r.mutex.Unlock()
+
+	go r.discover()
+	return nil
+}
+
+// Returns the scheme and host of a leader's URL, which the routes are added to
+func parseLeaderURL(leader string) (string, error) {
+	parsed, err := url.Parse(leader)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return "", fmt.Errorf("the leader must be an http:// or https:// URL, not %q", leader)
+	}
+	return parsed.Scheme + "://" + parsed.Host, nil
+}
+
+// Keeps the copied namespaces in line with the leader's, until Stop is called
+func (r *Replication) discover() {
+	for {
+		if err := r.discoverOnce(); err != nil {
+			logger.Errorf("Error listing the leader's namespaces: %v", err)
+		}
+
+		select {
+		case <-r.stopped:
+			return
+		case <-time.After(REPLICATION_DISCOVERY_INTERVAL):
+		}
+	}
+}
+
+/*
+Stop stops copying the leader's namespaces. The server stays a replica, so it keeps
+rejecting writes.
+*/
+func (r *Replication) Stop() {
+	r.stopOnce.Do(func() { close(r.stopped) })
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for name, stream := range r.streams {
+		stream.cancel()
+		delete(r.streams, name)
+	}
+}
+
+func (r *Replication) discoverOnce() error {
+	infos, err := r.listNamespaces()
+	if err != nil {
+		return err
+	}
+
+	leaderNames := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		leaderNames[info.Name] = true
+		r.mutex.Lock()
+		_, following := r.streams[info.Name]
+		r.mutex.Unlock()
+		if following {
+			continue
+		}
+
+		if dispatcher, err := r.namespaces.Get(info.Name); err != nil {
+			if _, err := r.namespaces.Create(info.Name); err != nil {
+				logger.Errorf("Error creating replicated namespace %s: %v", info.Name, err)
+				continue
+			}
+		} else if dispatcher.dictionary != nil {
+			logger.Errorf("Error replicating namespace %s: a local dictionary has the same name", info.Name)
+			continue
+		}
+		r.startStream(info.Name)
+	}
+
+	// Drop what the leader dropped, except for local dictionaries
+	for _, name := range r.namespaces.Names() {
+		dispatcher, err := r.namespaces.Get(name)
+		if err != nil || leaderNames[name] || dispatcher.dictionary != nil || name == DEFAULT_NAMESPACE {
+			continue
+		}
+		r.stopStream(name)
+		if err := r.namespaces.Drop(name); err != nil {
+			logger.Errorf("Error dropping namespace %s, which the leader dropped: %v", name, err)
+		}
+	}
+	return nil
+}
+
+/*
+Lists the leader's namespaces. A leader that doesn't answer in time is given up on
+until the next attempt, so that discovery can't hang.
+*/
+func (r *Replication) listNamespaces() ([]NamespaceInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), REPLICATION_TIMEOUT)
+	defer cancel()
+
+	response, err := r.get(ctx, "/replication/namespaces")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var infos []NamespaceInfo
+	if err := json.NewDecoder(response.Body).Decode(&infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// Sends a GET request to the leader
+func (r *Replication) get(ctx context.Context, path string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", r.leader+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.token != "" {
+		request.Header.Set("Authorization", "Bearer "+r.token)
+	}
+
+	response, err := r.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		defer response.Body.Close()
+		var body restError
+		json.NewDecoder(response.Body).Decode(&body)
+		return nil, fmt.Errorf("the leader answered %s: %s", response.Status, body.Error.Message)
+	}
+	return response, nil
+}
+
+// Starts copying a namespace
+func (r *Replication) startStream(name string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &replicaStream{cancel: cancel, status: ReplicaNamespaceStatus{Namespace: name}, caughtUp: time.Now()}
+
+	r.mutex.Lock()
+	select {
+	case <-r.stopped:
+		// Stopped while the namespaces were being listed
+		r.mutex.Unlock()
+		cancel()
+		return
+	default:
+	}
+	r.streams[name] = stream
+	r.mutex.Unlock()
+
+	go func() {
+		for ctx.Err() == nil {
+			err := r.follow(ctx, name, stream)
+			if ctx.Err() != nil {
+				return
+			}
+
+			r.mutex.Lock()
+			stream.status.Connected = false
+			if err != nil {
+				stream.status.LastError = err.Error()
+			}
+			r.mutex.Unlock()
+			if err != nil {
+				logger.Errorf("Error replicating namespace %s: %v", name, err)
+			}
+			time.Sleep(REPLICATION_RETRY_INTERVAL)
+		}
+	}()
+}
+
+// Stops copying a namespace
+func (r *Replication) stopStream(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if stream, ok := r.streams[name]; ok {
+		stream.cancel()
+		delete(r.streams, name)
+	}
+}
+
+/*
+Copies a namespace over one connection to the leader, until the connection ends.
+It returns nil when the leader ends the stream on purpose, to start over.
+*/
+func (r *Replication) follow(ctx context.Context, name string, stream *replicaStream) error {
+	dispatcher, err := r.namespaces.Get(name)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"namespace": {name}}
+	r.mutex.Lock()
+	if stream.synced {
+		query.Set("after", strconv.FormatUint(dispatcher.Revision(), 10))
+	}
+	r.mutex.Unlock()
+
+	// The request is cancelled if the leader goes quiet, since heartbeats stopped. Any bytes
+	// count as hearing from it, so that a large snapshot can take longer than the timeout.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	watchdog := time.AfterFunc(REPLICATION_TIMEOUT, cancel)
+	defer watchdog.Stop()
+
+	response, err := r.get(ctx, "/replication/stream?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	r.mutex.Lock()
+	stream.status.Connected = true
+	stream.status.LastError = ""
+	r.mutex.Unlock()
+
+	reader := bufio.NewReader(&watchdogReader{reader: response.Body, watchdog: watchdog})
+	var position uint64
+	// Changes that arrived before the stream ended are committed too, so they get published
+	defer func() {
+		if position > 0 {
+			dispatcher.commit(position)
+		}
+	}()
+	for {
+		payload, err := readReplicationFrame(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return errors.New("the leader stopped sending heartbeats")
+			}
+			return err
+		}
+
+		now := time.Now()
+		leaderRevision := uint64(0)
+		switch payload[0] {
+		case REPLICATION_OP_SNAPSHOT:
+			trie, err := ReadSnapshot(bytes.NewReader(payload[1:]))
+			if err != nil {
+				return fmt.Errorf("invalid snapshot from the leader: %v", err)
+			}
+			if err := dispatcher.resync(trie); err != nil {
+				return err
+			}
+			logger.Infof("copied namespace %s from the leader at revision %d", name, trie.Clock)
+
+			r.mutex.Lock()
+			stream.synced = true
+			stream.status.Resyncs++
+			r.mutex.Unlock()
+			leaderRevision = trie.Clock
+
+		case REPLICATION_OP_HEARTBEAT:
+			revision, n := binary.Uvarint(payload[1:])
+			if n <= 0 {
+				return errors.New("invalid heartbeat from the leader")
+			}
+			leaderRevision = revision
+
+		default:
+			change, err := decodeWALPayload(payload)
+			if err != nil {
+				return fmt.Errorf("invalid change from the leader: %v", err)
+			}
+			if change.Op == CHANGE_LOAD {
+				// The leader's trie was replaced, so it is copied again
+				r.mutex.Lock()
+				stream.synced = false
+				r.mutex.Unlock()
+				return nil
+			}
+
+			if position, err = dispatcher.replicate(change); err != nil {
+				r.mutex.Lock()
+				stream.synced = false
+				r.mutex.Unlock()
+				return err
+			}
+			leaderRevision = change.Version
+		}
+
+		// Changes that arrived together are made durable together
+		if reader.Buffered() == 0 {
+			if err := dispatcher.commit(position); err != nil {
+				return err
+			}
+		}
+
+		revision := dispatcher.Revision()
+		r.mutex.Lock()
+		stream.status.LastContact = &now
+		stream.status.Revision = revision
+		if leaderRevision > stream.status.LeaderRevision || payload[0] != REPLICATION_OP_HEARTBEAT {
+			stream.status.LeaderRevision = leaderRevision
+		}
+		if revision >= stream.status.LeaderRevision {
+			stream.caughtUp = now
+		}
+		r.mutex.Unlock()
+	}
+}
+
+// Resets a watchdog whenever bytes are read
+type watchdogReader struct {
+	reader   io.Reader
+	watchdog *time.Timer
+}
+
+func (r *watchdogReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.watchdog.Reset(REPLICATION_TIMEOUT)
+	}
+	return n, err
+}
+
+/*
+Reads a frame of a replication stream, returning its payload. The payload is read as it
+arrives rather than allocated up front, so a corrupt length can't exhaust memory.
+*/
+func readReplicationFrame(reader *bufio.Reader) ([]byte, error) {
+	header := make([]byte, WAL_RECORD_HEADER_SIZE)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header))
+	if length > REPLICATION_MAX_FRAME_SIZE {
+		return nil, fmt.Errorf("frame of %d bytes is over the limit of %d", length, REPLICATION_MAX_FRAME_SIZE)
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(reader, length))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(payload)) < length {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if crc32.Checksum(payload, snapshotCRCTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("frame checksum mismatch")
+	}
+	if len(payload) == 0 {
+		return nil, errors.New("empty frame")
+	}
+	return payload, nil
+}
+
+/*
+Replaces the trie with a copy of the leader's, keeping the leader's revision. The copy's
+snapshot is written before the write lock is taken, and put in place while the load is
+recorded, as for a restore (see Load).
+*/
+func (s *ThreadSafeDispatcher) resync(trie *Trie) error {
+	// Only the stream copying the namespace changes it, so the copy is the latest state
+	snapshot, err := s.prepareSnapshot(trie)
+	if err != nil {
+		return err
+	}
+
+	position, failed := s.change(func() {
+		if err = s.recordLoad(trie.Clock, trie.Clock+1, snapshot); err != nil {
+			return
+		}
+		trie.observer = s.trie.observer
+		s.trie.observer = nil
+		s.trie = trie
+	})
+	if failed != nil {
+		discardSnapshot(snapshot)
+		return failed
+	}
+	return s.finishLoad(err, position, snapshot, trie.Clock+1)
+}
+
+/*
+Makes a change copied from the leader, which must come right after the trie's clock,
+returning the write-ahead log's position after it. Changes the trie already has are
+skipped.
+*/
+func (s *ThreadSafeDispatcher) replicate(change Change) (uint64, error) {
+	var err error
+	position, failed := s.change(func() {
+		if change.Version <= s.trie.Clock {
+			return
+		}
+		if change.Version != s.trie.Clock+1 {
+			err = fmt.Errorf("the leader skipped from revision %d to %d", s.trie.Clock, change.Version)
+			return
+		}
+		// The replica's own logs and subscribers need to know about the change too
+		err = s.trie.ApplyObserved(change)
+	})
+	if failed != nil {
+		return 0, failed
+	}
+	return position, err
+}
+
+func sortedStreamNames(streams map[string]*replicaStream) []string {
+	names := make([]string, 0, len(streams))
+	for name := range streams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+Returns the "replication_status" command.
+*/
+func replicationStatusCommand(replication *Replication) *Command {
+	return &Command{
+		Name:      "replication_status",
+		Code:      NO_LEGACY_CODE,
+		ReadOnly:  true,
+		Unlocked:  true,
+		ParseArgs: argsParser(func() interface{} { return &struct{}{} }),
+		// result: a ReplicationStatus
+		Run: func(trie *Trie, args interface{}) (interface{}, error) {
+			return replication.Status(), nil
+		},
+	}
+}
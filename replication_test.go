@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// How long the tests wait for a replica to catch up
+const testReplicationWait = 10 * time.Second
+
+func TestReadReplicationFrame(t *testing.T) {
+	change := encodeWALRecord(encodeWALPayload(Change{Op: CHANGE_INSERT, Key: "apple", Version: 7}))
+	heartbeat := encodeWALRecord(appendUvarint([]byte{REPLICATION_OP_HEARTBEAT}, 42))
+
+	corrupt := append([]byte(nil), change...)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	// A length far past REPLICATION_MAX_FRAME_SIZE, with no payload behind it
+	oversized := appendUint32(appendUint32(nil, 0xffffffff), 0)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "change", data: change, want: change[WAL_RECORD_HEADER_SIZE:]},
+		{name: "heartbeat", data: heartbeat, want: heartbeat[WAL_RECORD_HEADER_SIZE:]},
+		{name: "bad checksum", data: corrupt, wantErr: true},
+		{name: "empty payload", data: encodeWALRecord(nil), wantErr: true},
+		{name: "cut off header", data: change[:WAL_RECORD_HEADER_SIZE-1], wantErr: true},
+		{name: "cut off payload", data: change[:len(change)-1], wantErr: true},
+		{name: "oversized", data: oversized, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, err := readReplicationFrame(bufio.NewReader(bytes.NewReader(test.data)))
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got payload %x", payload)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload, test.want) {
+				t.Fatalf("got payload %x, want %x", payload, test.want)
+			}
+		})
+	}
+}
+
+func TestParseLeaderURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "http://localhost:5001", want: "http://localhost:5001"},
+		{url: "https://leader.example.com/some/path?x=1", want: "https://leader.example.com"},
+		{url: "localhost:5001"},
+		{url: "ftp://localhost:5001"},
+		{url: "http://"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			base, err := parseLeaderURL(test.url)
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("expected %q to be refused, got %q", test.url, base)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if base != test.want {
+				t.Fatalf("got %q, want %q", base, test.want)
+			}
+		})
+	}
+}
+
+func TestSubscribeForReplica(t *testing.T) {
+	dispatcher := NewThreadSafeDispatcher(nil)
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := dispatcher.trie.Add(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		after        uint64
+		resume       bool
+		wantSnapshot bool
+		wantBacklog  int
+	}{
+		{name: "first connection", wantSnapshot: true},
+		{name: "from the start", after: 0, resume: true, wantBacklog: 3},
+		{name: "missed one change", after: 2, resume: true, wantBacklog: 1},
+		{name: "caught up", after: 3, resume: true},
+		{name: "ahead of the leader", after: 4, resume: true, wantSnapshot: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			subscription, snapshot, backlog, err := dispatcher.subscribeForReplica(test.after, test.resume)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer subscription.Close()
+
+			if (snapshot != nil) != test.wantSnapshot {
+				t.Fatalf("got a snapshot: %v, want one: %v", snapshot != nil, test.wantSnapshot)
+			}
+			if len(backlog) != test.wantBacklog {
+				t.Fatalf("got %d changes, want %d", len(backlog), test.wantBacklog)
+			}
+			for i, change := range backlog {
+				if change.Version != test.after+uint64(i)+1 {
+					t.Fatalf("change %d has revision %d, want %d", i, change.Version, test.after+uint64(i)+1)
+				}
+			}
+		})
+	}
+
+	t.Run("forgotten changes", func(t *testing.T) {
+		// Changes made before the hub existed, as before a restart
+		dispatcher := NewThreadSafeDispatcher(nil)
+		dispatcher.trie.Clock = 10
+		if _, err := dispatcher.trie.Add("a"); err != nil {
+			t.Fatal(err)
+		}
+
+		subscription, snapshot, backlog, err := dispatcher.subscribeForReplica(5, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer subscription.Close()
+		if snapshot == nil || len(backlog) != 0 {
+			t.Fatalf("expected a snapshot, got %d changes", len(backlog))
+		}
+	})
+}
+
+func TestReplication(t *testing.T) {
+	leader := NewServer()
+	listener := httptest.NewServer(leader.HttpServeMux())
+	defer listener.Close()
+	defer listener.CloseClientConnections()
+
+	for _, key := range []string{"apple", "banana"} {
+		if _, err := leader.Run("insert", &keyArgs{Key: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replica := NewServer()
+	if err := replica.Follow(listener.URL, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer replica.namespaces.replication.Stop()
+
+	t.Run("bootstrap", func(t *testing.T) {
+		waitForKeys(t, replica, []string{"apple", "banana"})
+		if resyncs := replicaResyncs(replica); resyncs != 1 {
+			t.Fatalf("got %d resyncs, want 1", resyncs)
+		}
+	})
+
+	t.Run("rejected writes", func(t *testing.T) {
+		_, err := replica.Run("insert", &keyArgs{Key: "cherry"})
+		var coded *CodedError
+		if !errors.As(err, &coded) || coded.Code != ERR_CODE_READ_ONLY {
+			t.Fatalf("got error %v, want %s", err, ERR_CODE_READ_ONLY)
+		}
+	})
+
+	t.Run("live changes", func(t *testing.T) {
+		if _, err := leader.Run("delete", &keyArgs{Key: "apple"}); err != nil {
+			t.Fatal(err)
+		}
+		waitForKeys(t, replica, []string{"banana"})
+	})
+
+	t.Run("resume after a reconnect", func(t *testing.T) {
+		listener.CloseClientConnections()
+		if _, err := leader.Run("insert", &keyArgs{Key: "cherry"}); err != nil {
+			t.Fatal(err)
+		}
+
+		waitForKeys(t, replica, []string{"banana", "cherry"})
+		// The replica passed `after`, so it got the missed change instead of a snapshot
+		if resyncs := replicaResyncs(replica); resyncs != 1 {
+			t.Fatalf("got %d resyncs, want 1", resyncs)
+		}
+	})
+
+	t.Run("resync after a load", func(t *testing.T) {
+		leaderNamespace, err := leader.namespaces.Get("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := leaderNamespace.Import([]string{"durian"}, IMPORT_MODE_REPLACE); err != nil {
+			t.Fatal(err)
+		}
+
+		waitForKeys(t, replica, []string{"durian"})
+		if resyncs := replicaResyncs(replica); resyncs != 2 {
+			t.Fatalf("got %d resyncs, want 2", resyncs)
+		}
+		if leaderRevision, revision := leader.namespaces.Default().Revision(), replica.namespaces.Default().Revision(); revision != leaderRevision {
+			t.Fatalf("the replica is at revision %d, the leader at %d", revision, leaderRevision)
+		}
+	})
+}
+
+// Waits until the replica's default namespace holds exactly the given keys
+func waitForKeys(t *testing.T, server *Server, want []string) {
+	t.Helper()
+
+	deadline := time.Now().Add(testReplicationWait)
+	var keys []string
+	for time.Now().Before(deadline) {
+		result, err := server.Run("keys", &keysArgs{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = result.([]string)
+		if equalKeys(keys, want) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("got keys %q, want %q", keys, want)
+}
+
+func equalKeys(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns how many snapshots a replica copied into its default namespace
+func replicaResyncs(server *Server) int {
+	for _, namespace := range server.namespaces.replication.Status().Namespaces {
+		if namespace.Namespace == DEFAULT_NAMESPACE {
+			return namespace.Resyncs
+		}
+	}
+	return 0
+}
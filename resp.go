@@ -0,0 +1,732 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/logger"
+)
+
+/*
+A RESP (REdis Serialization Protocol) listener, so that redis-cli and Redis client
+libraries can talk to the trie. The trie is presented as a Redis set:
+
+	SADD key member [member ...]     Insert members, replying with how many were new
+	SREM key member [member ...]     Delete members, replying with how many were removed
+	SISMEMBER key member             1 if the member exists, 0 otherwise
+	SMISMEMBER key member [...]      SISMEMBER for several members at once
+	SMEMBERS key                     All members
+	SCARD key                        Number of members
+	SSCAN key cursor [MATCH pattern] [COUNT count]
+	SCAN cursor [MATCH pattern] [COUNT count]
+	PREFIX prefix [LIMIT limit]      Members starting with prefix (alias: COMPLETE)
+	NAMESPACE [name]                 Switch the connection to a namespace, or name the current one
+	AUTH [username] token            Authenticate with an API token (the username is ignored)
+
+Each namespace is a single set, so the key argument of the set commands is accepted but
+ignored. Connections start in the default namespace. If the server has API tokens, connections
+must AUTH (or HELLO with AUTH) before running any of the commands above. Both RESP2 and RESP3 are spoken; clients switch with HELLO 3. Commands may be
+pipelined: replies are buffered and flushed once no more input is waiting.
+*/
+
+// Limits on incoming requests, to stop a client from making us allocate without bound
+const (
+	MAX_RESP_ARGUMENTS     = 1 << 20
+	MAX_RESP_BULK_LENGTH   = 1 << 20
+	MAX_RESP_INLINE_LENGTH = 64 * 1024
+)
+
+// Number of keys a SCAN returns when no COUNT is given
+const RESP_DEFAULT_SCAN_COUNT = 10
+
+/*
+ServeRESP accepts RESP connections on a listener until it fails.
+*/
+func (s *Server) ServeRESP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handleRESPConn(conn)
+	}
+}
+
+// State of a single RESP connection
+type respConn struct {
+	server *Server
+	reader *bufio.Reader
+	writer *respWriter
+	// namespace is the namespace commands run in, set with NAMESPACE
+	namespace string
+	// token is the token of the client's certificate, or the one set with AUTH
+	token *Token
+}
+
+func (s *Server) handleRESPConn(conn net.Conn) {
+	defer conn.Close()
+
+	logger.Infof("received RESP connection from %s", conn.RemoteAddr())
+
+	token, err := s.authenticateConn(conn)
+	if err != nil {
+		logger.Errorf("Error in TLS handshake: %v", err)
+		return
+	}
+
+	c := &respConn{
+		server:    s,
+		reader:    bufio.NewReaderSize(conn, MAX_RESP_INLINE_LENGTH),
+		writer:    &respWriter{Writer: bufio.NewWriter(conn), protocol: 2},
+		namespace: DEFAULT_NAMESPACE,
+		token:     token,
+	}
+
+	for {
+		args, err := readRESPCommand(c.reader)
+		if err != nil {
+			if err != io.EOF {
+				logger.Errorf("Error reading RESP command: %v", err)
+				c.writer.writeError("ERR Protocol error: " + err.Error())
+				c.writer.Flush()
+			}
+			return
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := c.execute(args)
+
+		// Flush once the client has no more pipelined commands waiting
+		if quit || c.reader.Buffered() == 0 {
+			if err := c.writer.Flush(); err != nil {
+				logger.Errorf("Error writing RESP reply: %v", err)
+				return
+			}
+		}
+
+		if quit {
+			return
+		}
+	}
+}
+
+/*
+Reads one command, either as an array of bulk strings or as an inline command.
+*/
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '*' {
+		// Inline command, as typed into telnet
+		return strings.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > MAX_RESP_ARGUMENTS {
+		return nil, errors.New("invalid multibulk length")
+	}
+	if count <= 0 {
+		// A null or empty array holds no command, so it is skipped like an empty line
+		return []string{}, nil
+	}
+
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		header, err := readRESPLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		if len(header) == 0 || header[0] != '$' {
+			return nil, fmt.Errorf("expected '$', got '%s'", header)
+		}
+
+		length, err := strconv.Atoi(header[1:])
+		if err != nil || length < 0 || length > MAX_RESP_BULK_LENGTH {
+			return nil, errors.New("invalid bulk length")
+		}
+
+		// The bulk string is followed by CRLF
+		bulk := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, bulk); err != nil {
+			return nil, err
+		}
+		args = append(args, string(bulk[:length]))
+	}
+
+	return args, nil
+}
+
+/*
+Reads a CRLF-terminated line, without the terminator.
+*/
+func readRESPLine(reader *bufio.Reader) (string, error) {
+	// The reader's buffer is MAX_RESP_INLINE_LENGTH long, so longer lines fill it
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errors.New("line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+/*
+Runs a command and writes its reply, returning whether the connection should be closed.
+*/
+func (c *respConn) execute(args []string) bool {
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+
+	logger.Infof("RESP command %s", name)
+
+	switch name {
+	case "QUIT":
+		c.writer.writeSimpleString("OK")
+		return true
+
+	case "PING":
+		if len(args) > 0 {
+			c.writer.writeBulkString(args[0])
+		} else {
+			c.writer.writeSimpleString("PONG")
+		}
+
+	case "ECHO":
+		if c.checkArity(name, args, 1, 1) {
+			c.writer.writeBulkString(args[0])
+		}
+
+	case "HELLO":
+		c.hello(args)
+
+	case "SELECT", "CLIENT":
+		// Accepted for compatibility with clients that send them on connect
+		c.writer.writeSimpleString("OK")
+
+	case "AUTH":
+		if c.checkArity(name, args, 1, 2) && c.auth(args[len(args)-1]) {
+			c.writer.writeSimpleString("OK")
+		}
+
+	case "NAMESPACE":
+		if !c.checkArity(name, args, 0, 1) {
+			break
+		}
+		if err := c.server.requireToken(c.token); err != nil {
+			c.writer.writeDispatchError(err)
+			break
+		}
+		if len(args) == 0 {
+			c.writer.writeBulkString(c.namespace)
+			break
+		}
+		if _, err := c.server.namespaces.Get(args[0]); err != nil {
+			c.writer.writeDispatchError(err)
+			break
+		}
+		c.namespace = args[0]
+		c.writer.writeSimpleString("OK")
+
+	case "COMMAND":
+		// redis-cli asks for command docs on startup; we have none to offer
+		c.writer.writeArrayHeader(0)
+
+	case "SADD":
+		if c.checkArity(name, args, 2, -1) && c.checkMembers(args[1:]) {
+			c.countBatch("insert", args[1:])
+		}
+
+	case "SREM":
+		if c.checkArity(name, args, 2, -1) && c.checkMembers(args[1:]) {
+			c.countBatch("delete", args[1:])
+		}
+
+	case "SISMEMBER":
+		if c.checkArity(name, args, 2, 2) {
+			result, err := c.run("exists", &keyArgs{Key: args[1]})
+			if err != nil {
+				c.writer.writeDispatchError(err)
+			} else {
+				c.writer.writeBoolInteger(result.(bool))
+			}
+		}
+
+	case "SMISMEMBER":
+		if c.checkArity(name, args, 2, -1) {
+			result, err := c.run("exists_many", &keyListArgs{Keys: args[1:]})
+			if err != nil {
+				c.writer.writeDispatchError(err)
+				break
+			}
+
+			batch := result.(BatchResult)
+			c.writer.writeArrayHeader(len(batch.Results))
+			for _, item := range batch.Results {
+				c.writer.writeBoolInteger(item.Result)
+			}
+		}
+
+	case "SMEMBERS":
+		if c.checkArity(name, args, 1, 1) {
+			c.listKeys("keys", &keysArgs{}, true)
+		}
+
+	case "SCARD":
+		if c.checkArity(name, args, 1, 1) {
+			result, err := c.run("count", &struct{}{})
+			if err != nil {
+				c.writer.writeDispatchError(err)
+			} else {
+				c.writer.writeInteger(int64(result.(int)))
+			}
+		}
+
+	case "SCAN":
+		if c.checkArity(name, args, 1, -1) {
+			c.scan(args)
+		}
+
+	case "SSCAN":
+		if c.checkArity(name, args, 2, -1) {
+			c.scan(args[1:])
+		}
+
+	case "PREFIX", "COMPLETE":
+		if !c.checkArity(name, args, 1, 3) {
+			break
+		}
+
+		completionsArgs := &completionsArgs{Prefix: args[0]}
+		if len(args) > 1 {
+			if len(args) != 3 || strings.ToUpper(args[1]) != "LIMIT" {
+				c.writer.writeError("ERR syntax error")
+				break
+			}
+
+			limit, err := strconv.Atoi(args[2])
+			if err != nil || limit < 0 {
+				c.writer.writeError("ERR value is not an integer or out of range")
+				break
+			}
+			completionsArgs.Limit = limit
+		}
+
+		c.listKeys("completions", completionsArgs, false)
+
+	default:
+		c.writer.writeError(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(name)))
+	}
+
+	return false
+}
+
+// Runs a command in the connection's namespace, as allowed by its token
+func (c *respConn) run(name string, args interface{}) (interface{}, error) {
+	if err := c.server.requireToken(c.token); err != nil {
+		return nil, err
+	}
+	return c.server.RunAs(c.token, c.namespace, name, args)
+}
+
+/*
+Authenticates the connection with a token, writing an error if that fails.
+*/
+func (c *respConn) auth(secret string) bool {
+	token, err := c.server.authenticateSecret(secret)
+	if err != nil {
+		if ErrorCode(err) == ERR_CODE_UNAUTHORIZED {
+			c.writer.writeError("WRONGPASS " + ErrorMessage(err))
+		} else {
+			c.writer.writeDispatchError(err)
+		}
+		return false
+	}
+
+	c.token = token
+	return true
+}
+
+/*
+Checks the number of arguments of a command, writing an error if it's wrong.
+A maximum of -1 means there is no maximum.
+*/
+func (c *respConn) checkArity(name string, args []string, min int, max int) bool {
+	if len(args) < min || (max >= 0 && len(args) > max) {
+		c.writer.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+	return true
+}
+
+/*
+Checks the members of SADD or SREM before any is changed, writing an error if one is invalid.
+Like Redis, the command then changes nothing.
+*/
+func (c *respConn) checkMembers(members []string) bool {
+	for _, member := range members {
+		if len(member) >= MAX_KEY_LENGTH {
+			c.writer.writeError("ERR " + ErrorMessage(errKeyTooLong))
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Runs a batch, replying with the number of keys for which the command returned true.
+The reply is an error if the batch failed for any member.
+*/
+func (c *respConn) countBatch(op string, keys []string) {
+	result, err := c.run("batch", &batchArgs{Op: op, Keys: keys})
+	if err != nil {
+		c.writer.writeDispatchError(err)
+		return
+	}
+
+	batch := result.(BatchResult)
+	for _, item := range batch.Results {
+		if item.Error != "" {
+			c.writer.writeError("ERR " + item.Error)
+			return
+		}
+	}
+
+	c.writer.writeInteger(int64(batch.True))
+}
+
+/*
+Runs a command that returns keys, replying with them as an array (or a set, in RESP3).
+*/
+func (c *respConn) listKeys(name string, args interface{}, asSet bool) {
+	result, err := c.run(name, args)
+	if err != nil {
+		c.writer.writeDispatchError(err)
+		return
+	}
+
+	keys := result.([]string)
+	if asSet {
+		c.writer.writeSetHeader(len(keys))
+	} else {
+		c.writer.writeArrayHeader(len(keys))
+	}
+	for _, key := range keys {
+		c.writer.writeBulkString(key)
+	}
+}
+
+/*
+Serves SCAN cursor [MATCH pattern] [COUNT count].
+Each call reads COUNT keys from the cursor on and replies with those that match, which may
+be none. The cursor is the next key to read, encoded as a number (see encodeScanCursor), so
+keys inserted or deleted during a scan never make it skip or repeat the others.
+*/
+func (c *respConn) scan(args []string) {
+	start, ok := decodeScanCursor(args[0])
+	if !ok {
+		c.writer.writeError("ERR invalid cursor")
+		return
+	}
+
+	pattern := "*"
+	count := RESP_DEFAULT_SCAN_COUNT
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			c.writer.writeError("ERR syntax error")
+			return
+		}
+
+		var err error
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				c.writer.writeError("ERR value is not an integer or out of range")
+				return
+			}
+		default:
+			c.writer.writeError("ERR syntax error")
+			return
+		}
+	}
+
+	// Only keys starting with the pattern's literal prefix can match
+	result, err := c.run("range", &rangeArgs{Prefix: globLiteralPrefix(pattern), Start: start, Limit: count})
+	if err != nil {
+		c.writer.writeDispatchError(err)
+		return
+	}
+	page := result.(RangeResult)
+
+	matches := make([]string, 0, len(page.Keys))
+	for _, key := range page.Keys {
+		if matchGlob(pattern, key) {
+			matches = append(matches, key)
+		}
+	}
+
+	// A cursor of 0 tells the client that the scan is complete
+	next := "0"
+	if page.More {
+		next = encodeScanCursor(page.Next)
+	}
+
+	c.writer.writeArrayHeader(2)
+	c.writer.writeBulkString(next)
+	c.writer.writeArrayHeader(len(matches))
+	for _, key := range matches {
+		c.writer.writeBulkString(key)
+	}
+}
+
+/*
+Encodes the key a SCAN goes on from as a cursor. Clients expect a number, so the cursor is
+the key's bytes read as a big-endian integer, after a leading 1 byte that keeps leading zero
+bytes and the empty key from reading as 0.
+*/
+func encodeScanCursor(key string) string {
+	return new(big.Int).SetBytes(append([]byte{1}, key...)).String()
+}
+
+// Decodes a cursor made by encodeScanCursor, or 0, which starts from the first key
+func decodeScanCursor(cursor string) (string, bool) {
+	if cursor == "0" {
+		return "", true
+	}
+
+	number, ok := new(big.Int).SetString(cursor, 10)
+	if !ok || number.Sign() <= 0 {
+		return "", false
+	}
+	bytes := number.Bytes()
+	if bytes[0] != 1 || len(bytes) > MAX_KEY_LENGTH {
+		return "", false
+	}
+	return string(bytes[1:]), true
+}
+
+/*
+Serves HELLO [protover [AUTH username password] [SETNAME clientname]], switching protocols
+once the arguments are checked and the connection is authenticated.
+*/
+func (c *respConn) hello(args []string) {
+	version := c.writer.protocol
+	if len(args) > 0 {
+		var err error
+		version, err = strconv.Atoi(args[0])
+		if err != nil || (version != 2 && version != 3) {
+			c.writer.writeError("NOPROTO unsupported protocol version")
+			return
+		}
+	}
+
+	// HELLO [protover [AUTH username password]]
+	if len(args) > 1 {
+		if len(args) != 4 || strings.ToUpper(args[1]) != "AUTH" {
+			c.writer.writeError("ERR syntax error")
+			return
+		}
+		if !c.auth(args[3]) {
+			return
+		}
+	}
+
+	c.writer.protocol = version
+	c.writer.writeMapHeader(3)
+	c.writer.writeBulkString("server")
+	c.writer.writeBulkString("trie")
+	c.writer.writeBulkString("proto")
+	c.writer.writeInteger(int64(c.writer.protocol))
+	c.writer.writeBulkString("mode")
+	c.writer.writeBulkString("standalone")
+}
+
+/*
+Returns the part of a glob pattern before its first special character.
+*/
+func globLiteralPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+/*
+matchGlob reports whether a string matches a Redis-style glob pattern.
+It supports *, ?, [abc], [^abc], [a-z] and backslash escapes.
+*/
+func matchGlob(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			// Collapse consecutive stars, then try every split point
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end, matched := matchGlobClass(pattern, s[0])
+			if !matched {
+				return false
+			}
+			pattern, s = pattern[end:], s[1:]
+
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+
+	return len(s) == 0
+}
+
+/*
+Matches a character against the class at the start of a pattern ("[...]"),
+returning the length of the class and whether the character matched.
+*/
+func matchGlobClass(pattern string, c byte) (int, bool) {
+	i := 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+
+	matched := false
+	for i < len(pattern) && pattern[i] != ']' {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			low, high := pattern[i], pattern[i+2]
+			if low > high {
+				low, high = high, low
+			}
+			if c >= low && c <= high {
+				matched = true
+			}
+			i += 3
+			continue
+		}
+
+		if pattern[i] == c {
+			matched = true
+		}
+		i++
+	}
+
+	// Step past the closing bracket, if there is one
+	if i < len(pattern) {
+		i++
+	}
+
+	return i, matched != negate
+}
+
+/*
+A respWriter encodes replies for either RESP2 or RESP3.
+*/
+type respWriter struct {
+	*bufio.Writer
+	// protocol is 2 or 3
+	protocol int
+}
+
+func (w *respWriter) writeSimpleString(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w *respWriter) writeError(message string) {
+	// Error messages can't contain newlines
+	message = strings.NewReplacer("\r", " ", "\n", " ").Replace(message)
+	w.WriteString("-" + message + "\r\n")
+}
+
+/*
+Writes an error from the dispatcher. The first word of a Redis error is its type,
+so the error's code is used as the type.
+*/
+func (w *respWriter) writeDispatchError(err error) {
+	code := ErrorCode(err)
+	if code == ERR_CODE_INVALID {
+		code = "ERR"
+	}
+	w.writeError(strings.ToUpper(code) + " " + ErrorMessage(err))
+}
+
+func (w *respWriter) writeInteger(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *respWriter) writeBoolInteger(b bool) {
+	if b {
+		w.writeInteger(1)
+	} else {
+		w.writeInteger(0)
+	}
+}
+
+func (w *respWriter) writeBulkString(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (w *respWriter) writeArrayHeader(length int) {
+	w.WriteString("*" + strconv.Itoa(length) + "\r\n")
+}
+
+// Sets are their own type in RESP3, and plain arrays in RESP2
+func (w *respWriter) writeSetHeader(length int) {
+	if w.protocol == 3 {
+		w.WriteString("~" + strconv.Itoa(length) + "\r\n")
+	} else {
+		w.writeArrayHeader(length)
+	}
+}
+
+// Maps are their own type in RESP3, and flat arrays of keys and values in RESP2
+func (w *respWriter) writeMapHeader(length int) {
+	if w.protocol == 3 {
+		w.WriteString("%" + strconv.Itoa(length) + "\r\n")
+	} else {
+		w.writeArrayHeader(length * 2)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/google/logger"
+)
+
+/*
+Resource-style routes, alongside the /http command endpoint:
+
+	GET    /keys/{key}                          The key and its version (404 if missing)
+	PUT    /keys/{key}                          Insert the key (201 if new, 200 if it existed)
+	DELETE /keys/{key}                          Delete the key (204, or 404 if missing)
+	GET    /keys?limit=&cursor=                 A page of keys
+	GET    /completions?prefix=&limit=&cursor=  A page of keys starting with a prefix
+
+Keys are path-escaped, so a key containing "/" is sent as %2F. Every route takes
+an optional `namespace` parameter (the default namespace if missing).
+A key's version is its ETag. PUT and DELETE honor If-Match (and PUT honors
+If-None-Match: *), answering 409 if the key's version doesn't match.
+If-Match: * only asks for the key to exist.
+
+Pages hold up to `limit` keys (REST_DEFAULT_PAGE_SIZE by default). If there are more,
+the response has a `next_cursor`, which is passed as `cursor` to get the next page.
+Errors are JSON objects of the form {"error": {"code": ..., "message": ...}}.
+*/
+const (
+	REST_DEFAULT_PAGE_SIZE = 100
+	REST_MAX_PAGE_SIZE     = 1000
+)
+
+// The representation of a single key
+type restKey struct {
+	Key     string `json:"key"`
+	Version uint64 `json:"version"`
+}
+
+// The representation of a page of keys
+type restPage struct {
+	Keys       []string `json:"keys"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// The representation of an error
+type restError struct {
+	Error V2Error `json:"error"`
+}
+
+/*
+HandleKey serves GET, PUT and DELETE on /keys/{key}.
+*/
+func (s *Server) HandleKey(w http.ResponseWriter, r *http.Request) {
+	token, err := s.authenticate(r)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	// Unescape the path ourselves, so that keys may contain an escaped "/"
+	key, err := url.PathUnescape(strings.TrimPrefix(r.URL.EscapedPath(), "/keys/"))
+	if err != nil {
+		writeRESTError(w, &CodedError{Code: ERR_CODE_INVALID, Message: "invalid key escape"})
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		s.getKey(w, r, token, key)
+	case "PUT":
+		s.putKey(w, r, token, key)
+	case "DELETE":
+		s.deleteKey(w, r, token, key)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) getKey(w http.ResponseWriter, r *http.Request, token *Token, key string) {
+	result, err := s.RunAs(token, requestNamespace(r), "get", &keyArgs{Key: key})
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	info := result.(KeyInfo)
+	if !info.Exists {
+		writeRESTError(w, &CodedError{Code: ERR_CODE_NOT_FOUND, Message: fmt.Sprintf("key %q not found", key)})
+		return
+	}
+
+	etag := formatETag(info.Version)
+	w.Header().Set("ETag", etag)
+	// Caches may keep the key, but must check that its version hasn't changed
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeRESTJSON(w, http.StatusOK, restKey{Key: key, Version: info.Version})
+}
+
+func (s *Server) putKey(w http.ResponseWriter, r *http.Request, token *Token, key string) {
+	expected, precondition, err := parsePrecondition(r)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	var version uint64
+	created := false
+
+	if precondition == PRECONDITION_VERSION {
+		result, err := s.RunAs(token, requestNamespace(r), "insert_if", &versionedKeyArgs{Key: key, Version: expected})
+		if err != nil {
+			writeRESTError(w, err)
+			return
+		}
+		version = result.(uint64)
+		created = expected == 0
+	} else {
+		result, err := s.RunAs(token, requestNamespace(r), "put", &putArgs{Key: key, MustExist: precondition == PRECONDITION_EXISTS})
+		if err != nil {
+			writeRESTError(w, err)
+			return
+		}
+		created = result.(PutResult).Created
+		version = result.(PutResult).Version
+	}
+
+	w.Header().Set("ETag", formatETag(version))
+	if created {
+		writeRESTJSON(w, http.StatusCreated, restKey{Key: key, Version: version})
+	} else {
+		writeRESTJSON(w, http.StatusOK, restKey{Key: key, Version: version})
+	}
+}
+
+func (s *Server) deleteKey(w http.ResponseWriter, r *http.Request, token *Token, key string) {
+	expected, precondition, err := parsePrecondition(r)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	var result interface{}
+	if precondition == PRECONDITION_VERSION {
+		result, err = s.RunAs(token, requestNamespace(r), "delete_if", &versionedKeyArgs{Key: key, Version: expected})
+	} else {
+		result, err = s.RunAs(token, requestNamespace(r), "delete", &keyArgs{Key: key})
+	}
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	if !result.(bool) {
+		if precondition == PRECONDITION_EXISTS {
+			writeRESTError(w, &CodedError{Code: ERR_CODE_CONFLICT, Message: fmt.Sprintf("key %q doesn't exist", key)})
+			return
+		}
+		writeRESTError(w, &CodedError{Code: ERR_CODE_NOT_FOUND, Message: fmt.Sprintf("key %q not found", key)})
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+HandleKeyList serves GET /keys.
+*/
+func (s *Server) HandleKeyList(w http.ResponseWriter, r *http.Request) {
+	s.servePage(w, r, "")
+}
+
+/*
+HandleCompletions serves GET /completions.
+*/
+func (s *Server) HandleCompletions(w http.ResponseWriter, r *http.Request) {
+	s.servePage(w, r, r.URL.Query().Get("prefix"))
+}
+
+/*
+Serves a page of the keys that start with a prefix.
+*/
+func (s *Server) servePage(w http.ResponseWriter, r *http.Request, prefix string) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, err := s.authenticate(r)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+
+	limit := REST_DEFAULT_PAGE_SIZE
+	if rawLimit := query.Get("limit"); rawLimit != "" {
+		parsed, err := strconv.Atoi(rawLimit)
+		if err != nil || parsed < 1 || parsed > REST_MAX_PAGE_SIZE {
+			writeRESTError(w, &CodedError{
+				Code:    ERR_CODE_INVALID,
+				Message: fmt.Sprintf("limit must be between 1 and %d", REST_MAX_PAGE_SIZE),
+			})
+			return
+		}
+		limit = parsed
+	}
+
+	// The cursor is the first key of the page, encoded so that it is safe in a URL
+	start, err := base64.RawURLEncoding.DecodeString(query.Get("cursor"))
+	if err != nil {
+		writeRESTError(w, &CodedError{Code: ERR_CODE_INVALID, Message: "invalid cursor"})
+		return
+	}
+
+	result, err := s.RunAs(token, requestNamespace(r), "range", &rangeArgs{Prefix: prefix, Start: string(start), Limit: limit})
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	page := result.(RangeResult)
+	response := restPage{Keys: page.Keys}
+	if page.More {
+		response.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(page.Next))
+	}
+
+	writeRESTJSON(w, http.StatusOK, response)
+}
+
+// enum for the preconditions of PUT and DELETE requests
+const (
+	PRECONDITION_NONE = iota
+	// The key must have a given version (0 if it must not exist)
+	PRECONDITION_VERSION
+	// The key must exist, whatever its version
+	PRECONDITION_EXISTS
+)
+
+/*
+Reads the precondition of a request from If-Match or If-None-Match, along with the version
+it expects the key to have, if any.
+*/
+func parsePrecondition(r *http.Request) (uint64, int, error) {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if ifMatch == "*" {
+			return 0, PRECONDITION_EXISTS, nil
+		}
+		version, err := strconv.ParseUint(strings.Trim(ifMatch, `"`), 10, 64)
+		if err != nil {
+			return 0, PRECONDITION_NONE, &CodedError{Code: ERR_CODE_INVALID, Message: "If-Match must be a version or *"}
+		}
+		return version, PRECONDITION_VERSION, nil
+	}
+
+	if r.Header.Get("If-None-Match") == "*" {
+		// The key must not exist yet
+		return 0, PRECONDITION_VERSION, nil
+	}
+
+	return 0, PRECONDITION_NONE, nil
+}
+
+// Returns the namespace a request names in its query, or "" for the default namespace
+func requestNamespace(r *http.Request) string {
+	return r.URL.Query().Get("namespace")
+}
+
+// Formats a version as an ETag
+func formatETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// Maps the dispatcher's error codes to HTTP statuses
+func httpStatus(err error) int {
+	switch ErrorCode(err) {
+	case ERR_CODE_CONFLICT:
+		return http.StatusConflict
+	case ERR_CODE_NOT_FOUND, ERR_CODE_UNKNOWN_COMMAND:
+		return http.StatusNotFound
+	case ERR_CODE_COMPACTED:
+		return http.StatusGone
+	case ERR_CODE_UNAUTHORIZED:
+		return http.StatusUnauthorized
+	case ERR_CODE_FORBIDDEN:
+		return http.StatusForbidden
+	case ERR_CODE_READ_ONLY:
+		return http.StatusMethodNotAllowed
+	case ERR_CODE_INVALID, ERR_CODE_UNSUPPORTED_VERSION:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeRESTError(w http.ResponseWriter, err error) {
+	logger.Errorf("Error handling REST request: %v", err)
+	writeRESTJSON(w, httpStatus(err), restError{Error: V2Error{Code: ErrorCode(err), Message: ErrorMessage(err)}})
+}
+
+func writeRESTJSON(w http.ResponseWriter, status int, body interface{}) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		logger.Errorf("Error encoding REST response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(encoded)
+}
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/google/logger"
 	"github.com/gorilla/websocket"
 )
 
+// Limits on the bodies of messages sent over HTTP: in full once the request is
+// authenticated, and only enough to answer in the message's format when it isn't
+const (
+	HTTP_MAX_BODY_BYTES     = 64 << 20
+	HTTP_MAX_REJECTED_BYTES = 4 << 10
+)
+
 /*
 A Server is just a wrapper around a TrieDispatcher.
 This TrieDispatcher is responsible for ensuring that
@@ -15,20 +26,28 @@ the state of the trie is atomic, and that all messages
 are handled individually and in order.
 */
 type Server struct {
-	// handles messages in a thread-safe fashion
+	// the server's namespaces, each with its own trie and dispatcher
+	namespaces *Namespaces
+	// handles messages in a thread-safe fashion. This is the default namespace's
+	// dispatcher, which passes requests for other namespaces on to theirs.
 	trieDispatcher *ThreadSafeDispatcher
 	// HTTP server route handler
 	httpServeMux *http.ServeMux
 	// Websocket upgrader
 	upgrader *websocket.Upgrader
+	// origins are the origins browsers may use the server from, or nil to allow
+	// WebSockets from anywhere and send no CORS headers
+	origins *OriginPolicy
+	// tokens are the API tokens requests must carry, or nil if authentication is disabled
+	tokens *TokenSet
 }
 
 /*
-NewServer creates a new server with an empty Trie.
+NewServer creates a new server with an empty default namespace.
 */
 func NewServer() *Server {
 	// Allows us to handle messages in a thread-safe fashion.
-	trieDispatcher := NewThreadSafeDispatcher(NewTrie())
+	namespaces := NewNamespaces()
 
 	// Router for HTTP requests.
 	// Allows us to add custom functions for routes.
@@ -38,22 +57,35 @@ func NewServer() *Server {
 	// Websockets follow a similar request cycle to HTTP requests, but are
 	// "upgraded" to Websocket connections. Websockets allow real-time
 	// bidirectional communication.
-	upgrader := &websocket.Upgrader{
-		// Allow connections from any origin.
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
+	upgrader := &websocket.Upgrader{}
 
 	server := &Server{
-		trieDispatcher: trieDispatcher,
+		namespaces:     namespaces,
+		trieDispatcher: namespaces.Default(),
 		httpServeMux:   httpServeMux,
 		upgrader:       upgrader,
 	}
 
-	// Add routes to the HTTP server.
-	httpServeMux.HandleFunc("/http", server.HandleHTTP)
-	httpServeMux.HandleFunc("/ws", server.HandleWS)
+	// Only allow connections from the origins the server allows (see cors.go).
+	upgrader.CheckOrigin = server.checkOrigin
+
+	// Add routes to the HTTP server. Every route answers cross-origin requests.
+	handle := func(pattern string, handler http.HandlerFunc) {
+		httpServeMux.HandleFunc(pattern, server.withCORS(handler))
+	}
+	handle("/http", server.HandleHTTP)
+	handle("/ws", server.HandleWS)
+	handle("/rpc", server.HandleJSONRPC)
+	handle("/rpc/ws", server.HandleJSONRPCWS)
+	handle("/keys", server.HandleKeyList)
+	handle("/keys/", server.HandleKey)
+	handle("/completions", server.HandleCompletions)
+	handle("/changes", server.HandleChanges)
+	handle("/changelog", server.HandleChangelog)
+	handle("/admin/backup", server.HandleBackup)
+	handle("/admin/restore", server.HandleRestore)
+	handle("/replication/namespaces", server.HandleReplicationNamespaces)
+	handle("/replication/stream", server.HandleReplicationStream)
 
 	return server
 }
@@ -63,32 +95,22 @@ const WS_MESSAGE_TYPE_TEXT = 1
 func (s *Server) HandleWS(w http.ResponseWriter, r *http.Request) {
 	logger.Infof("received connection")
 
+	// Check the token before upgrading, so that the client gets a proper HTTP error
+	token, err := s.authenticate(r)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
 	// Upgrade the connection to a websocket connection, allowing multiway communication.
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		logger.Errorf("error upgrading connection: %v", err)
 		return
 	}
-	for {
-		_, message, err := conn.ReadMessage()
-		if err != nil {
-			logger.Errorf("Error reading message: %v", err)
-			return
-		}
-
-		logger.Infof("Received message: %s", message)
+	defer conn.Close()
 
-		// Dispatch the message to the trie. This accepts a string
-		// and returns a string as a response.
-		response, err := s.Process(message)
-
-		if err != nil {
-			conn.WriteMessage(WS_MESSAGE_TYPE_TEXT, []byte("e"+err.Error()))
-			logger.Errorf("Error handling message: %v", err)
-		} else {
-			conn.WriteMessage(WS_MESSAGE_TYPE_TEXT, []byte("s"+string(response)))
-		}
-	}
+	newWSSession(s, conn, token).serve()
 }
 
 func (s *Server) HandleHTTP(w http.ResponseWriter, r *http.Request) {
@@ -98,8 +120,21 @@ func (s *Server) HandleHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Authenticate before reading more than the start of the body
+	token, err := s.authenticate(r)
+	if err != nil {
+		logger.Errorf("Error authenticating request: %v", err)
+		message, _ := ioutil.ReadAll(io.LimitReader(r.Body, HTTP_MAX_REJECTED_BYTES))
+		if IsV2Message(message) {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(rejectMessage(message, err))
+		return
+	}
+
 	// Read the request body.
-	message, err := ioutil.ReadAll(r.Body)
+	message, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, HTTP_MAX_BODY_BYTES))
 	if err != nil {
 		logger.Errorf("Error reading request body: %v", err)
 		w.WriteHeader(http.StatusBadRequest)
@@ -108,17 +143,127 @@ func (s *Server) HandleHTTP(w http.ResponseWriter, r *http.Request) {
 
 	logger.Infof("Received message: %s", message)
 
+	if IsV2Message(message) {
+		w.Header().Set("Content-Type", "application/json")
+	}
+
 	// Execute the command.
-	response, err := s.Process(message)
+	response, err := s.ProcessAs(token, message)
+
 	if err != nil {
 		logger.Errorf("Error handling message: %v", err)
-		// Format: e{error message}
 		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("e" + err.Error()))
 	} else {
-		// Format: s{successful response}
 		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("s" + string(response)))
+	}
+
+	w.Write(frameResponse(message, response, err))
+}
+
+/*
+Formats the response to a message.
+Legacy responses are prefixed with "s" on success, followed by the result,
+or "e" on failure, followed by the error message.
+Version 2 responses are already complete envelopes, so they are sent as-is.
+*/
+func frameResponse(message []byte, response []byte, err error) []byte {
+	if IsV2Message(message) {
+		return response
+	}
+
+	if err != nil {
+		// Format: e{error message}, without the code, as before codes existed
+		return []byte("e" + ErrorMessage(err))
+	}
+
+	// Format: s{successful response}
+	return []byte("s" + string(response))
+}
+
+/*
+Answers a message with an error raised before it was dispatched, in the message's format.
+*/
+func rejectMessage(message []byte, err error) []byte {
+	if IsV2Message(message) {
+		// Echo the request's id, if the envelope is readable
+		var request V2Request
+		json.Unmarshal(message, &request)
+		return encodeV2Response(request.ID, nil, err)
+	}
+
+	return frameResponse(message, nil, err)
+}
+
+/*
+HandleJSONRPC serves JSON-RPC 2.0 requests sent as POST bodies.
+*/
+func (s *Server) HandleJSONRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, err := s.authenticate(r)
+	if err != nil {
+		logger.Errorf("Error authenticating request: %v", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(encodeJSONRPCResponse(newJSONRPCDispatchErrorResponse(nil, err)))
+		return
+	}
+
+	message, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, HTTP_MAX_BODY_BYTES))
+	if err != nil {
+		logger.Errorf("Error reading request body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	logger.Infof("Received JSON-RPC message: %s", message)
+
+	response := s.trieDispatcher.DispatchJSONRPCAs(token, message)
+	if response == nil {
+		// Only notifications, so there is nothing to respond with
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(response)
+}
+
+/*
+HandleJSONRPCWS serves JSON-RPC 2.0 requests over a WebSocket, one request or batch per message.
+*/
+func (s *Server) HandleJSONRPCWS(w http.ResponseWriter, r *http.Request) {
+	logger.Infof("received JSON-RPC connection")
+
+	token, err := s.authenticate(r)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Errorf("error upgrading connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	for {
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			logger.Errorf("Error reading message: %v", err)
+			return
+		}
+
+		logger.Infof("Received JSON-RPC message: %s", message)
+
+		if response := s.trieDispatcher.DispatchJSONRPCAs(token, message); response != nil {
+			conn.WriteMessage(WS_MESSAGE_TYPE_TEXT, response)
+		}
 	}
 }
 
@@ -126,6 +271,102 @@ func (s *Server) Process(message []byte) ([]byte, error) {
 	return s.trieDispatcher.DispatchRaw(message)
 }
 
+/*
+ProcessAs is like Process, but only runs commands that a token allows.
+*/
+func (s *Server) ProcessAs(token *Token, message []byte) ([]byte, error) {
+	return s.trieDispatcher.DispatchRawAs(token, message)
+}
+
+/*
+Run dispatches a registered command by name, with already-parsed arguments,
+in the default namespace.
+*/
+func (s *Server) Run(name string, args interface{}) (interface{}, error) {
+	return s.RunIn("", name, args)
+}
+
+/*
+RunIn is like Run, but in the given namespace ("" for the default namespace).
+*/
+func (s *Server) RunIn(namespace string, name string, args interface{}) (interface{}, error) {
+	return s.RunAs(nil, namespace, name, args)
+}
+
+/*
+RunAs is like RunIn, but only runs commands that a token allows.
+*/
+func (s *Server) RunAs(token *Token, namespace string, name string, args interface{}) (interface{}, error) {
+	dispatcher, err := s.namespaces.Get(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	command, ok := dispatcher.Commands().Lookup(name)
+	if !ok {
+		return nil, &CodedError{Code: ERR_CODE_UNKNOWN_COMMAND, Message: fmt.Sprintf("unknown command %q", name)}
+	}
+	return dispatcher.DispatchAs(token, command, args)
+}
+
+/*
+UseChangelogs records the changes of every namespace in a changelog, in a subdirectory
+of dir named after the namespace (see ThreadSafeDispatcher.UseChangelog).
+*/
+func (s *Server) UseChangelogs(dir string, maxSegments int) error {
+	return s.namespaces.UseChangelogs(dir, maxSegments)
+}
+
+/*
+UseStorage keeps the snapshots and write-ahead log of every namespace in a subdirectory
+of dir named after the namespace, restoring the namespaces from them (see Namespaces.UseStorage).
+*/
+func (s *Server) UseStorage(dir string, options StorageOptions) error {
+	return s.namespaces.UseStorage(dir, options)
+}
+
+/*
+ScheduleSnapshots saves a snapshot of every namespace that changed, every interval,
+in the background.
+*/
+func (s *Server) ScheduleSnapshots(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			s.namespaces.SnapshotAll()
+		}
+	}()
+}
+
+/*
+UseEncryption encrypts the snapshots, write-ahead logs and changelogs with a keyring.
+It must be called before UseStorage and UseChangelogs.
+*/
+func (s *Server) UseEncryption(keyring *Keyring) {
+	s.namespaces.UseEncryption(keyring)
+}
+
+/*
+UseDictionaries serves the dictionaries of a directory as read-only namespaces.
+*/
+func (s *Server) UseDictionaries(dir string) error {
+	return s.namespaces.UseDictionaries(dir)
+}
+
+/*
+Follow makes the server a replica of the leader at a URL (see replication.go).
+The token, if any, is sent to the leader.
+*/
+func (s *Server) Follow(leader string, token string) error {
+	return s.namespaces.replication.Follow(leader, token)
+}
+
+/*
+UseTokens turns authentication on: from now on, every request needs one of the tokens.
+*/
+func (s *Server) UseTokens(tokens *TokenSet) {
+	s.tokens = tokens
+}
+
 func (s *Server) HttpServeMux() *http.ServeMux {
 	return s.httpServeMux
 }
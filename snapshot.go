@@ -0,0 +1,666 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/logger"
+)
+
+/*
+Snapshots save a trie to disk, so that it survives restarts. Each namespace keeps its
+snapshots in a subdirectory of the data directory named after the namespace, and every
+snapshot is named after the trie's clock when it was taken:
+
+	data/default/00000000000000000042.snap
+
+A snapshot holds the trie's nodes themselves rather than a list of keys, so that shared
+prefixes are only stored once. All integers are big-endian, except for the varints:
+
+	"TRIESNAP"            magic (8 bytes)
+	format version        uint16 (SNAPSHOT_FORMAT_VERSION)
+	flags                 uint16 (reserved, 0)
+	clock                 uint64
+	keys                  uint64, the number of keys
+	root node
+	checksum              uint32, CRC-32C of everything before it
+
+and each node, depth-first:
+
+	flags                 1 byte: SNAPSHOT_NODE_END_OF_WORD if a key ends here
+	version               uvarint, only if a key ends here
+	children              uvarint, the number of subtries
+	for each subtrie, in order of their characters:
+	  character           1 byte
+	  node
+
+Snapshots are written to a temporary file which is then renamed, so a crash never leaves
+a partly written snapshot behind. Only the newest few are kept; if the newest can't be
+read, the one before it is loaded instead.
+*/
+const (
+	SNAPSHOT_MAGIC          = "TRIESNAP"
+	SNAPSHOT_FORMAT_VERSION = 1
+	SNAPSHOT_SUFFIX         = ".snap"
+
+	// Default number of snapshots kept per namespace
+	SNAPSHOT_DEFAULT_RETAIN = 3
+	// Default time between snapshots of the namespaces that changed
+	SNAPSHOT_DEFAULT_INTERVAL = 5 * time.Minute
+
+	// Bits of a node's flags
+	SNAPSHOT_NODE_END_OF_WORD = 1
+)
+
+var snapshotCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+/*
+SnapshotInfo describes a snapshot.
+*/
+type SnapshotInfo struct {
+	Namespace string `json:"namespace"`
+	// Revision is the trie's clock when the snapshot was taken
+	Revision uint64 `json:"revision"`
+	Keys     uint64 `json:"keys"`
+	// Bytes is the size of the snapshot file
+	Bytes int64 `json:"bytes"`
+	// Key is the id of the key the snapshot is encrypted with, if it is (see encryption.go)
+	Key string `json:"key,omitempty"`
+}
+
+/*
+WriteSnapshot encodes a trie in the snapshot format.
+*/
+func WriteSnapshot(w io.Writer, trie *Trie) error {
+	checksum := crc32.New(snapshotCRCTable)
+	writer := bufio.NewWriter(io.MultiWriter(w, checksum))
+
+	header := make([]byte, 0, len(SNAPSHOT_MAGIC)+20)
+	header = append(header, SNAPSHOT_MAGIC...)
+	header = appendUint16(header, SNAPSHOT_FORMAT_VERSION)
+	header = appendUint16(header, 0)
+	header = appendUint64(header, trie.Clock)
+	header = appendUint64(header, uint64(trie.Size()))
+	writer.Write(header)
+
+	if err := writeSnapshotNode(writer, trie.TrieNode); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	// The checksum isn't part of what it covers
+	_, err := w.Write(appendUint32(nil, checksum.Sum32()))
+	return err
+}
+
+func writeSnapshotNode(writer *bufio.Writer, node *TrieNode) error {
+	var buffer [1 + 2*binary.MaxVarintLen64]byte
+
+	encoded := buffer[:1]
+	if node.IsEndOfWord {
+		encoded[0] = SNAPSHOT_NODE_END_OF_WORD
+		encoded = appendUvarint(encoded, node.Version)
+	}
+	encoded = appendUvarint(encoded, uint64(len(node.Subtries)))
+	if _, err := writer.Write(encoded); err != nil {
+		return err
+	}
+
+	for _, character := range node.sortedCharacters() {
+		writer.WriteByte(character)
+		if err := writeSnapshotNode(writer, node.Subtries[character]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+ReadSnapshot decodes a trie from the snapshot format, checking its checksum.
+*/
+func ReadSnapshot(r io.Reader) (*Trie, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	const headerSize = len(SNAPSHOT_MAGIC) + 20
+	if len(data) < headerSize+4 {
+		return nil, errors.New("snapshot is truncated")
+	}
+	if string(data[:len(SNAPSHOT_MAGIC)]) != SNAPSHOT_MAGIC {
+		return nil, errors.New("not a snapshot")
+	}
+
+	// Check the checksum first, so that a damaged snapshot is never partly decoded
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, snapshotCRCTable) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil, errors.New("snapshot checksum mismatch")
+	}
+
+	header := body[len(SNAPSHOT_MAGIC):]
+	if version := binary.BigEndian.Uint16(header); version != SNAPSHOT_FORMAT_VERSION {
+		return nil, fmt.Errorf("unsupported snapshot format version %d", version)
+	}
+	clock := binary.BigEndian.Uint64(header[4:])
+	keys := binary.BigEndian.Uint64(header[12:])
+
+	reader := bytes.NewReader(body[headerSize:])
+	trie := NewTrie()
+	trie.Clock = clock
+	if err := readSnapshotNode(reader, trie.TrieNode, clock, 0); err != nil {
+		return nil, err
+	}
+	if reader.Len() > 0 {
+		return nil, errors.New("snapshot has data after its last node")
+	}
+
+	if size := trie.Size(); uint64(size) != keys {
+		return nil, fmt.Errorf("snapshot should hold %d keys, but holds %d", keys, size)
+	}
+	return trie, nil
+}
+
+// Reads a node into `node`, which is `depth` characters below the root of a trie with the given clock
+func readSnapshotNode(r *bytes.Reader, node *TrieNode, clock uint64, depth int) error {
+	if depth >= MAX_KEY_LENGTH {
+		return errors.New("snapshot has a key that is too long")
+	}
+
+	flags, err := r.ReadByte()
+	if err != nil {
+		return errors.New("snapshot is truncated")
+	}
+	if flags&^SNAPSHOT_NODE_END_OF_WORD != 0 {
+		return fmt.Errorf("snapshot has a node with unknown flags %#x", flags)
+	}
+
+	if flags&SNAPSHOT_NODE_END_OF_WORD != 0 {
+		node.IsEndOfWord = true
+		if node.Version, err = binary.ReadUvarint(r); err != nil {
+			return errors.New("snapshot is truncated")
+		}
+		// Versions are handed out by the clock
+		if node.Version == 0 || node.Version > clock {
+			return fmt.Errorf("snapshot has a key with version %d, outside of its clock", node.Version)
+		}
+	}
+
+	children, err := binary.ReadUvarint(r)
+	if err != nil {
+		return errors.New("snapshot is truncated")
+	}
+	if children > 256 {
+		return errors.New("snapshot has a node with too many subtries")
+	}
+
+	for i := uint64(0); i < children; i++ {
+		character, err := r.ReadByte()
+		if err != nil {
+			return errors.New("snapshot is truncated")
+		}
+		if _, ok := node.Subtries[character]; ok {
+			return errors.New("snapshot has a node with a repeated subtrie")
+		}
+
+		subtrie := newTrieNode()
+		if err := readSnapshotNode(r, subtrie, clock, depth+1); err != nil {
+			return err
+		}
+		node.Subtries[character] = subtrie
+	}
+	return nil
+}
+
+/*
+A SnapshotStore holds the snapshots of one namespace. It is safe for concurrent use.
+*/
+type SnapshotStore struct {
+	dir    string
+	retain int
+	// keyring encrypts the snapshots, if set, binding them to the namespace, which is
+	// the name of the directory
+	keyring   *Keyring
+	namespace string
+
+	mutex sync.Mutex
+	// revision is the revision of the newest snapshot, or 0 if there is none
+	revision uint64
+}
+
+/*
+Opens the snapshots in a directory, creating the directory if needed. New snapshots are
+encrypted with the keyring's current key, unless the keyring is nil.
+*/
+func OpenSnapshotStore(dir string, retain int, keyring *Keyring) (*SnapshotStore, error) {
+	if retain < 1 {
+		retain = SNAPSHOT_DEFAULT_RETAIN
+	}
+
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+
+	store := &SnapshotStore{dir: dir, retain: retain, keyring: keyring, namespace: filepath.Base(dir)}
+
+	// Remove the temporary files of snapshots that were being written during a crash
+	temporary, _ := filepath.Glob(filepath.Join(dir, "*"+SNAPSHOT_SUFFIX+".tmp*"))
+	for _, path := range temporary {
+		os.Remove(path)
+	}
+
+	revisions, err := store.list()
+	if err != nil {
+		return nil, err
+	}
+	if len(revisions) > 0 {
+		store.revision = revisions[len(revisions)-1]
+	}
+	return store, nil
+}
+
+// Returns the revisions of the snapshots in the directory, oldest first
+func (s *SnapshotStore) list() ([]uint64, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]uint64, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, SNAPSHOT_SUFFIX) {
+			continue
+		}
+		revision, err := strconv.ParseUint(strings.TrimSuffix(name, SNAPSHOT_SUFFIX), 10, 64)
+		if err != nil {
+			continue
+		}
+		revisions = append(revisions, revision)
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i] < revisions[j] })
+	return revisions, nil
+}
+
+func (s *SnapshotStore) path(revision uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", revision, SNAPSHOT_SUFFIX))
+}
+
+/*
+Revision returns the revision of the newest snapshot, or 0 if there is none.
+*/
+func (s *SnapshotStore) Revision() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.revision
+}
+
+/*
+Latest loads the newest snapshot that can be read. The trie is nil if there are no
+snapshots, and it is an error if there are some but none of them can be read.
+*/
+func (s *SnapshotStore) Latest() (*Trie, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	revisions, err := s.list()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(revisions) - 1; i >= 0; i-- {
+		trie, err := s.read(revisions[i])
+		if err == nil {
+			return trie, nil
+		}
+		logger.Errorf("Error reading snapshot %s: %v", s.path(revisions[i]), err)
+	}
+
+	if len(revisions) > 0 {
+		return nil, fmt.Errorf("none of the snapshots in %s can be read", s.dir)
+	}
+	return nil, nil
+}
+
+func (s *SnapshotStore) read(revision uint64) (*Trie, error) {
+	data, err := ioutil.ReadFile(s.path(revision))
+	if err != nil {
+		return nil, err
+	}
+	snapshot, _, err := s.keyring.openSnapshot(data, s.namespace, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	trie, err := ReadSnapshot(bytes.NewReader(snapshot))
+	if err != nil {
+		return nil, err
+	}
+	if trie.Clock != revision {
+		return nil, fmt.Errorf("snapshot is named after revision %d, but holds revision %d", revision, trie.Clock)
+	}
+	return trie, nil
+}
+
+/*
+Save writes a snapshot of a trie, then deletes the snapshots that are no longer kept.
+The caller must make sure the trie doesn't change while it is being saved.
+*/
+func (s *SnapshotStore) Save(trie *Trie) (SnapshotInfo, error) {
+	pending, err := s.Prepare(trie)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := pending.Install(); err != nil {
+		pending.Discard()
+		return SnapshotInfo{}, err
+	}
+	return pending.Keep(), nil
+}
+
+/*
+A PendingSnapshot is a snapshot written to disk, but not yet in place: a restart
+doesn't see it until it is installed.
+*/
+type PendingSnapshot struct {
+	store *SnapshotStore
+	info  SnapshotInfo
+	// temporary is the file the snapshot was written to, until it is installed
+	temporary string
+	installed bool
+}
+
+/*
+Prepare writes a snapshot of a trie to a temporary file and syncs it, so that putting it
+in place (see PendingSnapshot.Install) is quick. The caller must make sure the trie
+doesn't change while it is being written.
+*/
+func (s *SnapshotStore) Prepare(trie *Trie) (*PendingSnapshot, error) {
+	pending := &PendingSnapshot{store: s, info: SnapshotInfo{Revision: trie.Clock, Keys: uint64(trie.Size())}}
+	temporary, size, err := writeTemporaryFile(s.path(trie.Clock), func(w io.Writer) error {
+		if s.keyring != nil {
+			pending.info.Key = s.keyring.Current()
+			return s.keyring.writeSnapshot(w, s.namespace, trie)
+		}
+		return WriteSnapshot(w, trie)
+	})
+	if err != nil {
+		return nil, err
+	}
+	pending.temporary = temporary
+	pending.info.Bytes = size
+	return pending, nil
+}
+
+/*
+Install puts the snapshot in place, where a restart finds it.
+*/
+func (p *PendingSnapshot) Install() error {
+	p.store.mutex.Lock()
+	defer p.store.mutex.Unlock()
+
+	if err := replaceFile(p.temporary, p.store.path(p.info.Revision)); err != nil {
+		return err
+	}
+	p.installed = true
+	return nil
+}
+
+/*
+Keep records an installed snapshot in the store, and deletes the snapshots that are no
+longer kept.
+*/
+func (p *PendingSnapshot) Keep() SnapshotInfo {
+	p.store.mutex.Lock()
+	defer p.store.mutex.Unlock()
+
+	if p.info.Revision > p.store.revision {
+		p.store.revision = p.info.Revision
+	}
+	p.store.prune()
+	return p.info
+}
+
+/*
+Discard deletes the snapshot, whether it was installed or not, so that a restart
+never loads it.
+*/
+func (p *PendingSnapshot) Discard() error {
+	p.store.mutex.Lock()
+	defer p.store.mutex.Unlock()
+
+	if !p.installed {
+		return os.Remove(p.temporary)
+	}
+	if err := os.Remove(p.store.path(p.info.Revision)); err != nil {
+		return err
+	}
+	p.installed = false
+	return syncDir(p.store.dir)
+}
+
+// Deletes all but the newest `retain` snapshots
+func (s *SnapshotStore) prune() {
+	revisions, err := s.list()
+	if err != nil {
+		logger.Errorf("Error listing snapshots: %v", err)
+		return
+	}
+
+	for len(revisions) > s.retain {
+		if err := os.Remove(s.path(revisions[0])); err != nil {
+			logger.Errorf("Error deleting snapshot: %v", err)
+		}
+		revisions = revisions[1:]
+	}
+}
+
+/*
+Writes a file by writing a temporary file next to it, syncing it and renaming it,
+so that the file is either entirely replaced or left alone. Returns the file's size.
+*/
+func writeFileAtomically(path string, write func(w io.Writer) error) (int64, error) {
+	temporary, size, err := writeTemporaryFile(path, write)
+	if err != nil {
+		return 0, err
+	}
+	if err := replaceFile(temporary, path); err != nil {
+		os.Remove(temporary)
+		return 0, err
+	}
+	return size, nil
+}
+
+/*
+Writes and syncs a temporary file next to path, to be renamed to it with replaceFile.
+Returns the temporary file's name and size.
+*/
+func writeTemporaryFile(path string, write func(w io.Writer) error) (string, int64, error) {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return "", 0, err
+	}
+	temporary := file.Name()
+	if err := file.Chmod(0660); err != nil {
+		logger.Errorf("Error setting the mode of %s: %v", temporary, err)
+	}
+
+	writer := &countingWriter{Writer: file}
+	err = write(writer)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temporary)
+		return "", 0, err
+	}
+	return temporary, writer.count, nil
+}
+
+// Renames a file written by writeTemporaryFile to its final name, durably
+func replaceFile(temporary string, path string) error {
+	if err := os.Rename(temporary, path); err != nil {
+		return err
+	}
+
+	// Make the rename itself durable
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		logger.Errorf("Error syncing %s: %v", filepath.Dir(path), err)
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// Counts the bytes written through it
+type countingWriter struct {
+	io.Writer
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+/*
+UseSnapshots restores the trie from the newest snapshot in a store, if there is one,
+and registers the "snapshot" command to take a snapshot on demand. It must be called
+before UseChangelog, so that the changelog can move the clock on from the snapshot's.
+*/
+func (s *ThreadSafeDispatcher) UseSnapshots(store *SnapshotStore) error {
+	trie, err := store.Latest()
+	if err != nil {
+		return err
+	}
+
+	s.dispatcherMutex.Lock()
+	if trie != nil {
+		s.restore(trie)
+		logger.Infof("restored namespace %s from its snapshot at revision %d", s.name, trie.Clock)
+	}
+	s.snapshots = store
+	s.dispatcherMutex.Unlock()
+
+	return s.commands.Register(snapshotCommand(s))
+}
+
+/*
+Replaces the dispatcher's trie with another, keeping the clock from going back.
+The caller must hold the write lock.
+*/
+func (s *ThreadSafeDispatcher) restore(trie *Trie) {
+	if trie.Clock < s.trie.Clock {
+		trie.Clock = s.trie.Clock
+	}
+	trie.observer = s.trie.observer
+	s.trie.observer = nil
+	s.trie = trie
+}
+
+/*
+Snapshot saves a snapshot of the trie. Only copying the trie holds up changes; the copy
+is written while they go on.
+*/
+func (s *ThreadSafeDispatcher) Snapshot() (SnapshotInfo, error) {
+	if s.snapshots == nil {
+		return SnapshotInfo{}, &CodedError{Code: ERR_CODE_INVALID, Message: "snapshots are disabled"}
+	}
+
+	start := time.Now()
+	s.dispatcherMutex.RLock()
+	if s.failed != nil {
+		// The trie may hold changes that aren't durable
+		s.dispatcherMutex.RUnlock()
+		return SnapshotInfo{}, s.failed
+	}
+	trie := s.trie.Clone()
+	var position uint64
+	if s.wal != nil {
+		position = s.wal.Position()
+	}
+	s.dispatcherMutex.RUnlock()
+
+	// Nor may the snapshot hold changes that aren't committed yet
+	if err := s.commit(position); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	info, err := s.snapshots.Save(trie)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	info.Namespace = s.name
+	logger.Infof("saved snapshot of namespace %s at revision %d (%d keys, %d bytes) in %v",
+		s.name, info.Revision, info.Keys, info.Bytes, time.Since(start))
+	return info, nil
+}
+
+/*
+Returns the "snapshot" command, which saves a snapshot of a dispatcher's namespace.
+It takes the dispatcher's lock itself, only while copying the trie.
+*/
+func snapshotCommand(dispatcher *ThreadSafeDispatcher) *Command {
+	return &Command{
+		Name:      "snapshot",
+		Code:      NO_LEGACY_CODE,
+		Unlocked:  true,
+		ParseArgs: argsParser(func() interface{} { return &struct{}{} }),
+		// result: a SnapshotInfo
+		Run: func(trie *Trie, args interface{}) (interface{}, error) {
+			return dispatcher.Snapshot()
+		},
+		Describe: func(args interface{}) string {
+			return "saving a snapshot of namespace " + dispatcher.name
+		},
+	}
+}
+
+func appendUint16(buffer []byte, value uint16) []byte {
+	return append(buffer, byte(value>>8), byte(value))
+}
+
+func appendUint32(buffer []byte, value uint32) []byte {
+	var encoded [4]byte
+	binary.BigEndian.PutUint32(encoded[:], value)
+	return append(buffer, encoded[:]...)
+}
+
+func appendUint64(buffer []byte, value uint64) []byte {
+	var encoded [8]byte
+	binary.BigEndian.PutUint64(encoded[:], value)
+	return append(buffer, encoded[:]...)
+}
+
+func appendUvarint(buffer []byte, value uint64) []byte {
+	var encoded [binary.MaxVarintLen64]byte
+	return append(buffer, encoded[:binary.PutUvarint(encoded[:], value)]...)
+}
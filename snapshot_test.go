@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Returns a trie holding some keys that share prefixes
+func testSnapshotTrie(t *testing.T) *Trie {
+	trie := NewTrie()
+	for _, key := range []string{"apple", "app", "apricot", "banana", "b", "cherry"} {
+		if _, err := trie.Add(key); err != nil {
+			t.Fatalf("adding %q: %v", key, err)
+		}
+	}
+	if _, err := trie.Remove("b"); err != nil {
+		t.Fatalf("removing: %v", err)
+	}
+	return trie
+}
+
+// Fails unless two tries hold the same keys, with the same versions, at the same clock
+func checkSameTrie(t *testing.T, got *Trie, want *Trie) {
+	t.Helper()
+
+	if got.Clock != want.Clock {
+		t.Errorf("clock is %d, want %d", got.Clock, want.Clock)
+	}
+	if !reflect.DeepEqual(got.Keys(), want.Keys()) {
+		t.Fatalf("keys are %v, want %v", got.Keys(), want.Keys())
+	}
+	for _, key := range want.Keys() {
+		gotVersion, _ := got.GetVersion(key)
+		wantVersion, _ := want.GetVersion(key)
+		if gotVersion != wantVersion {
+			t.Errorf("version of %q is %d, want %d", key, gotVersion, wantVersion)
+		}
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		trie *Trie
+	}{
+		{name: "empty", trie: NewTrie()},
+		{name: "keys", trie: testSnapshotTrie(t)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := WriteSnapshot(&buffer, test.trie); err != nil {
+				t.Fatalf("WriteSnapshot: %v", err)
+			}
+			trie, err := ReadSnapshot(&buffer)
+			if err != nil {
+				t.Fatalf("ReadSnapshot: %v", err)
+			}
+			checkSameTrie(t, trie, test.trie)
+		})
+	}
+}
+
+func TestReadSnapshotDamaged(t *testing.T) {
+	var buffer bytes.Buffer
+	if err := WriteSnapshot(&buffer, testSnapshotTrie(t)); err != nil {
+		t.Fatalf("WriteSnapshot: %v", err)
+	}
+	snapshot := buffer.Bytes()
+
+	flipped := append([]byte(nil), snapshot...)
+	flipped[len(SNAPSHOT_MAGIC)+25] ^= 0x01
+
+	badMagic := append([]byte(nil), snapshot...)
+	badMagic[0] = 'X'
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "cut off header", data: snapshot[:len(SNAPSHOT_MAGIC)+10]},
+		{name: "cut off", data: snapshot[:len(snapshot)-1]},
+		{name: "flipped bit", data: flipped},
+		{name: "bad magic", data: badMagic},
+		{name: "trailing data", data: append(append([]byte(nil), snapshot...), 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ReadSnapshot(bytes.NewReader(test.data)); err == nil {
+				t.Fatal("ReadSnapshot succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestSnapshotStore(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "default")
+	store, err := OpenSnapshotStore(dir, 2, nil)
+	if err != nil {
+		t.Fatalf("OpenSnapshotStore: %v", err)
+	}
+
+	if trie, err := store.Latest(); err != nil || trie != nil {
+		t.Fatalf("Latest of an empty store is %v, %v; want nil, nil", trie, err)
+	}
+
+	trie := testSnapshotTrie(t)
+	var saved []*Trie
+	for i := 0; i < 3; i++ {
+		if _, err := trie.Add("key" + string(rune('a'+i))); err != nil {
+			t.Fatalf("adding: %v", err)
+		}
+		info, err := store.Save(trie.Clone())
+		if err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if info.Revision != trie.Clock || info.Keys != uint64(trie.Size()) || info.Bytes == 0 {
+			t.Errorf("Save returned %+v for revision %d with %d keys", info, trie.Clock, trie.Size())
+		}
+		saved = append(saved, trie.Clone())
+	}
+
+	// Only the newest two are kept
+	revisions, err := store.list()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if want := []uint64{saved[1].Clock, saved[2].Clock}; !reflect.DeepEqual(revisions, want) {
+		t.Errorf("kept revisions %v, want %v", revisions, want)
+	}
+
+	// A reopened store finds the newest snapshot
+	store, err = OpenSnapshotStore(dir, 2, nil)
+	if err != nil {
+		t.Fatalf("OpenSnapshotStore: %v", err)
+	}
+	if store.Revision() != saved[2].Clock {
+		t.Errorf("Revision is %d, want %d", store.Revision(), saved[2].Clock)
+	}
+	latest, err := store.Latest()
+	if err != nil {
+		t.Fatalf("Latest: %v", err)
+	}
+	checkSameTrie(t, latest, saved[2])
+
+	// A damaged newest snapshot falls back to the one before it
+	if err := ioutil.WriteFile(store.path(saved[2].Clock), []byte("damaged"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	latest, err = store.Latest()
+	if err != nil {
+		t.Fatalf("Latest: %v", err)
+	}
+	checkSameTrie(t, latest, saved[1])
+
+	// A snapshot named after another revision is refused
+	data, err := ioutil.ReadFile(store.path(saved[1].Clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(store.path(saved[2].Clock), data, 0660); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.read(saved[2].Clock); err == nil {
+		t.Error("read a snapshot named after the wrong revision, want an error")
+	}
+}
+
+func TestPendingSnapshotDiscard(t *testing.T) {
+	tests := []struct {
+		name    string
+		install bool
+	}{
+		{name: "prepared", install: false},
+		{name: "installed", install: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "default")
+			store, err := OpenSnapshotStore(dir, 0, nil)
+			if err != nil {
+				t.Fatalf("OpenSnapshotStore: %v", err)
+			}
+
+			trie := testSnapshotTrie(t)
+			pending, err := store.Prepare(trie)
+			if err != nil {
+				t.Fatalf("Prepare: %v", err)
+			}
+			if _, err := os.Stat(store.path(trie.Clock)); !os.IsNotExist(err) {
+				t.Fatalf("a prepared snapshot is in place before Install (%v)", err)
+			}
+			if test.install {
+				if err := pending.Install(); err != nil {
+					t.Fatalf("Install: %v", err)
+				}
+			}
+
+			if err := pending.Discard(); err != nil {
+				t.Fatalf("Discard: %v", err)
+			}
+			entries, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("files are left after Discard: %v", entries[0].Name())
+			}
+			if trie, err := store.Latest(); err != nil || trie != nil {
+				t.Errorf("Latest after Discard is %v, %v; want nil, nil", trie, err)
+			}
+		})
+	}
+}
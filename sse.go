@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/logger"
+)
+
+/*
+GET /changes streams the trie's changes as Server-Sent Events:
+
+	id: 7
+	event: change
+	data: {"op":"insert","key":"foo","revision":7}
+
+The revision is the trie's clock after the change, and doubles as the event's id.
+The stream can be narrowed with one or more `prefix` parameters (/changes?prefix=fo&prefix=ba),
+and follows the default namespace unless a `namespace` parameter names another.
+
+A client that reconnects with a Last-Event-ID header (or a `last_event_id` parameter) first
+receives the changes it missed, as long as they are still among the last CHANGE_HISTORY_SIZE.
+If some of them have been forgotten (or were made before the server restarted), or the
+Last-Event-ID is ahead of the trie, the stream starts with a "reset" event, and the client
+should reload whatever it built from the changes.
+
+If a client falls more than SUBSCRIPTION_BUFFER_SIZE changes behind, the stream ends with an
+"overflow" event. EventSource clients reconnect on their own and catch up from history.
+*/
+const (
+	// How often a comment is sent on an idle stream, so that proxies don't close it
+	SSE_KEEPALIVE_INTERVAL = 15 * time.Second
+	// How long clients wait before reconnecting, in milliseconds
+	SSE_RETRY_MILLISECONDS = 1000
+)
+
+// The data of a change event
+type sseChange struct {
+	Op       string `json:"op"`
+	Key      string `json:"key"`
+	Revision uint64 `json:"revision"`
+}
+
+// The data of reset and overflow events
+type sseNotice struct {
+	Reason   string `json:"reason"`
+	Revision uint64 `json:"revision"`
+}
+
+/*
+HandleChanges serves GET /changes.
+*/
+func (s *Server) HandleChanges(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeRESTError(w, &CodedError{Code: ERR_CODE_INVALID, Message: "streaming is not supported"})
+		return
+	}
+
+	token, err := s.authenticate(r)
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+
+	dispatcher, err := s.namespaces.Get(query.Get("namespace"))
+	if err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	prefixes := query["prefix"]
+	if len(prefixes) == 0 && token != nil && len(token.Prefixes) > 0 {
+		// Follow everything the token may see
+		prefixes = token.Prefixes
+	}
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+	if err := token.AuthorizeSubscription(dispatcher, prefixes); err != nil {
+		writeRESTError(w, err)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = query.Get("last_event_id")
+	}
+
+	var subscription *Subscription
+	var backlog []Change
+	complete := true
+
+	if lastEventID != "" {
+		after, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			writeRESTError(w, &CodedError{Code: ERR_CODE_INVALID, Message: "Last-Event-ID must be a revision"})
+			return
+		}
+		subscription, backlog, complete = dispatcher.SubscribeFrom(prefixes, 0, after)
+	} else {
+		subscription = dispatcher.Changes().Subscribe(prefixes, 0)
+	}
+	defer subscription.Close()
+
+	logger.Infof("streaming changes to %v from %q", prefixes, lastEventID)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", SSE_RETRY_MILLISECONDS)
+
+	if !complete {
+		writeSSEEvent(w, "", "reset", sseNotice{Reason: "history", Revision: dispatcher.Revision()})
+	}
+	for _, change := range backlog {
+		writeSSEChange(w, change)
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(SSE_KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+
+		case change, ok := <-subscription.Events():
+			if !ok {
+				// The namespace was dropped
+				return
+			}
+			if change.Op == CHANGE_OVERFLOW {
+				// Ending the stream makes the client reconnect and catch up from history
+				writeSSEEvent(w, "", "overflow", sseNotice{Reason: "slow client", Revision: change.Version})
+				flusher.Flush()
+				return
+			}
+
+			writeSSEChange(w, change)
+			// Send everything that is already waiting before flushing
+			if len(subscription.Events()) == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+func writeSSEChange(w http.ResponseWriter, change Change) {
+	id := strconv.FormatUint(change.Version, 10)
+	writeSSEEvent(w, id, "change", sseChange{Op: change.Op, Key: change.Key, Revision: change.Version})
+}
+
+/*
+Writes one event. The data is JSON, so it never spans several lines.
+*/
+func writeSSEEvent(w http.ResponseWriter, id string, event string, data interface{}) {
+	// Events are made of strings and numbers, so they always encode
+	encoded, _ := json.Marshal(data)
+
+	if id != "" {
+		fmt.Fprintf(w, "id: %s\n", id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, encoded)
+}
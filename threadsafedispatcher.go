@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
 	"sync"
 
 	"github.com/google/logger"
@@ -14,27 +17,160 @@ ThreadSafeDispatcher dispatches commands to a Trie and ensures that they are pro
 type ThreadSafeDispatcher struct {
 	// trie is the Trie to which commands are dispatched
 	trie *Trie
-	// dispatcherMutex is the Mutex to ensure that no commands are processed out of order
-	dispatcherMutex sync.Mutex
+	// dispatcherMutex is the Mutex to ensure that no commands are processed out of order.
+	// Read-only commands only take the read lock, so they can run alongside each other.
+	dispatcherMutex sync.RWMutex
+	// commands are the commands this dispatcher can run
+	commands *CommandRegistry
+	// changes receives every change made to the trie, once it is durable
+	changes *ChangeHub
+	// unpublished are the changes recorded in the write-ahead log but not yet committed,
+	// in order. They are published once they are. It is guarded by publishMutex.
+	unpublished  []unpublishedChange
+	publishMutex sync.Mutex
+	// changelog records the changes on disk, if enabled
+	changelog *Changelog
+	// snapshots saves the trie on disk, if enabled
+	snapshots *SnapshotStore
+	// wal records every change before it is acknowledged, if enabled
+	wal *WriteAheadLog
+	// compactor keeps the write-ahead log short, if enabled
+	compactor *compactor
+	// dictionary answers the commands instead of the trie, in a dictionary namespace
+	dictionary *Dictionary
+	// name is the name of the dispatcher's namespace, and namespaces holds its siblings.
+	// Requests for another namespace are passed on to that namespace's dispatcher.
+	// Both are empty for a dispatcher created on its own.
+	name       string
+	namespaces *Namespaces
+	// failed is set once a change can't be made durable. The trie may then hold changes
+	// that would be lost on a restart, so the namespace refuses every command from then on.
+	// It is guarded by dispatcherMutex.
+	failed error
 }
 
 /*
-Creates a thread-safe dispatcher for the given Trie.
+Creates a thread-safe dispatcher for the given Trie, with the built-in commands.
 */
 func NewThreadSafeDispatcher(trie *Trie) *ThreadSafeDispatcher {
 	if trie == nil {
-		return &ThreadSafeDispatcher{trie: NewTrie()}
+		trie = NewTrie()
 	}
-	return &ThreadSafeDispatcher{trie: trie}
+
+	dispatcher := &ThreadSafeDispatcher{trie: trie, commands: NewDefaultCommandRegistry(), changes: NewChangeHub()}
+	trie.SetObserver(dispatcher.observe)
+
+	for _, command := range bulkCommands(dispatcher) {
+		if err := dispatcher.commands.Register(command); err != nil {
+			// They never clash with the built-in commands
+			panic(err)
+		}
+	}
+
+	return dispatcher
+}
+
+// A change waiting to be committed, with the write-ahead log's position after it
+type unpublishedChange struct {
+	change   Change
+	position uint64
+}
+
+/*
+Called with every change to the trie before it is made, under the write lock, so changes are
+recorded in order. The change is refused if it can't be recorded in the write-ahead log.
+Subscribers only hear of it once it is committed (see commit).
+*/
+func (s *ThreadSafeDispatcher) observe(change Change) error {
+	if s.wal != nil {
+		if err := s.wal.Append(change); err != nil {
+			logger.Errorf("Error appending to write-ahead log: %v", err)
+			return &CodedError{Code: ERR_CODE_INTERNAL, Message: fmt.Sprintf("the change couldn't be recorded: %v", err)}
+		}
+	}
+	if s.changelog != nil {
+		if err := s.changelog.Append(change); err != nil {
+			logger.Errorf("Error appending to changelog: %v", err)
+			// The logs must hold the same changes
+			if s.wal != nil {
+				if unappendErr := s.wal.Unappend(); unappendErr != nil {
+					logger.Errorf("Error removing the change from the write-ahead log: %v", unappendErr)
+				}
+			}
+			return &CodedError{Code: ERR_CODE_INTERNAL, Message: fmt.Sprintf("the change couldn't be recorded: %v", err)}
+		}
+	}
+
+	if s.wal == nil {
+		s.changes.Publish(change)
+		return nil
+	}
+	s.publishMutex.Lock()
+	s.unpublished = append(s.unpublished, unpublishedChange{change: change, position: s.wal.Position()})
+	s.publishMutex.Unlock()
+	return nil
+}
+
+// Publishes the changes recorded up to a position of the write-ahead log, in order
+func (s *ThreadSafeDispatcher) publish(position uint64) {
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+
+	published := 0
+	for _, pending := range s.unpublished {
+		if pending.position > position {
+			break
+		}
+		s.changes.Publish(pending.change)
+		published++
+	}
+	s.unpublished = s.unpublished[published:]
 }
 
-// enum for various command codes
+/*
+Returns the revision of the last change published. The caller must hold dispatcherMutex
+(so no change is recorded meanwhile) and publishMutex (so none is published).
+*/
+func (s *ThreadSafeDispatcher) publishedRevision() uint64 {
+	if len(s.unpublished) > 0 {
+		return s.unpublished[0].change.Version - 1
+	}
+	return s.trie.Clock
+}
+
+/*
+Commits and publishes every change recorded so far, so that a copy of the trie holds no
+change that isn't durable. The caller must hold dispatcherMutex, so it doesn't call fail
+if the changes can't be made durable; the caller that made them does.
+*/
+func (s *ThreadSafeDispatcher) flush() error {
+	s.publishMutex.Lock()
+	if len(s.unpublished) == 0 {
+		s.publishMutex.Unlock()
+		return nil
+	}
+	position := s.unpublished[len(s.unpublished)-1].position
+	s.publishMutex.Unlock()
+
+	if err := s.wal.Commit(position); err != nil {
+		return err
+	}
+	s.publish(position)
+	return nil
+}
+
+// enum for the legacy codes of the built-in commands
 const (
 	CMD_INSERT = iota
 	CMD_DELETE
 	CMD_EXISTS
 	CMD_COMPLETIONS
 	CMD_KEYS
+	CMD_GET
+	CMD_INSERT_IF
+	CMD_DELETE_IF
+	CMD_UPDATE_IF
+	CMD_BATCH
 )
 
 const ASCII_0 = 48
@@ -51,10 +187,18 @@ Command codes:
 	2: Check if a key exists
 	3: Generate completions for a prefix
 	4: List all keys in the trie
+	5: Get a key's version
+	6: Insert a key if its version matches
+	7: Delete a key if its version matches
+	8: Give a key a new version if its version matches
+	9: Run insert, delete or exists on many keys at once
 
 Because there is only one possible argument, this protocol is fairly straightforward.
 If there is an argument, it is simply the remaining string after the first byte, which
-is the command code.
+is the command code. The conditional commands (6, 7 and 8) take the expected version
+and the key separated by a colon. An expected version of 0 means that the key must not exist.
+The batch command (9) takes the code of the command to run (0, 1 or 2), followed by the keys,
+either as a JSON array of strings or as one key per line.
 
 Example Commands
 	0foo: Insert "foo"
@@ -62,123 +206,427 @@ Example Commands
 	2foo: Check if "foo" exists
 	3foo: Generate completions for "foo"
 	4: List all keys in the trie
-
+	5foo: Get the version of "foo"
+	63:foo: Insert "foo" if its version is 3
+	73:foo: Delete "foo" if its version is 3
+	83:foo: Give "foo" a new version if its version is 3
+	90["foo","bar"]: Insert "foo" and "bar"
+	92foo\nbar: Check if "foo" and "bar" exist
+
+Codes are looked up in the dispatcher's CommandRegistry, so the codes above are only the built-in ones.
+Messages that start with "{" use the version 2 protocol instead (see DispatchV2).
+Their result is a response envelope, which also describes any error.
+
+A legacy message can be sent to another namespace by prefixing it with "@[NAMESPACE] ":
+	@team 0foo: Insert "foo" in the namespace "team"
 */
 func (s *ThreadSafeDispatcher) DispatchRaw(message []byte) ([]byte, error) {
+	return s.DispatchRawAs(nil, message)
+}
+
+/*
+DispatchRawAs is like DispatchRaw, but only runs commands that a token allows.
+*/
+func (s *ThreadSafeDispatcher) DispatchRawAs(token *Token, message []byte) ([]byte, error) {
 	if len(message) == 0 {
-		return nil, errors.New("empty message")
+		return nil, &CodedError{Code: ERR_CODE_INVALID, Message: "empty message"}
 	}
 
-	// First byte is the command code
-	command := message[0] - ASCII_0
-
-	switch command {
-	case CMD_INSERT:
-		logger.Infof("inserting %s", message[1:])
+	if IsV2Message(message) {
+		return s.dispatchV2(token, message)
+	}
 
-		// result: true if the key was inserted, false if it was already present
-		result, err := s.DispatchInsert(string(message[1:]))
+	namespace, message := splitLegacyNamespace(message)
+	if namespace != "" {
+		target, err := s.resolve(namespace)
 		if err != nil {
 			return nil, err
 		}
+		if target != s {
+			return target.DispatchRawAs(token, message)
+		}
+		if len(message) == 0 {
+			return nil, &CodedError{Code: ERR_CODE_INVALID, Message: "empty message"}
+		}
+	}
 
-		return json.Marshal(result)
+	// First byte is the command code
+	command, ok := s.commands.LookupCode(int(message[0]) - ASCII_0)
+	if !ok {
+		return []byte{}, &CodedError{Code: ERR_CODE_INVALID, Message: "invalid command"}
+	}
 
-	case CMD_DELETE:
-		logger.Infof("deleting %s", message[1:])
+	args, err := command.ParseLegacy(message[1:])
+	if err != nil {
+		return nil, err
+	}
 
-		// result: true if the key was deleted, false if it was not present
-		result, err := s.DispatchDelete(string(message[1:]))
-		if err != nil {
-			return nil, err
-		}
+	result, err := s.DispatchAs(token, command, args)
+	if err != nil {
+		return nil, err
+	}
 
-		return json.Marshal(result)
+	return json.Marshal(result)
+}
 
-	case CMD_EXISTS:
-		logger.Infof("checking if %s exists", message[1:])
+/*
+Dispatch runs a command with already-parsed arguments.
+Read-only commands share the lock with each other; all other commands hold it exclusively.
+*/
+func (s *ThreadSafeDispatcher) Dispatch(command *Command, args interface{}) (interface{}, error) {
+	return s.DispatchAs(nil, command, args)
+}
 
-		// result: true if the key exists, false if it does not
-		result, err := s.DispatchExists(string(message[1:]))
-		if err != nil {
-			return nil, err
-		}
+/*
+DispatchAs is like Dispatch, but fails with ERR_CODE_FORBIDDEN unless the token allows the command.
+*/
+func (s *ThreadSafeDispatcher) DispatchAs(token *Token, command *Command, args interface{}) (interface{}, error) {
+	description := "dispatching " + command.Name
+	if command.Describe != nil {
+		description = command.Describe(args)
+	}
 
-		return json.Marshal(result)
+	if err := token.Authorize(s, command, args); err != nil {
+		logger.Warningf("[%s] denied %s: %v", token.Name, description, err)
+		return nil, err
+	}
 
-	case CMD_COMPLETIONS:
-		logger.Infof("completing %s", message[1:])
+	// Replicas only change through their leader (see replication.go)
+	if s.namespaces != nil && !command.ReadOnly && !replicaLocalCommands[command.Name] && s.namespaces.replication.IsReplica() {
+		return nil, s.namespaces.replication.readOnlyError()
+	}
 
-		// result: list of completions
-		result, err := s.DispatchCompetions(string(message[1:]))
-		if err != nil {
-			return nil, err
-		}
+	if token != nil {
+		// Say who made the request, for auditing
+		logger.Infof("[%s] %s", token.Name, description)
+	} else {
+		logger.Info(description)
+	}
 
-		return json.Marshal(result)
+	if command.Unlocked {
+		return command.Run(nil, args)
+	}
 
-	case CMD_KEYS:
-		logger.Infof("listing keys")
+	if command.ReadOnly {
+		s.dispatcherMutex.RLock()
+		defer s.dispatcherMutex.RUnlock()
 
-		if len(message) > 1 {
-			return nil, errors.New("key listing command takes no arguments")
+		if s.failed != nil {
+			return nil, s.failed
 		}
-
-		// result: list of keys
-		result := s.DispatchKeys()
-		return json.Marshal(result)
-
+		return command.Run(s.trie, args)
 	}
 
-	return []byte{}, errors.New("invalid command")
+	var result interface{}
+	var err error
+	position, failed := s.change(func() {
+		result, err = command.Run(s.trie, args)
+	})
+	if failed != nil {
+		return nil, failed
+	}
+	if commitErr := s.commit(position); commitErr != nil {
+		return nil, commitErr
+	}
+	return result, err
 }
 
 /*
-Insert a key to the Trie, returning whether there was a change (thread-safe).
+Makes changes to the trie under the write lock, returning the write-ahead log's position after them.
+It fails without making them if the namespace has stopped (see fail).
 */
-func (s *ThreadSafeDispatcher) DispatchInsert(key string) (bool, error) {
+func (s *ThreadSafeDispatcher) change(apply func()) (uint64, error) {
 	s.dispatcherMutex.Lock()
 	defer s.dispatcherMutex.Unlock()
 
-	return s.trie.Add(key)
+	if s.failed != nil {
+		return 0, s.failed
+	}
+	apply()
+	if s.wal == nil {
+		return 0, nil
+	}
+	return s.wal.Position(), nil
 }
 
 /*
-Delete a key from the Trie, returning whether there was a change (thread-safe).
+Waits until the changes made up to a position of the write-ahead log are durable, then
+publishes them. It is called after releasing the lock, so that other commands can run
+meanwhile, and the changes they make can be synced along with these.
 */
-func (s *ThreadSafeDispatcher) DispatchDelete(key string) (bool, error) {
-	s.dispatcherMutex.Lock()
-	defer s.dispatcherMutex.Unlock()
+func (s *ThreadSafeDispatcher) commit(position uint64) error {
+	if s.wal == nil {
+		return nil
+	}
+	if err := s.wal.Commit(position); err != nil {
+		s.fail(err)
+		return err
+	}
+	if s.changelog != nil && s.changelog.policy == WAL_FSYNC_ALWAYS {
+		if err := s.changelog.Sync(); err != nil {
+			s.fail(err)
+			return &CodedError{Code: ERR_CODE_INTERNAL, Message: fmt.Sprintf("the changelog couldn't be synced: %v", err)}
+		}
+	}
+	s.publish(position)
 
-	return s.trie.Remove(key)
+	s.maybeCompact()
+	return nil
 }
 
 /*
-Check if a key exists in the Trie (thread-safe).
+Stops the namespace after a change couldn't be made durable. The change is already in the
+trie, but it would be lost on a restart: every later command fails, subscribers are
+disconnected without hearing of it, and replicas never copy it. Reads made between the
+change and the failed commit, and readers of the changelog, may still have seen it.
+Restarting the server recovers what the log holds.
 */
-func (s *ThreadSafeDispatcher) DispatchExists(key string) (bool, error) {
+func (s *ThreadSafeDispatcher) fail(err error) {
 	s.dispatcherMutex.Lock()
 	defer s.dispatcherMutex.Unlock()
 
-	return s.trie.Has(key)
+	s.stop(err)
+}
+
+// Like fail, for callers that hold the write lock
+func (s *ThreadSafeDispatcher) stop(err error) {
+	if s.failed != nil {
+		return
+	}
+	logger.Errorf("Stopping namespace %s: %v", s.name, err)
+	s.failed = &CodedError{
+		Code:    ERR_CODE_INTERNAL,
+		Message: fmt.Sprintf("namespace %q stopped after failing to write to disk; restart the server", s.name),
+	}
+	s.changes.Close()
+}
+
+/*
+Changes returns the hub that publishes every change made to the trie.
+*/
+func (s *ThreadSafeDispatcher) Changes() *ChangeHub {
+	return s.changes
+}
+
+/*
+SubscribeFrom subscribes to the changes to keys with the given prefixes, along with the
+remembered changes after a revision (see ChangeHub.SubscribeFrom). The boolean result is false
+if that backlog misses some of the changes up to the trie's current revision.
+*/
+func (s *ThreadSafeDispatcher) SubscribeFrom(prefixes []string, capacity int, after uint64) (*Subscription, []Change, bool) {
+	s.dispatcherMutex.RLock()
+	defer s.dispatcherMutex.RUnlock()
+	s.publishMutex.Lock()
+	defer s.publishMutex.Unlock()
+
+	return s.changes.SubscribeFrom(prefixes, capacity, after, s.publishedRevision())
+}
+
+/*
+Info describes the dispatcher's namespace.
+*/
+func (s *ThreadSafeDispatcher) Info() NamespaceInfo {
+	s.dispatcherMutex.RLock()
+	defer s.dispatcherMutex.RUnlock()
+
+	if s.dictionary != nil {
+		return NamespaceInfo{Name: s.name, Keys: s.dictionary.Size(), Revision: s.trie.Clock, Dictionary: filepath.Base(s.dictionary.path)}
+	}
+	return NamespaceInfo{Name: s.name, Keys: s.trie.Size(), Revision: s.trie.Clock}
 }
 
 /*
-Get the keys starting with a prefix in the Trie (thread-safe).
+Returns the dispatcher of the named namespace, which may be this one.
 */
-func (s *ThreadSafeDispatcher) DispatchCompetions(prefix string) ([]string, error) {
+func (s *ThreadSafeDispatcher) resolve(namespace string) (*ThreadSafeDispatcher, error) {
+	if namespace == "" || namespace == s.name {
+		return s, nil
+	}
+	if s.namespaces == nil {
+		return nil, &CodedError{Code: ERR_CODE_NOT_FOUND, Message: fmt.Sprintf("namespace %q not found", namespace)}
+	}
+	return s.namespaces.Get(namespace)
+}
+
+/*
+Waits for running commands to finish, then ends every subscription and closes the changelog
+(or the dictionary).
+Used when the dispatcher's namespace is dropped.
+*/
+func (s *ThreadSafeDispatcher) close() {
 	s.dispatcherMutex.Lock()
 	defer s.dispatcherMutex.Unlock()
 
-	return s.trie.Completions(prefix)
+	s.trie.SetObserver(nil)
+	s.changes.Close()
+	if s.changelog != nil {
+		if err := s.changelog.Close(); err != nil {
+			logger.Errorf("Error closing changelog: %v", err)
+		}
+	}
+	if s.wal != nil {
+		if err := s.wal.Close(); err != nil {
+			logger.Errorf("Error closing write-ahead log: %v", err)
+		}
+	}
+	if s.dictionary != nil {
+		if err := s.dictionary.Close(); err != nil {
+			logger.Errorf("Error closing dictionary: %v", err)
+		}
+	}
 }
 
 /*
-List all keys, in depth-first order (thread-safe).
+Splits a legacy message of the form "@[NAMESPACE] [MESSAGE]" into its namespace and message.
+Messages without the prefix have an empty namespace.
 */
-func (s *ThreadSafeDispatcher) DispatchKeys() []string {
+func splitLegacyNamespace(message []byte) (string, []byte) {
+	if len(message) == 0 || message[0] != '@' {
+		return "", message
+	}
+
+	separator := bytes.IndexByte(message, ' ')
+	if separator < 0 {
+		return string(message[1:]), nil
+	}
+
+	return string(message[1:separator]), message[separator+1:]
+}
+
+/*
+UseChangelog records every change made to the trie from now on in a changelog,
+and registers the "changes" command to read it. The trie's clock is moved forward
+to the changelog's last revision, so that revisions keep increasing across restarts.
+*/
+func (s *ThreadSafeDispatcher) UseChangelog(changelog *Changelog) error {
 	s.dispatcherMutex.Lock()
 	defer s.dispatcherMutex.Unlock()
 
-	return s.trie.Keys()
+	s.changelog = changelog
+	if revision := changelog.Revision(); revision > s.trie.Clock {
+		s.trie.Clock = revision
+	}
+
+	return s.commands.Register(changesCommand(changelog))
+}
+
+/*
+Revision returns the trie's clock, which advances by one with every change.
+*/
+func (s *ThreadSafeDispatcher) Revision() uint64 {
+	s.dispatcherMutex.RLock()
+	defer s.dispatcherMutex.RUnlock()
+
+	return s.trie.Clock
+}
+
+/*
+Commands returns the registry of commands this dispatcher understands.
+Commands registered here become available over every protocol.
+*/
+func (s *ThreadSafeDispatcher) Commands() *CommandRegistry {
+	return s.commands
+}
+
+/*
+Parses the argument of a conditional command, encoded as [EXPECTED VERSION]:[KEY].
+*/
+func parseVersionedKey(argument []byte) (uint64, string, error) {
+	separator := bytes.IndexByte(argument, ':')
+	if separator < 0 {
+		return 0, "", &CodedError{Code: ERR_CODE_INVALID, Message: "conditional commands take [VERSION]:[KEY]"}
+	}
+
+	expected, err := strconv.ParseUint(string(argument[:separator]), 10, 64)
+	if err != nil {
+		return 0, "", &CodedError{Code: ERR_CODE_INVALID, Message: "invalid version"}
+	}
+
+	return expected, string(argument[separator+1:]), nil
+}
+
+/*
+Parses a list of keys, encoded either as a JSON array of strings or as one key per line.
+A single trailing newline is ignored.
+*/
+func parseKeyList(argument []byte) ([]string, error) {
+	if len(argument) > 0 && argument[0] == '[' {
+		var keys []string
+		if err := json.Unmarshal(argument, &keys); err != nil {
+			return nil, &CodedError{Code: ERR_CODE_INVALID, Message: "invalid key list"}
+		}
+		return keys, nil
+	}
+
+	if len(argument) == 0 {
+		return []string{}, nil
+	}
+
+	argument = bytes.TrimSuffix(argument, []byte("\n"))
+
+	lines := bytes.Split(argument, []byte("\n"))
+	keys := make([]string, 0, len(lines))
+	for _, line := range lines {
+		keys = append(keys, string(line))
+	}
+	return keys, nil
+}
+
+/*
+KeyInfo is the result of looking up a single key.
+*/
+type KeyInfo struct {
+	// Exists is whether the key is in the Trie
+	Exists bool `json:"exists"`
+	// Version is the key's current version (0 if it doesn't exist)
+	Version uint64 `json:"version"`
+}
+
+/*
+BatchItemResult is the result of one key in a batch.
+*/
+type BatchItemResult struct {
+	// Key is the key the command ran on
+	Key string `json:"key"`
+	// Result is the boolean result the single-key command would have returned
+	Result bool `json:"result"`
+	// Error is set if the command failed for this key
+	Error string `json:"error,omitempty"`
+}
+
+/*
+BatchResult is the result of a batch command: one result per key, in order,
+and the number of keys that returned true, returned false, or failed.
+*/
+type BatchResult struct {
+	Results []BatchItemResult `json:"results"`
+	True    int               `json:"true"`
+	False   int               `json:"false"`
+	Errors  int               `json:"errors"`
+}
+
+/*
+Applies a single-key command to every key, collecting the results.
+A failure on one key does not stop the rest of the batch.
+*/
+func runBatch(apply func(key string) (bool, error), keys []string) BatchResult {
+	result := BatchResult{Results: make([]BatchItemResult, 0, len(keys))}
+	for _, key := range keys {
+		item := BatchItemResult{Key: key}
+
+		value, err := apply(key)
+		if err != nil {
+			item.Error = err.Error()
+			result.Errors++
+		} else if value {
+			item.Result = true
+			result.True++
+		} else {
+			result.False++
+		}
+
+		result.Results = append(result.Results, item)
+	}
+
+	return result
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/logger"
+)
+
+/*
+TLS for every TCP listener, configured from the environment (see main.go):
+
+	TLS_CERT_FILE, TLS_KEY_FILE  The server's certificate chain and private key, as PEM
+	TLS_CLIENT_CA_FILE           CA certificates that client certificates must chain to (mutual TLS)
+	TLS_CLIENT_AUTH              "require" (the default) or "optional", when there is a client CA
+
+The files are checked for changes every TLS_RELOAD_INTERVAL, so rotated certificates are
+picked up without a restart. Connections that are already open keep their certificates.
+If the new files can't be loaded, the old ones stay in use.
+
+With mutual TLS, a verified client certificate identifies the client: its subject picks
+the client's API token (see auth.go), and appears in the logs of every command it runs.
+*/
+const TLS_RELOAD_INTERVAL = 30 * time.Second
+
+const (
+	TLS_CLIENT_AUTH_REQUIRE  = "require"
+	TLS_CLIENT_AUTH_OPTIONAL = "optional"
+)
+
+/*
+A CertificateReloader holds the server's certificate and client CAs, and reloads them
+when their files change.
+*/
+type CertificateReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	clientAuth   tls.ClientAuthType
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	// modTimes are the modification times of the files when they were last loaded
+	modTimes map[string]time.Time
+}
+
+/*
+Loads the certificate, key and (optionally) client CAs. clientAuth is one of the
+TLS_CLIENT_AUTH_* constants, and is ignored without client CAs.
+*/
+func NewCertificateReloader(certFile string, keyFile string, clientCAFile string, clientAuth string) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+
+	if clientCAFile != "" {
+		switch clientAuth {
+		case "", TLS_CLIENT_AUTH_REQUIRE:
+			reloader.clientAuth = tls.RequireAndVerifyClientCert
+		case TLS_CLIENT_AUTH_OPTIONAL:
+			reloader.clientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("client auth must be %q or %q", TLS_CLIENT_AUTH_REQUIRE, TLS_CLIENT_AUTH_OPTIONAL)
+		}
+	}
+
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+/*
+Reads the files and swaps them in.
+*/
+func (r *CertificateReloader) load() error {
+	modTimes, err := r.readModTimes()
+	if err != nil {
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in " + r.clientCAFile)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.certificate = &certificate
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *CertificateReloader) readModTimes() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, file := range []string{r.certFile, r.keyFile, r.clientCAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+/*
+Reloads the files if any of them changed since they were last loaded.
+*/
+func (r *CertificateReloader) reloadIfChanged() {
+	modTimes, err := r.readModTimes()
+	if err != nil {
+		logger.Errorf("Error checking TLS certificates: %v", err)
+		return
+	}
+
+	r.mutex.RLock()
+	changed := false
+	for file, modTime := range modTimes {
+		if !modTime.Equal(r.modTimes[file]) {
+			changed = true
+		}
+	}
+	r.mutex.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	if err := r.load(); err != nil {
+		logger.Errorf("Error reloading TLS certificates, keeping the old ones: %v", err)
+		return
+	}
+	logger.Infof("reloaded TLS certificates from %s", r.certFile)
+}
+
+/*
+Watch checks for new certificates every interval, in the background.
+*/
+func (r *CertificateReloader) Watch(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			r.reloadIfChanged()
+		}
+	}()
+}
+
+/*
+TLSConfig returns a configuration that always uses the latest certificates.
+*/
+func (r *CertificateReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// Every handshake gets a configuration with the certificates loaded at that moment
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mutex.RLock()
+			defer r.mutex.RUnlock()
+
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.certificate},
+				ClientCAs:    r.clientCAs,
+				ClientAuth:   r.clientAuth,
+				NextProtos:   []string{"h2", "http/1.1"},
+			}, nil
+		},
+	}
+}
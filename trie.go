@@ -2,11 +2,13 @@ package main
 
 import (
 	"errors"
+	"sort"
+	"strings"
 )
 
 /*
 The Trie data structure stores a set of strings.
-Each Trie object can act as a node in any part of the trie.
+A Trie is made of TrieNodes, and each TrieNode can act as the root of the trie below it.
 To make prefix lookups efficient, each node simply stores a map of (next character) --> (sub-trie).
 For example, a Trie containing the words "foo", "bar", "baz", and "fo" would have the following structure:
 
@@ -38,24 +40,85 @@ HEAD
 Now, we can just list all the keys for the subtries.
 If the current trie were also a subtrie, then we would add the prefix to the list.
 
-This method is implemented recursively.
-The base case is that the prefix is empty, in which case we return the keys of the current trie.
-Otherwise, we follow the subtrie corresponding to the first character of the prefix,
-and recursively call the function on the subtrie with the remaining characters of the prefix.
-(We must remember to prepend each of these results with the character of the subtrie that led to them)
-Then, if the current trie is the end of a word, we add the current prefix to the results.
+To list the keys, we walk the subtries recursively, in order of their characters,
+keeping the bytes of the path that led to each node. Whenever a node is the end of a word,
+its path is a key, so the keys come out in lexicographic order.
 */
 type Trie struct {
+	// The node of the empty prefix
+	*TrieNode
+	// The last version handed out by this trie. Every change to the trie
+	// advances the clock, so versions of a key only ever increase, even if
+	// the key is deleted and inserted again.
+	Clock uint64
+	// observer is called with every change made to the trie, before it is made (optional)
+	observer func(change Change) error
+}
+
+/*
+A TrieNode is one node of a Trie. Nodes only hold what every node needs, since
+there are as many of them as there are characters in the trie.
+*/
+type TrieNode struct {
 	// The map of (next character) --> (sub-trie)
-	Subtries map[byte]*Trie
+	Subtries map[byte]*TrieNode
 	// If this is set to true, a word ends at this node
 	IsEndOfWord bool
+	// The version of the word ending at this node (0 if no word ends here)
+	Version uint64
+}
+
+// enum for the kinds of changes to a trie
+const (
+	// A key was added
+	CHANGE_INSERT = "insert"
+	// An existing key was given a new version
+	CHANGE_UPDATE = "update"
+	// A key was removed
+	CHANGE_DELETE = "delete"
+	// The whole trie was replaced, such as by restoring a backup. The change has no key.
+	CHANGE_LOAD = "load"
+)
+
+/*
+A Change describes a single modification of a trie.
+*/
+type Change struct {
+	// Op is one of the CHANGE_* constants
+	Op string `json:"op"`
+	// Key is the key that changed
+	Key string `json:"key"`
+	// Version is the trie's clock after the change. For inserts and updates,
+	// it is also the key's new version.
+	Version uint64 `json:"version"`
+}
+
+/*
+SetObserver registers a function to call before every change to the trie, such as to
+record the change. If the observer fails, the change isn't made, and the error is returned.
+The observer runs synchronously, so it must not block or modify the trie.
+*/
+func (t *Trie) SetObserver(observer func(change Change) error) {
+	t.observer = observer
+}
+
+// notify tells the observer, if any, about a change that is about to be made at a version
+func (t *Trie) notify(op string, key string, version uint64) error {
+	if t.observer == nil {
+		return nil
+	}
+	return t.observer(Change{Op: op, Key: key, Version: version})
 }
 
 // Creates an empty trie
 func NewTrie() *Trie {
-	return &Trie{
-		Subtries:    make(map[byte]*Trie),
+	return &Trie{TrieNode: newTrieNode()}
+}
+
+// Creates a node with no subtries
+func newTrieNode() *TrieNode {
+	return &TrieNode{
+		Subtries:    make(map[byte]*TrieNode),
 		IsEndOfWord: false,
 	}
 }
@@ -63,47 +126,83 @@ func NewTrie() *Trie {
 // Keys can be a maximum length of 256 characters
 const MAX_KEY_LENGTH = 256
 
+// Errors for keys and prefixes of MAX_KEY_LENGTH characters or more
+var (
+	errKeyTooLong    = &CodedError{Code: ERR_CODE_INVALID, Message: "key is too long"}
+	errPrefixTooLong = &CodedError{Code: ERR_CODE_INVALID, Message: "prefix is too long"}
+)
+
 // Add adds a word to the trie, returning whether there was a change
 func (t *Trie) Add(key string) (bool, error) {
 	// Verify that the key is not too long
 	if len(key) >= MAX_KEY_LENGTH {
-		return false, errors.New("key is too long")
+		return false, errKeyTooLong
+	}
+
+	if t.version(key) != 0 {
+		return false, nil
 	}
+	if err := t.notify(CHANGE_INSERT, key, t.Clock+1); err != nil {
+		return false, err
+	}
+
+	t.Clock++
+	t.add(key, t.Clock, false)
+	return true, nil
+}
 
+// add marks the end of `key` as a word with the given version.
+// If the word is already present, its version is only replaced when `overwrite` is set.
+func (t *TrieNode) add(key string, version uint64, overwrite bool) bool {
 	// If the key is empty, then this node is the end of a word
 	if len(key) == 0 {
 		// Return whether there was a change
-		previousIssubtrie := t.IsEndOfWord
+		if t.IsEndOfWord && !overwrite {
+			return false
+		}
 		t.IsEndOfWord = true
-		return t.IsEndOfWord != previousIssubtrie, nil
+		t.Version = version
+		return true
 	}
 
 	first := key[0]
 
 	if _, ok := t.Subtries[first]; !ok {
 		// Add a subtrie if a subtrie for the next character doesn't exist
-		t.Subtries[first] = &Trie{
-			Subtries:    make(map[uint8]*Trie),
-			IsEndOfWord: false,
-		}
+		t.Subtries[first] = newTrieNode()
 	}
 
 	// Add the key to the subtrie
-	return t.Subtries[first].Add(key[1:])
+	return t.Subtries[first].add(key[1:], version, overwrite)
 }
 
 // Remove removes a word from the trie, returning whether there was a change
 func (t *Trie) Remove(key string) (bool, error) {
 	// Verify that the key is not too long
 	if len(key) >= MAX_KEY_LENGTH {
-		return false, errors.New("key is too long")
+		return false, errKeyTooLong
 	}
 
+	if t.version(key) == 0 {
+		return false, nil
+	}
+	if err := t.notify(CHANGE_DELETE, key, t.Clock+1); err != nil {
+		return false, err
+	}
+
+	t.Clock++
+	t.remove(key)
+	return true, nil
+}
+
+// remove unmarks the end of `key`, pruning subtries that become empty
+func (t *TrieNode) remove(key string) bool {
 	if len(key) == 0 {
 		// Return whether there was a change
 		previousIssubtrie := t.IsEndOfWord
 		t.IsEndOfWord = false
-		return t.IsEndOfWord != previousIssubtrie, nil
+		t.Version = 0
+		return t.IsEndOfWord != previousIssubtrie
 	}
 
 	// Recurse. Follow the path of subtries, and remove the node corresponding to the key.
@@ -112,14 +211,11 @@ func (t *Trie) Remove(key string) (bool, error) {
 
 	if _, ok := t.Subtries[first]; !ok {
 		// The key doesn't exist
-		return false, nil
+		return false
 	}
 
 	// Remove the key from the subtrie
-	changed, err := t.Subtries[first].Remove(key[1:])
-	if err != nil {
-		return changed, err
-	}
+	changed := t.Subtries[first].remove(key[1:])
 
 	if changed {
 		subtrie := t.Subtries[first]
@@ -129,34 +225,180 @@ func (t *Trie) Remove(key string) (bool, error) {
 		}
 	}
 
-	return changed, err
+	return changed
 }
 
 // Has returns whether the trie contains a key
 func (t *Trie) Has(key string) (bool, error) {
+	version, err := t.GetVersion(key)
+	return version != 0, err
+}
+
+// GetVersion returns the version of a key, or 0 if the key is not in the trie
+func (t *Trie) GetVersion(key string) (uint64, error) {
 	// Verify that the key is not too long
 	if len(key) >= MAX_KEY_LENGTH {
-		return false, errors.New("key is too long")
+		return 0, errKeyTooLong
 	}
 
+	return t.version(key), nil
+}
+
+// version returns the version of a key below this node, or 0 if there is no such key
+func (t *TrieNode) version(key string) uint64 {
 	// Base case: if the key is blank, and this trie marks the end of a word,
 	// then the key is in the trie
 	if len(key) == 0 {
-		return t.IsEndOfWord, nil
+		if !t.IsEndOfWord {
+			return 0
+		}
+		return t.Version
 	}
 
 	// Recurse. Follow the path of subtries, and check if the key is in the subtrie
 	first := key[0]
 
 	if _, ok := t.Subtries[first]; !ok {
-		return false, nil
+		return 0
 	}
 
-	return t.Subtries[first].Has(key[1:])
+	return t.Subtries[first].version(key[1:])
+}
+
+/*
+AddIfVersion writes a key only if its current version equals `expected`,
+returning the key's new version. An expected version of 0 means that the key
+must not exist yet. If the key already exists, it is given a new version.
+*/
+func (t *Trie) AddIfVersion(key string, expected uint64) (uint64, error) {
+	current, err := t.GetVersion(key)
+	if err != nil {
+		return 0, err
+	}
+
+	if current != expected {
+		return 0, NewVersionConflictError(key, expected, current)
+	}
+
+	op := CHANGE_INSERT
+	if current != 0 {
+		op = CHANGE_UPDATE
+	}
+	if err := t.notify(op, key, t.Clock+1); err != nil {
+		return 0, err
+	}
+
+	t.Clock++
+	t.add(key, t.Clock, true)
+	return t.Clock, nil
+}
+
+/*
+RemoveIfVersion removes a key only if its current version equals `expected`,
+returning whether there was a change.
+*/
+func (t *Trie) RemoveIfVersion(key string, expected uint64) (bool, error) {
+	current, err := t.GetVersion(key)
+	if err != nil {
+		return false, err
+	}
+
+	if current != expected {
+		return false, NewVersionConflictError(key, expected, current)
+	}
+
+	return t.Remove(key)
+}
+
+/*
+UpdateIfVersion gives an existing key a new version, but only if its current
+version equals `expected`. It returns the key's new version.
+*/
+func (t *Trie) UpdateIfVersion(key string, expected uint64) (uint64, error) {
+	current, err := t.GetVersion(key)
+	if err != nil {
+		return 0, err
+	}
+
+	// An update never creates a key, so a missing key is always a conflict
+	if current == 0 || current != expected {
+		return 0, NewVersionConflictError(key, expected, current)
+	}
+
+	if err := t.notify(CHANGE_UPDATE, key, t.Clock+1); err != nil {
+		return 0, err
+	}
+
+	t.Clock++
+	t.add(key, t.Clock, true)
+	return t.Clock, nil
+}
+
+/*
+Apply redoes a change that was recorded elsewhere, such as in a write-ahead log.
+The key gets the version the change was made at, and the clock moves to it, so
+applying the changes in order rebuilds the trie exactly. The observer isn't told.
+*/
+func (t *Trie) Apply(change Change) error {
+	return t.apply(change, false)
+}
+
+/*
+ApplyObserved is like Apply, but tells the observer first, like any change made to this
+trie. Replicas use it to make the changes copied from their leader.
+*/
+func (t *Trie) ApplyObserved(change Change) error {
+	return t.apply(change, true)
+}
+
+func (t *Trie) apply(change Change, observed bool) error {
+	if len(change.Key) >= MAX_KEY_LENGTH {
+		return errKeyTooLong
+	}
+	switch change.Op {
+	case CHANGE_INSERT, CHANGE_UPDATE, CHANGE_DELETE:
+	default:
+		return errors.New("unknown change " + change.Op)
+	}
+
+	if observed {
+		if err := t.notify(change.Op, change.Key, change.Version); err != nil {
+			return err
+		}
+	}
+
+	if change.Op == CHANGE_DELETE {
+		t.remove(change.Key)
+	} else {
+		t.add(change.Key, change.Version, true)
+	}
+
+	t.Clock = change.Version
+	return nil
+}
+
+/*
+Clone returns a deep copy of the trie, with the same clock but without its observer.
+*/
+func (t *Trie) Clone() *Trie {
+	return &Trie{TrieNode: t.TrieNode.clone(), Clock: t.Clock}
+}
+
+// clone returns a deep copy of the node and the nodes below it
+func (t *TrieNode) clone() *TrieNode {
+	clone := &TrieNode{
+		Subtries:    make(map[byte]*TrieNode, len(t.Subtries)),
+		IsEndOfWord: t.IsEndOfWord,
+		Version:     t.Version,
+	}
+	for character, subtrie := range t.Subtries {
+		clone.Subtries[character] = subtrie.clone()
+	}
+	return clone
 }
 
 // IsEmpty returns whether the trie is empty
-func (t *Trie) IsEmpty() bool {
+func (t *TrieNode) IsEmpty() bool {
 	return len(t.Subtries) == 0 && !t.IsEndOfWord
 }
 
@@ -164,37 +406,82 @@ func (t *Trie) IsEmpty() bool {
 func (t *Trie) Completions(prefix string) ([]string, error) {
 	// Verify that the prefix is not too long
 	if len(prefix) >= MAX_KEY_LENGTH {
-		return nil, errors.New("prefix is too long")
+		return nil, errPrefixTooLong
 	}
 
-	// If we reach the end of the prefix, simply return all characters in the trie
-	if len(prefix) == 0 {
-		return t.Keys(), nil
+	// The keys are collected along with the path that led to them, so that they come out
+	// in the same order, and with the same bytes, as pages of CompletionsFrom
+	keys, _, _, err := t.CompletionsFrom(prefix, "", 0)
+	return keys, err
+}
+
+/*
+CompletionsFrom returns, in lexicographic order, up to `limit` keys that begin with `prefix`
+and sort at or after `start`. A limit of 0 means no limit.
+If there are more keys, it also returns the first key that didn't fit, which is where the
+next page starts.
+*/
+func (t *Trie) CompletionsFrom(prefix string, start string, limit int) ([]string, string, bool, error) {
+	// Verify that the prefix is not too long
+	if len(prefix) >= MAX_KEY_LENGTH {
+		return nil, "", false, errPrefixTooLong
 	}
 
-	// Recurse. Follow the path of subtries, and check if the prefix is in the subtrie
-	first := prefix[0]
+	// Follow the path of subtries to the node for the prefix
+	node := t.TrieNode
+	for i := 0; i < len(prefix); i++ {
+		subtrie, ok := node.Subtries[prefix[i]]
+		if !ok {
+			// This prefix doesn't exist in the tree
+			return []string{}, "", false, nil
+		}
+		node = subtrie
+	}
 
-	if _, ok := t.Subtries[first]; !ok {
-		// This prefix doesn't exist in the tree
-		return []string{}, nil
+	page := &keyPage{start: start, limit: limit, keys: make([]string, 0)}
+	node.collectPage([]byte(prefix), page)
+	return page.keys, page.next, page.more, nil
+}
+
+// A page of keys being collected by collectPage
+type keyPage struct {
+	start string
+	limit int
+	keys  []string
+	// next is the first key that didn't fit on the page, if more is set
+	next string
+	more bool
+}
+
+// collectPage adds the keys under this node to the page, in order, returning true once the page is full
+func (t *TrieNode) collectPage(path []byte, page *keyPage) bool {
+	// Every key under this node begins with `path`. If `path` sorts before the start
+	// of the page without being a prefix of it, then so do all of those keys.
+	current := string(path)
+	if current < page.start && !strings.HasPrefix(page.start, current) {
+		return false
 	}
 
-	// Find completions from the corresponding subtrie
-	subtrieCompletions, err := t.Subtries[first].Completions(prefix[1:])
-	if err != nil {
-		return nil, err
+	if t.IsEndOfWord && current >= page.start {
+		if page.limit > 0 && len(page.keys) == page.limit {
+			page.next = current
+			page.more = true
+			return true
+		}
+		page.keys = append(page.keys, current)
 	}
 
-	prefixedCompletions := make([]string, 0, len(subtrieCompletions))
-	for _, subtrieCompletion := range subtrieCompletions {
-		prefixedCompletions = append(prefixedCompletions, string(first)+subtrieCompletion)
+	for _, characterThatLedToSubtrie := range t.sortedCharacters() {
+		if t.Subtries[characterThatLedToSubtrie].collectPage(append(path, characterThatLedToSubtrie), page) {
+			return true
+		}
 	}
-	return prefixedCompletions, nil
+
+	return false
 }
 
 // Size returns the number of keys in the trie
-func (t *Trie) Size() int {
+func (t *TrieNode) Size() int {
 	size := 0
 
 	// Size = number of keys in subtries + whether or not this node is the end of a word
@@ -209,20 +496,19 @@ func (t *Trie) Size() int {
 	return size
 }
 
-// Keys returns all keys in the trie
-func (t *Trie) Keys() []string {
-	keys := make([]string, 0, t.Size())
-	// End of a word: add an empty string.
-	if t.IsEndOfWord {
-		keys = append(keys, "")
-	}
+// Keys returns all keys in the trie, in lexicographic order
+func (t *TrieNode) Keys() []string {
+	page := &keyPage{keys: make([]string, 0, t.Size())}
+	t.collectPage(nil, page)
+	return page.keys
+}
 
-	for characterThatLedToSubtrie, subtrie := range t.Subtries {
-		for _, subtrieKey := range subtrie.Keys() {
-			// Add keys from subtries, prefixed with character that led to them
-			keys = append(keys, string(characterThatLedToSubtrie)+subtrieKey)
-		}
+// sortedCharacters returns the characters that lead to subtries, in ascending order
+func (t *TrieNode) sortedCharacters() []byte {
+	characters := make([]byte, 0, len(t.Subtries))
+	for character := range t.Subtries {
+		characters = append(characters, character)
 	}
-
-	return keys
+	sort.Slice(characters, func(i, j int) bool { return characters[i] < characters[j] })
+	return characters
 }
@@ -0,0 +1,353 @@
+/*
+Package trieclient is a client for the trie server's binary protocol.
+
+A Client is safe for concurrent use. Requests from several goroutines are pipelined
+over one connection, and each response is matched to its request by request id.
+
+	client, err := trieclient.Dial("tcp", "localhost:7000")
+	if err != nil {
+		...
+	}
+	defer client.Close()
+
+	inserted, err := client.Insert("foo")
+	completions, err := client.Completions("fo")
+*/
+package trieclient
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Opcodes of the server's built-in commands
+const (
+	OP_INSERT      = 0
+	OP_DELETE      = 1
+	OP_EXISTS      = 2
+	OP_COMPLETIONS = 3
+	OP_KEYS        = 4
+	OP_GET         = 5
+	OP_INSERT_IF   = 6
+	OP_DELETE_IF   = 7
+	OP_UPDATE_IF   = 8
+	OP_BATCH       = 9
+	// Opcode of requests that name their command instead of using an opcode
+	OP_NAMED = 0xFF
+)
+
+const (
+	// Don't send a response if the request succeeds
+	FLAG_QUIET = 1 << 0
+
+	statusOK = 0
+	// Largest key the protocol can carry
+	maxKeyLength = 1<<16 - 1
+	// Largest frame the client will accept
+	maxFrameLength = 16 << 20
+)
+
+// ErrClosed is returned for requests made after the connection closed
+var ErrClosed = errors.New("trieclient: connection closed")
+
+/*
+An Error is an error reported by the server.
+*/
+type Error struct {
+	// Code is the server's error code, such as "conflict"
+	Code string `json:"code"`
+	// Message is a human-readable description of the error
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// A response, as read off the connection
+type response struct {
+	status  byte
+	payload []byte
+}
+
+/*
+A Client is a connection to a trie server's binary protocol listener.
+*/
+type Client struct {
+	conn net.Conn
+	// writeMutex serializes request frames
+	writeMutex sync.Mutex
+	writer     *bufio.Writer
+
+	// mutex guards the fields below
+	mutex   sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan response
+	err     error
+	closed  bool
+}
+
+/*
+Dial connects to a server. The network is "tcp" or "unix".
+*/
+func Dial(network string, address string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+/*
+NewClient wraps an existing connection.
+*/
+func NewClient(conn net.Conn) *Client {
+	client := &Client{
+		conn:    conn,
+		writer:  bufio.NewWriter(conn),
+		pending: make(map[uint32]chan response),
+	}
+	go client.readLoop()
+	return client
+}
+
+/*
+Close closes the connection. Outstanding requests fail with ErrClosed.
+*/
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	c.closed = true
+	c.mutex.Unlock()
+
+	return c.conn.Close()
+}
+
+/*
+Reads responses and hands them to the requests waiting for them.
+*/
+func (c *Client) readLoop() {
+	reader := bufio.NewReader(c.conn)
+
+	var err error
+	for {
+		var length uint32
+		if err = binary.Read(reader, binary.BigEndian, &length); err != nil {
+			break
+		}
+		if length < 5 || length > maxFrameLength {
+			err = fmt.Errorf("trieclient: invalid frame length %d", length)
+			break
+		}
+
+		frame := make([]byte, length)
+		if _, err = io.ReadFull(reader, frame); err != nil {
+			break
+		}
+
+		id := binary.BigEndian.Uint32(frame[1:5])
+
+		c.mutex.Lock()
+		waiter, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mutex.Unlock()
+
+		if ok {
+			waiter <- response{status: frame[0], payload: frame[5:]}
+		}
+	}
+
+	// Fail everything that is still waiting
+	c.mutex.Lock()
+	if err == io.EOF || c.closed {
+		err = ErrClosed
+	}
+	c.err = err
+	for id, waiter := range c.pending {
+		close(waiter)
+		delete(c.pending, id)
+	}
+	c.mutex.Unlock()
+
+	c.conn.Close()
+}
+
+/*
+Do sends a request and waits for its response, returning the JSON-encoded result.
+For most opcodes, `key` is the command's key and `args` holds its other arguments
+(it may be nil). For OP_NAMED, `key` is the command's name.
+*/
+func (c *Client) Do(opcode byte, key string, args interface{}) (json.RawMessage, error) {
+	return c.do(opcode, 0, key, args)
+}
+
+/*
+Send sends a request without waiting for a response. The server only replies if
+the request fails, and those failures are discarded.
+*/
+func (c *Client) Send(opcode byte, key string, args interface{}) error {
+	_, err := c.do(opcode, FLAG_QUIET, key, args)
+	return err
+}
+
+func (c *Client) do(opcode byte, flags byte, key string, args interface{}) (json.RawMessage, error) {
+	if len(key) > maxKeyLength {
+		return nil, errors.New("trieclient: key too long")
+	}
+
+	var payload []byte
+	if args != nil {
+		var err error
+		if payload, err = json.Marshal(args); err != nil {
+			return nil, err
+		}
+	}
+
+	c.mutex.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mutex.Unlock()
+		return nil, err
+	}
+	c.nextID++
+	id := c.nextID
+	waiter := make(chan response, 1)
+	quiet := flags&FLAG_QUIET != 0
+	if !quiet {
+		c.pending[id] = waiter
+	}
+	c.mutex.Unlock()
+
+	frame := make([]byte, 4+1+4+1+2, 4+1+4+1+2+len(key)+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(1+4+1+2+len(key)+len(payload)))
+	frame[4] = opcode
+	binary.BigEndian.PutUint32(frame[5:9], id)
+	frame[9] = flags
+	binary.BigEndian.PutUint16(frame[10:12], uint16(len(key)))
+	frame = append(frame, key...)
+	frame = append(frame, payload...)
+
+	c.writeMutex.Lock()
+	_, err := c.writer.Write(frame)
+	if err == nil {
+		err = c.writer.Flush()
+	}
+	c.writeMutex.Unlock()
+
+	if err != nil {
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+		return nil, err
+	}
+
+	if quiet {
+		return nil, nil
+	}
+
+	response, ok := <-waiter
+	if !ok {
+		c.mutex.Lock()
+		err := c.err
+		c.mutex.Unlock()
+		return nil, err
+	}
+
+	if response.status != statusOK {
+		serverError := &Error{}
+		if err := json.Unmarshal(response.payload, serverError); err != nil {
+			return nil, fmt.Errorf("trieclient: malformed error response: %s", response.payload)
+		}
+		return nil, serverError
+	}
+
+	return response.payload, nil
+}
+
+/*
+Call runs a command by name, decoding its result into `result` (which may be nil).
+*/
+func (c *Client) Call(name string, args interface{}, result interface{}) error {
+	return c.call(OP_NAMED, name, args, result)
+}
+
+func (c *Client) call(opcode byte, key string, args interface{}, result interface{}) error {
+	payload, err := c.Do(opcode, key, args)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(payload, result)
+}
+
+// Insert adds a key, returning whether it was new
+func (c *Client) Insert(key string) (bool, error) {
+	var inserted bool
+	err := c.call(OP_INSERT, key, nil, &inserted)
+	return inserted, err
+}
+
+// Delete removes a key, returning whether it was present
+func (c *Client) Delete(key string) (bool, error) {
+	var deleted bool
+	err := c.call(OP_DELETE, key, nil, &deleted)
+	return deleted, err
+}
+
+// Exists returns whether a key is present
+func (c *Client) Exists(key string) (bool, error) {
+	var exists bool
+	err := c.call(OP_EXISTS, key, nil, &exists)
+	return exists, err
+}
+
+// Get returns the version of a key, or 0 if it isn't present
+func (c *Client) Get(key string) (uint64, error) {
+	var info struct {
+		Version uint64 `json:"version"`
+	}
+	err := c.call(OP_GET, key, nil, &info)
+	return info.Version, err
+}
+
+// Completions returns up to `limit` keys starting with a prefix (0 means no limit)
+func (c *Client) Completions(prefix string, limit int) ([]string, error) {
+	var completions []string
+	err := c.call(OP_COMPLETIONS, prefix, map[string]int{"limit": limit}, &completions)
+	return completions, err
+}
+
+// Keys returns up to `limit` keys (0 means no limit)
+func (c *Client) Keys(limit int) ([]string, error) {
+	var keys []string
+	err := c.call(OP_KEYS, "", map[string]int{"limit": limit}, &keys)
+	return keys, err
+}
+
+// InsertIfVersion writes a key if its version is `expected` (0 for absent), returning its new version
+func (c *Client) InsertIfVersion(key string, expected uint64) (uint64, error) {
+	var version uint64
+	err := c.call(OP_INSERT_IF, key, map[string]uint64{"version": expected}, &version)
+	return version, err
+}
+
+// DeleteIfVersion removes a key if its version is `expected`, returning whether it was present
+func (c *Client) DeleteIfVersion(key string, expected uint64) (bool, error) {
+	var deleted bool
+	err := c.call(OP_DELETE_IF, key, map[string]uint64{"version": expected}, &deleted)
+	return deleted, err
+}
+
+// UpdateIfVersion gives a key a new version if its version is `expected`, returning the new version
+func (c *Client) UpdateIfVersion(key string, expected uint64) (uint64, error) {
+	var version uint64
+	err := c.call(OP_UPDATE_IF, key, map[string]uint64{"version": expected}, &version)
+	return version, err
+}
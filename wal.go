@@ -0,0 +1,641 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/logger"
+)
+
+/*
+The write-ahead log records every change to a namespace's trie before the change is
+acknowledged, so that nothing acknowledged is lost when the server stops. On startup,
+the namespace is restored from its newest snapshot, and the log is replayed on top of it.
+
+The log lives next to the snapshots (see snapshot.go), in files named after the first
+revision they may hold:
+
+	data/default/00000000000000000043.wal
+
+Each record is one change, stored as:
+
+	length                uint32, the length of the payload
+	checksum              uint32, CRC-32C of the payload
+	payload:
+	  op                  1 byte, one of the WAL_OP_* constants
+	  revision            uvarint, the trie's clock after the change
+	  key                 the rest of the payload
+
+If the log is encrypted (see encryption.go), each file starts with a header naming its key,
+and the payload of each record is sealed.
+
+Records hold the revision the change was made at, rather than the change relative to the
+state before it, so replaying a record that the snapshot already covers changes nothing.
+Replay skips them, and stops cleanly at a record that was only partly written when the
+server stopped; that record was never acknowledged. A log that skips a revision, or starts
+after the snapshot's, is missing acknowledged changes, so the namespace isn't opened.
+
+How durable an acknowledged change is depends on the fsync policy:
+
+	always     every change is synced to disk before it is acknowledged. Changes made while
+	           the disk is busy syncing wait for the next sync together (group commit).
+	everysec   the log is synced once a second, so a crash of the machine loses at most
+	           about a second of changes. A crash of the server alone loses nothing.
+	never      the operating system decides when the log reaches the disk.
+*/
+const (
+	WAL_FSYNC_ALWAYS   = "always"
+	WAL_FSYNC_EVERYSEC = "everysec"
+	WAL_FSYNC_NEVER    = "never"
+
+	WAL_SUFFIX = ".wal"
+
+	// Size of a record's length and checksum
+	WAL_RECORD_HEADER_SIZE = 8
+)
+
+// enum for the kinds of records in the write-ahead log
+const (
+	WAL_OP_INSERT = iota + 1
+	WAL_OP_UPDATE
+	WAL_OP_DELETE
+	// The trie was replaced by the snapshot taken at the record's revision
+	WAL_OP_LOAD
+)
+
+var walOps = map[string]byte{
+	CHANGE_INSERT: WAL_OP_INSERT,
+	CHANGE_UPDATE: WAL_OP_UPDATE,
+	CHANGE_DELETE: WAL_OP_DELETE,
+	CHANGE_LOAD:   WAL_OP_LOAD,
+}
+
+var walChanges = map[byte]string{
+	WAL_OP_INSERT: CHANGE_INSERT,
+	WAL_OP_UPDATE: CHANGE_UPDATE,
+	WAL_OP_DELETE: CHANGE_DELETE,
+	WAL_OP_LOAD:   CHANGE_LOAD,
+}
+
+/*
+A WriteAheadLog is the write-ahead log of one namespace. It is safe for concurrent use.
+*/
+type WriteAheadLog struct {
+	dir    string
+	policy string
+	// keyring encrypts new log files, if set
+	keyring *Keyring
+
+	mutex sync.Mutex
+	// files are the first revisions of the log files, oldest first
+	files []uint64
+	// current is the newest file, which records are appended to
+	current *os.File
+	// currentFirst is the first revision of the current file, currentBytes its size, and
+	// currentKey the id of the key it is encrypted with ("" if it isn't)
+	currentFirst uint64
+	currentBytes int64
+	currentKey   string
+	// retired are the files rotated out that may hold unsynced records. The next sync
+	// syncs and closes them.
+	retired []*os.File
+	// position counts the records appended since the log was opened
+	position uint64
+	// lastRecord is the size of the last record appended, for Unappend
+	lastRecord int64
+	// bytes is the total size of the log files
+	bytes int64
+	// failed is the error that made the log unusable: a failed sync, after which the
+	// kernel may have dropped the unsynced records, or a partial record that couldn't be
+	// cut off. From then on, no change is acknowledged.
+	failed error
+
+	// syncMutex is held while syncing, so that callers waiting for a sync share it
+	syncMutex sync.Mutex
+	// synced is the position up to which the log is on disk
+	synced uint64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+/*
+Opens the write-ahead log in a directory, creating the directory if needed. New files are
+encrypted with the keyring's current key, unless the keyring is nil.
+Call Replay before appending to it.
+*/
+func OpenWriteAheadLog(dir string, policy string, keyring *Keyring) (*WriteAheadLog, error) {
+	switch policy {
+	case WAL_FSYNC_ALWAYS, WAL_FSYNC_EVERYSEC, WAL_FSYNC_NEVER:
+	default:
+		return nil, fmt.Errorf("the fsync policy must be %q, %q or %q", WAL_FSYNC_ALWAYS, WAL_FSYNC_EVERYSEC, WAL_FSYNC_NEVER)
+	}
+
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	wal := &WriteAheadLog{dir: dir, policy: policy, keyring: keyring, stop: make(chan struct{})}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, WAL_SUFFIX) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, WAL_SUFFIX), 10, 64)
+		if err != nil {
+			continue
+		}
+		wal.files = append(wal.files, first)
+	}
+	sort.Slice(wal.files, func(i, j int) bool { return wal.files[i] < wal.files[j] })
+
+	if policy == WAL_FSYNC_EVERYSEC {
+		go wal.syncEverySecond()
+	}
+	return wal, nil
+}
+
+func (w *WriteAheadLog) path(first uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", first, WAL_SUFFIX))
+}
+
+/*
+Replay applies the changes in the log that are newer than the trie, returning how many
+it applied. A partly written record at the end of the log is cut off; a missing revision
+is an error.
+*/
+func (w *WriteAheadLog) Replay(trie *Trie) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	applied := 0
+	if len(w.files) > 0 && w.files[0] > trie.Clock+1 {
+		// The files in between were deleted along with a newer snapshot that can't be read
+		return applied, fmt.Errorf("the write-ahead log starts at revision %d, but the snapshot is at revision %d", w.files[0], trie.Clock)
+	}
+	for i, first := range w.files {
+		path := w.path(first)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return applied, err
+		}
+		w.bytes += int64(len(data))
+
+		key, offset, err := parseEncryptionHeader(data)
+		if err != nil {
+			return applied, fmt.Errorf("%s: %v", path, err)
+		}
+		if key == "" && len(data) > 0 {
+			if err := w.keyring.checkPlaintext(); err != nil {
+				return applied, fmt.Errorf("%s: %v", path, err)
+			}
+		}
+		if i == len(w.files)-1 {
+			w.currentFirst, w.currentKey = first, key
+		}
+
+		for offset < len(data) {
+			payload, size, err := readWALRecord(data[offset:])
+			if err == nil && key != "" {
+				// The checksum matched, so the record was written in full
+				if payload, err = w.keyring.open(key, payload, walAdditionalData(first, int64(offset))); err != nil {
+					return applied, fmt.Errorf("record at offset %d of %s: %v", offset, path, err)
+				}
+			}
+			var change Change
+			if err == nil {
+				change, err = decodeWALPayload(payload)
+			}
+			if err != nil {
+				if i < len(w.files)-1 || offset+size < len(data) {
+					// Only the last record can be partly written
+					return applied, fmt.Errorf("corrupt record at offset %d of %s: %v", offset, path, err)
+				}
+				logger.Warningf("dropping a partly written record at the end of %s: %v", path, err)
+				if err := os.Truncate(path, int64(offset)); err != nil {
+					return applied, err
+				}
+				w.bytes -= int64(len(data) - offset)
+				break
+			}
+			offset += size
+
+			if change.Version <= trie.Clock {
+				// The snapshot already has this change
+				continue
+			}
+			if change.Op == CHANGE_LOAD {
+				// The state after a load is only in the snapshot taken along with it
+				return applied, fmt.Errorf("%s needs the snapshot of revision %d, which is missing", path, change.Version)
+			}
+			if change.Version != trie.Clock+1 {
+				return applied, fmt.Errorf("%s skips from revision %d to %d", path, trie.Clock, change.Version)
+			}
+			if err := trie.Apply(change); err != nil {
+				return applied, fmt.Errorf("replaying %s of %q from %s: %v", change.Op, change.Key, path, err)
+			}
+			applied++
+		}
+	}
+
+	// Keep appending to the last file, unless it was encrypted differently. The first change
+	// from now on starts a new file then.
+	if len(w.files) > 0 && w.currentKey == w.currentKeyring() {
+		path := w.path(w.currentFirst)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0660)
+		if err != nil {
+			return applied, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return applied, err
+		}
+		w.current = file
+		w.currentBytes = info.Size()
+	}
+	return applied, nil
+}
+
+// Returns the id of the key new files are encrypted with, or "" if they aren't
+func (w *WriteAheadLog) currentKeyring() string {
+	if w.keyring == nil {
+		return ""
+	}
+	return w.keyring.Current()
+}
+
+/*
+Reads the record at the start of data, returning its payload and its size. If the record
+is cut off, the size reaches past the end of data.
+*/
+func readWALRecord(data []byte) ([]byte, int, error) {
+	if len(data) < WAL_RECORD_HEADER_SIZE {
+		return nil, WAL_RECORD_HEADER_SIZE, errors.New("record header is cut off")
+	}
+
+	length := int(binary.BigEndian.Uint32(data))
+	size := WAL_RECORD_HEADER_SIZE + length
+	if len(data) < size {
+		return nil, size, errors.New("record is cut off")
+	}
+
+	payload := data[WAL_RECORD_HEADER_SIZE:size]
+	if crc32.Checksum(payload, snapshotCRCTable) != binary.BigEndian.Uint32(data[4:]) {
+		return nil, size, errors.New("record checksum mismatch")
+	}
+	return payload, size, nil
+}
+
+// Decodes the change in a record's payload
+func decodeWALPayload(payload []byte) (Change, error) {
+	if len(payload) < 2 {
+		return Change{}, errors.New("record is too short")
+	}
+	op, ok := walChanges[payload[0]]
+	if !ok {
+		return Change{}, fmt.Errorf("unknown record type %d", payload[0])
+	}
+	revision, n := binary.Uvarint(payload[1:])
+	if n <= 0 {
+		return Change{}, errors.New("invalid revision")
+	}
+
+	return Change{Op: op, Key: string(payload[1+n:]), Version: revision}, nil
+}
+
+func encodeWALPayload(change Change) []byte {
+	payload := make([]byte, 0, 1+binary.MaxVarintLen64+len(change.Key))
+	payload = append(payload, walOps[change.Op])
+	payload = appendUvarint(payload, change.Version)
+	return append(payload, change.Key...)
+}
+
+func encodeWALRecord(payload []byte) []byte {
+	record := make([]byte, 0, WAL_RECORD_HEADER_SIZE+len(payload))
+	record = appendUint32(record, uint32(len(payload)))
+	record = appendUint32(record, crc32.Checksum(payload, snapshotCRCTable))
+	return append(record, payload...)
+}
+
+/*
+Append writes a change to the log, before it is made. It doesn't wait for the change to
+reach the disk; Commit does. If the change can't be written, whatever part of it was
+written is cut off again, so the change can be refused and the log stays usable.
+*/
+func (w *WriteAheadLog) Append(change Change) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.failed != nil {
+		return w.failedError()
+	}
+
+	if w.current == nil {
+		if err := w.startFile(change.Version); err != nil {
+			return err
+		}
+	}
+
+	payload := encodeWALPayload(change)
+	if w.currentKey != "" {
+		payload = w.keyring.seal(w.currentKey, payload, walAdditionalData(w.currentFirst, w.currentBytes))
+	}
+	record := encodeWALRecord(payload)
+	if _, err := w.current.Write(record); err != nil {
+		if truncateErr := w.current.Truncate(w.currentBytes); truncateErr != nil {
+			// The partial record would end the log when it is replayed, hiding later records
+			w.failed = truncateErr
+		}
+		return err
+	}
+	w.position++
+	w.lastRecord = int64(len(record))
+	w.bytes += int64(len(record))
+	w.currentBytes += int64(len(record))
+	return nil
+}
+
+/*
+Unappend removes the last record appended, which must not have been synced yet, for a
+change that was refused after all.
+*/
+func (w *WriteAheadLog) Unappend() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.failed != nil {
+		return w.failedError()
+	}
+
+	if err := w.current.Truncate(w.currentBytes - w.lastRecord); err != nil {
+		w.failed = err
+		return w.failedError()
+	}
+	w.position--
+	w.bytes -= w.lastRecord
+	w.currentBytes -= w.lastRecord
+	w.lastRecord = 0
+	return nil
+}
+
+/*
+Starts a new log file whose first record has the given revision.
+The caller must hold the mutex.
+*/
+func (w *WriteAheadLog) startFile(first uint64) error {
+	path := w.path(first)
+	// A file with the same name can only hold changes from before the revision it is named
+	// after if it is empty, so it is started over
+	if info, err := os.Stat(path); err == nil {
+		w.bytes -= info.Size()
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0660)
+	if err != nil {
+		return err
+	}
+
+	key := w.currentKeyring()
+	var header []byte
+	if key != "" {
+		header = encryptionHeader(key)
+		// Synced at once, so that a crash can't leave a partly written header behind
+		if _, err := file.Write(header); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := syncDir(w.dir); err != nil {
+		file.Close()
+		return err
+	}
+
+	if w.current != nil {
+		if w.policy == WAL_FSYNC_NEVER {
+			w.current.Close()
+		} else {
+			// Nothing in the old file may be left unsynced once it is closed
+			w.retired = append(w.retired, w.current)
+		}
+	}
+	w.current = file
+	w.currentFirst = first
+	w.currentBytes = int64(len(header))
+	w.currentKey = key
+	w.bytes += int64(len(header))
+	if len(w.files) == 0 || w.files[len(w.files)-1] != first {
+		w.files = append(w.files, first)
+	}
+	return nil
+}
+
+/*
+Rotate starts a new file, whose first record will have the given revision. The changes
+up to that revision can then be saved in a snapshot, and the files before the new one
+deleted with RemoveBefore. The current file is synced by the next sync (see Commit),
+rather than while the caller waits.
+*/
+func (w *WriteAheadLog) Rotate(first uint64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.failed != nil {
+		return w.failed
+	}
+	return w.startFile(first)
+}
+
+/*
+RemoveBefore deletes the files older than the one starting at the given revision,
+returning how many it deleted.
+*/
+func (w *WriteAheadLog) RemoveBefore(first uint64) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	removed := 0
+	for len(w.files) > 1 && w.files[0] < first {
+		path := w.path(w.files[0])
+		info, err := os.Stat(path)
+		if err != nil {
+			return removed, err
+		}
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		w.bytes -= info.Size()
+		w.files = w.files[1:]
+		removed++
+	}
+	return removed, nil
+}
+
+/*
+Size returns the total size of the log files, and how many there are.
+*/
+func (w *WriteAheadLog) Size() (int64, int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.bytes, len(w.files)
+}
+
+/*
+Position returns the number of records appended so far. Pass it to Commit to wait for
+everything appended up to now.
+*/
+func (w *WriteAheadLog) Position() uint64 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.position
+}
+
+/*
+Commit waits until the log is as durable up to a position as the fsync policy asks for,
+and fails if it can't be.
+*/
+func (w *WriteAheadLog) Commit(position uint64) error {
+	if w.policy == WAL_FSYNC_ALWAYS {
+		w.syncMutex.Lock()
+		defer w.syncMutex.Unlock()
+
+		// Another caller's sync may have covered this position while we waited
+		if w.synced < position {
+			w.sync()
+		}
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.failed != nil {
+		return w.failedError()
+	}
+	return nil
+}
+
+// The caller must hold the mutex
+func (w *WriteAheadLog) failedError() error {
+	return &CodedError{
+		Code:    ERR_CODE_INTERNAL,
+		Message: fmt.Sprintf("the write-ahead log failed, so changes can't be made durable: %v", w.failed),
+	}
+}
+
+/*
+Syncs everything appended so far. The caller must hold syncMutex.
+*/
+func (w *WriteAheadLog) sync() {
+	w.mutex.Lock()
+	position := w.position
+	file := w.current
+	retired := w.retired
+	w.retired = nil
+	w.mutex.Unlock()
+
+	// Appends go on while the files sync; they wait for the next sync
+	var err error
+	for _, old := range retired {
+		if w.synced < position {
+			if syncErr := old.Sync(); syncErr != nil && err == nil {
+				err = syncErr
+			}
+		}
+		old.Close()
+	}
+	if err == nil && file != nil && w.synced < position {
+		err = file.Sync()
+	}
+	if err != nil {
+		w.mutex.Lock()
+		if w.failed == nil {
+			w.failed = err
+		}
+		w.mutex.Unlock()
+		return
+	}
+	w.synced = position
+}
+
+func (w *WriteAheadLog) syncEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.syncMutex.Lock()
+			w.sync()
+			w.syncMutex.Unlock()
+		}
+	}
+}
+
+/*
+Close syncs the log and closes it.
+*/
+func (w *WriteAheadLog) Close() error {
+	w.stopOnce.Do(func() { close(w.stop) })
+
+	w.syncMutex.Lock()
+	defer w.syncMutex.Unlock()
+	if w.policy != WAL_FSYNC_NEVER {
+		w.sync()
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.current == nil {
+		return w.failed
+	}
+	err := w.current.Close()
+	w.current = nil
+	if w.failed != nil {
+		return w.failed
+	}
+	return err
+}
+
+/*
+UseWriteAheadLog replays a log on top of the trie, then records every change in it from
+now on. It must be called after UseSnapshots and before UseChangelog.
+*/
+func (s *ThreadSafeDispatcher) UseWriteAheadLog(wal *WriteAheadLog) error {
+	s.dispatcherMutex.Lock()
+	defer s.dispatcherMutex.Unlock()
+
+	start := s.trie.Clock
+	applied, err := wal.Replay(s.trie)
+	if err != nil {
+		return err
+	}
+	if applied > 0 {
+		logger.Infof("replayed %d changes to namespace %s from revision %d to %d", applied, s.name, start, s.trie.Clock)
+	}
+
+	s.wal = wal
+	return nil
+}
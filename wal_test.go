@@ -0,0 +1,344 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// Opens the write-ahead log in a directory, replaying it onto a trie
+func openTestWAL(t *testing.T, dir string, policy string, keyring *Keyring, trie *Trie) (*WriteAheadLog, int, error) {
+	t.Helper()
+
+	wal, err := OpenWriteAheadLog(dir, policy, keyring)
+	if err != nil {
+		t.Fatalf("OpenWriteAheadLog: %v", err)
+	}
+	applied, err := wal.Replay(trie)
+	return wal, applied, err
+}
+
+// Appends an insert of each key, at the revisions after `clock`
+func appendTestChanges(t *testing.T, wal *WriteAheadLog, clock uint64, keys ...string) {
+	t.Helper()
+
+	for i, key := range keys {
+		if err := wal.Append(Change{Op: CHANGE_INSERT, Key: key, Version: clock + uint64(i) + 1}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+}
+
+func TestWriteAheadLogReplay(t *testing.T) {
+	dir := t.TempDir()
+	wal, _, err := openTestWAL(t, dir, WAL_FSYNC_ALWAYS, nil, NewTrie())
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	appendTestChanges(t, wal, 0, "apple", "banana", "cherry")
+	if err := wal.Rotate(4); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	appendTestChanges(t, wal, 3, "date")
+	if err := wal.Append(Change{Op: CHANGE_DELETE, Key: "banana", Version: 5}); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if err := wal.Commit(wal.Position()); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// A snapshot taken at revision 3, which the first file is already in
+	snapshot := NewTrie()
+	for _, key := range []string{"apple", "banana", "cherry"} {
+		snapshot.Add(key)
+	}
+
+	tests := []struct {
+		name        string
+		trie        *Trie
+		wantApplied int
+	}{
+		{name: "from scratch", trie: NewTrie(), wantApplied: 5},
+		{name: "from a snapshot", trie: snapshot, wantApplied: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wal, applied, err := openTestWAL(t, dir, WAL_FSYNC_ALWAYS, nil, test.trie)
+			if err != nil {
+				t.Fatalf("Replay: %v", err)
+			}
+			defer wal.Close()
+
+			if applied != test.wantApplied {
+				t.Errorf("Replay applied %d changes, want %d", applied, test.wantApplied)
+			}
+			if test.trie.Clock != 5 {
+				t.Errorf("clock is %d, want 5", test.trie.Clock)
+			}
+			if want := []string{"apple", "cherry", "date"}; !reflect.DeepEqual(test.trie.Keys(), want) {
+				t.Errorf("keys are %v, want %v", test.trie.Keys(), want)
+			}
+		})
+	}
+}
+
+func TestWriteAheadLogReplayTruncated(t *testing.T) {
+	dir := t.TempDir()
+	wal, _, err := openTestWAL(t, dir, WAL_FSYNC_NEVER, nil, NewTrie())
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	appendTestChanges(t, wal, 0, "apple", "banana")
+	path := wal.path(1)
+	wal.Close()
+
+	// The last record was only partly written when the server stopped
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+
+	trie := NewTrie()
+	wal, applied, err := openTestWAL(t, dir, WAL_FSYNC_NEVER, nil, trie)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if applied != 1 || trie.Clock != 1 {
+		t.Errorf("Replay applied %d changes up to revision %d, want 1 up to 1", applied, trie.Clock)
+	}
+
+	// The partial record is cut off, so that the changes after it can be replayed
+	appendTestChanges(t, wal, 1, "cherry")
+	wal.Close()
+
+	trie = NewTrie()
+	wal, applied, err = openTestWAL(t, dir, WAL_FSYNC_NEVER, nil, trie)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	defer wal.Close()
+	if want := []string{"apple", "cherry"}; applied != 2 || !reflect.DeepEqual(trie.Keys(), want) {
+		t.Errorf("Replay applied %d changes with keys %v, want 2 with %v", applied, trie.Keys(), want)
+	}
+}
+
+func TestWriteAheadLogReplayErrors(t *testing.T) {
+	record := len(encodeWALRecord(encodeWALPayload(Change{Op: CHANGE_INSERT, Key: "apple", Version: 1})))
+
+	tests := []struct {
+		name string
+		// write writes the log, starting with an empty one
+		write func(t *testing.T, wal *WriteAheadLog)
+		// damage changes the log's files after they are written, if set
+		damage func(t *testing.T, wal *WriteAheadLog)
+	}{
+		{
+			name: "corrupt record before the last",
+			write: func(t *testing.T, wal *WriteAheadLog) {
+				appendTestChanges(t, wal, 0, "apple", "berry")
+			},
+			damage: func(t *testing.T, wal *WriteAheadLog) {
+				flipByte(t, wal.path(1), int64(record-1))
+			},
+		},
+		{
+			name: "partly written record in an older file",
+			write: func(t *testing.T, wal *WriteAheadLog) {
+				appendTestChanges(t, wal, 0, "apple", "berry")
+				if err := wal.Rotate(3); err != nil {
+					t.Fatalf("Rotate: %v", err)
+				}
+				appendTestChanges(t, wal, 2, "cherry")
+			},
+			damage: func(t *testing.T, wal *WriteAheadLog) {
+				if err := os.Truncate(wal.path(1), int64(2*record-1)); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "revision gap",
+			write: func(t *testing.T, wal *WriteAheadLog) {
+				appendTestChanges(t, wal, 0, "apple")
+				appendTestChanges(t, wal, 2, "cherry")
+			},
+		},
+		{
+			name: "log starting after the snapshot",
+			write: func(t *testing.T, wal *WriteAheadLog) {
+				appendTestChanges(t, wal, 4, "apple")
+			},
+		},
+		{
+			name: "load without its snapshot",
+			write: func(t *testing.T, wal *WriteAheadLog) {
+				appendTestChanges(t, wal, 0, "apple")
+				if err := wal.Append(Change{Op: CHANGE_LOAD, Version: 2}); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			wal, _, err := openTestWAL(t, dir, WAL_FSYNC_NEVER, nil, NewTrie())
+			if err != nil {
+				t.Fatalf("Replay: %v", err)
+			}
+			test.write(t, wal)
+			wal.Close()
+			if test.damage != nil {
+				test.damage(t, wal)
+			}
+
+			wal, _, err = openTestWAL(t, dir, WAL_FSYNC_NEVER, nil, NewTrie())
+			defer wal.Close()
+			if err == nil {
+				t.Fatal("Replay succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestWriteAheadLogGroupCommit(t *testing.T) {
+	const writers = 8
+	const changes = 50
+
+	dir := t.TempDir()
+	wal, _, err := openTestWAL(t, dir, WAL_FSYNC_ALWAYS, nil, NewTrie())
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+
+	// Like the dispatcher, changes are appended one at a time and committed concurrently
+	var appendMutex sync.Mutex
+	var clock uint64
+	var wait sync.WaitGroup
+	errs := make(chan error, writers*changes)
+	for i := 0; i < writers; i++ {
+		wait.Add(1)
+		go func(writer int) {
+			defer wait.Done()
+			for j := 0; j < changes; j++ {
+				appendMutex.Lock()
+				clock++
+				err := wal.Append(Change{Op: CHANGE_INSERT, Key: fmt.Sprintf("key%d-%d", writer, j), Version: clock})
+				position := wal.Position()
+				appendMutex.Unlock()
+
+				if err == nil {
+					err = wal.Commit(position)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				wal.syncMutex.Lock()
+				synced := wal.synced
+				wal.syncMutex.Unlock()
+				if synced < position {
+					errs <- fmt.Errorf("Commit(%d) returned with the log synced up to %d", position, synced)
+					return
+				}
+			}
+		}(i)
+	}
+	wait.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	trie := NewTrie()
+	wal, applied, err := openTestWAL(t, dir, WAL_FSYNC_ALWAYS, nil, trie)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	defer wal.Close()
+	if applied != writers*changes || trie.Size() != writers*changes {
+		t.Errorf("Replay applied %d changes and has %d keys, want %d", applied, trie.Size(), writers*changes)
+	}
+}
+
+func TestWriteAheadLogRotate(t *testing.T) {
+	tests := []struct {
+		policy      string
+		wantRetired int
+	}{
+		{policy: WAL_FSYNC_ALWAYS, wantRetired: 1},
+		{policy: WAL_FSYNC_EVERYSEC, wantRetired: 1},
+		{policy: WAL_FSYNC_NEVER, wantRetired: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			dir := t.TempDir()
+			wal, _, err := openTestWAL(t, dir, test.policy, nil, NewTrie())
+			if err != nil {
+				t.Fatalf("Replay: %v", err)
+			}
+			defer wal.Close()
+
+			appendTestChanges(t, wal, 0, "apple", "banana")
+			if err := wal.Rotate(3); err != nil {
+				t.Fatalf("Rotate: %v", err)
+			}
+			appendTestChanges(t, wal, 2, "cherry")
+
+			wal.mutex.Lock()
+			retired := len(wal.retired)
+			wal.mutex.Unlock()
+			if retired != test.wantRetired {
+				t.Errorf("%d files are waiting to be synced after Rotate, want %d", retired, test.wantRetired)
+			}
+
+			// The next sync syncs and closes the old file
+			wal.syncMutex.Lock()
+			wal.sync()
+			wal.syncMutex.Unlock()
+			wal.mutex.Lock()
+			retired = len(wal.retired)
+			wal.mutex.Unlock()
+			if retired != 0 {
+				t.Errorf("%d files are still waiting to be synced after a sync", retired)
+			}
+
+			if removed, err := wal.RemoveBefore(3); err != nil || removed != 1 {
+				t.Errorf("RemoveBefore removed %d files (%v), want 1", removed, err)
+			}
+			if _, files := wal.Size(); files != 1 {
+				t.Errorf("the log has %d files, want 1", files)
+			}
+		})
+	}
+}
+
+// Flips the bits of the byte at an offset of a file
+func flipByte(t *testing.T, path string, offset int64) {
+	t.Helper()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[offset] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0660); err != nil {
+		t.Fatal(err)
+	}
+}
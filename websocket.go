@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/google/logger"
+	"github.com/gorilla/websocket"
+)
+
+// Maximum number of read commands a single connection may have in flight at once
+const MAX_PIPELINED_REQUESTS = 32
+
+/*
+A wsSession serves the messages of a single WebSocket connection.
+
+Clients may tag a message with a request ID, which is echoed in the response so that
+pipelined requests can be matched with their replies. Legacy messages carry the ID as a
+"#[ID] " prefix, which is repeated in front of the "s"/"e" response:
+
+	#42 2foo  -->  #42 strue
+
+Version 2 messages carry the ID in the envelope's "id" field instead.
+
+Read-only commands with a request ID run concurrently, so their responses may arrive out
+of order. Every other message waits for the reads before it to finish and runs on its own,
+so a client that doesn't use IDs sees its messages answered strictly in order.
+
+Sessions can also subscribe to changes, with the version 2 ops "subscribe" and "unsubscribe":
+
+	{"id": 1, "op": "subscribe", "args": {"prefixes": ["fo"], "buffer": 100}}
+	{"v": 2, "id": 1, "ok": true, "result": {"subscription": 1}}
+
+Matching changes are then pushed as events, and if the client falls more than `buffer`
+changes behind, it gets an overflow event saying how many changes it missed:
+
+	{"v": 2, "event": {"subscription": 1, "op": "insert", "key": "foo", "version": 7}}
+	{"v": 2, "event": {"subscription": 1, "op": "overflow", "version": 9, "dropped": 12}}
+
+	{"id": 2, "op": "unsubscribe", "args": {"subscription": 1}}
+*/
+type wsSession struct {
+	server *Server
+	conn   *websocket.Conn
+	// token is the token the connection was opened with (nil if authentication is disabled)
+	token *Token
+	// writeMutex serializes writes to the connection, which may come from several goroutines
+	writeMutex sync.Mutex
+	// inFlight tracks the concurrently running read commands
+	inFlight sync.WaitGroup
+	// slots bounds the number of concurrently running read commands
+	slots chan struct{}
+	// subscriptions are the session's change subscriptions, by id.
+	// Only the goroutine running serve touches this map.
+	subscriptions      map[int]*Subscription
+	nextSubscriptionID int
+	// forwarders tracks the goroutines pushing subscription events
+	forwarders sync.WaitGroup
+}
+
+func newWSSession(server *Server, conn *websocket.Conn, token *Token) *wsSession {
+	return &wsSession{
+		server:        server,
+		conn:          conn,
+		token:         token,
+		slots:         make(chan struct{}, MAX_PIPELINED_REQUESTS),
+		subscriptions: make(map[int]*Subscription),
+	}
+}
+
+/*
+Reads messages until the connection closes, then waits for outstanding reads
+and subscription forwarders to finish.
+*/
+func (c *wsSession) serve() {
+	defer c.forwarders.Wait()
+	defer c.closeSubscriptions()
+	defer c.inFlight.Wait()
+
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			logger.Errorf("Error reading message: %v", err)
+			return
+		}
+
+		logger.Infof("Received message: %s", message)
+
+		requestID, body := splitRequestID(message)
+
+		if c.handleSubscriptionOp(body) {
+			continue
+		}
+
+		if !c.canRunConcurrently(requestID, body) {
+			// Keep the order of responses for everything that isn't an independent read
+			c.inFlight.Wait()
+			c.handle(requestID, body)
+			continue
+		}
+
+		c.slots <- struct{}{}
+		c.inFlight.Add(1)
+		go func() {
+			defer c.inFlight.Done()
+			defer func() { <-c.slots }()
+
+			c.handle(requestID, body)
+		}()
+	}
+}
+
+/*
+Returns whether a message is a read that the client can tell apart from other responses.
+*/
+func (c *wsSession) canRunConcurrently(requestID []byte, message []byte) bool {
+	command, ok := c.server.trieDispatcher.LookupMessageCommand(message)
+	if !ok || !command.ReadOnly {
+		return false
+	}
+
+	if IsV2Message(message) {
+		var request V2Request
+		return json.Unmarshal(message, &request) == nil && len(request.ID) > 0
+	}
+
+	return requestID != nil
+}
+
+/*
+Processes a single message and writes its response.
+*/
+func (c *wsSession) handle(requestID []byte, message []byte) {
+	// Dispatch the message to the trie. This accepts a string
+	// and returns a string as a response.
+	response, err := c.server.ProcessAs(c.token, message)
+	if err != nil {
+		logger.Errorf("Error handling message: %v", err)
+	}
+
+	frame := frameResponse(message, response, err)
+	if requestID != nil {
+		frame = append([]byte("#"+string(requestID)+" "), frame...)
+	}
+
+	c.write(frame)
+}
+
+/*
+Writes a text frame to the connection (thread-safe).
+*/
+func (c *wsSession) write(frame []byte) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if err := c.conn.WriteMessage(WS_MESSAGE_TYPE_TEXT, frame); err != nil {
+		logger.Errorf("Error writing message: %v", err)
+	}
+}
+
+/*
+Splits a legacy message of the form "#[ID] [MESSAGE]" into its request ID and message.
+Messages without the prefix have a nil request ID.
+*/
+func splitRequestID(message []byte) ([]byte, []byte) {
+	if len(message) == 0 || message[0] != '#' {
+		return nil, message
+	}
+
+	separator := bytes.IndexByte(message, ' ')
+	if separator < 0 {
+		return nil, message
+	}
+
+	return message[1:separator], message[separator+1:]
+}
+
+// Arguments of the subscribe op
+type subscribeArgs struct {
+	Prefixes []string `json:"prefixes"`
+	Buffer   int      `json:"buffer"`
+}
+
+// Arguments of the unsubscribe op
+type unsubscribeArgs struct {
+	Subscription int `json:"subscription"`
+}
+
+// SubscribeResult identifies a new subscription
+type SubscribeResult struct {
+	Subscription int `json:"subscription"`
+}
+
+// SubscriptionEvent is a change pushed to a subscriber
+type SubscriptionEvent struct {
+	Subscription int    `json:"subscription"`
+	Op           string `json:"op"`
+	Key          string `json:"key,omitempty"`
+	Version      uint64 `json:"version"`
+	// Dropped is the number of changes missed, for overflow events
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// The envelope of a pushed event
+type wsEventEnvelope struct {
+	Version int               `json:"v"`
+	Event   SubscriptionEvent `json:"event"`
+}
+
+/*
+Handles the subscribe and unsubscribe ops, which belong to the session rather than
+the dispatcher. It returns false if the message is anything else.
+*/
+func (c *wsSession) handleSubscriptionOp(message []byte) bool {
+	if !IsV2Message(message) {
+		return false
+	}
+
+	var request V2Request
+	if err := json.Unmarshal(message, &request); err != nil {
+		return false
+	}
+
+	var result interface{}
+	var err error
+	switch request.Op {
+	case "subscribe":
+		result, err = c.subscribe(&request)
+	case "unsubscribe":
+		result, err = c.unsubscribe(request.Args)
+	default:
+		return false
+	}
+
+	if err != nil {
+		logger.Errorf("Error handling message: %v", err)
+	}
+
+	c.write(encodeV2Response(request.ID, result, err))
+	return true
+}
+
+func (c *wsSession) subscribe(request *V2Request) (interface{}, error) {
+	var args subscribeArgs
+	if err := decodeV2Args(request.Args, &args); err != nil {
+		return nil, err
+	}
+	if len(args.Prefixes) == 0 {
+		return nil, &CodedError{Code: ERR_CODE_INVALID, Message: "subscribe needs at least one prefix"}
+	}
+	if args.Buffer < 0 || args.Buffer > MAX_SUBSCRIPTION_BUFFER_SIZE {
+		return nil, &CodedError{
+			Code:    ERR_CODE_INVALID,
+			Message: fmt.Sprintf("buffer must be between 0 and %d", MAX_SUBSCRIPTION_BUFFER_SIZE),
+		}
+	}
+
+	// Subscriptions follow the namespace named in the envelope, like other requests
+	dispatcher, err := c.server.namespaces.Get(request.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.token.AuthorizeSubscription(dispatcher, args.Prefixes); err != nil {
+		return nil, err
+	}
+
+	c.nextSubscriptionID++
+	id := c.nextSubscriptionID
+
+	subscription := dispatcher.Changes().Subscribe(args.Prefixes, args.Buffer)
+	c.subscriptions[id] = subscription
+
+	logger.Infof("subscribed to %v as subscription %d", args.Prefixes, id)
+
+	c.forwarders.Add(1)
+	go c.forward(id, subscription)
+
+	return SubscribeResult{Subscription: id}, nil
+}
+
+func (c *wsSession) unsubscribe(raw json.RawMessage) (interface{}, error) {
+	var args unsubscribeArgs
+	if err := decodeV2Args(raw, &args); err != nil {
+		return nil, err
+	}
+
+	subscription, ok := c.subscriptions[args.Subscription]
+	if !ok {
+		return nil, &CodedError{Code: ERR_CODE_NOT_FOUND, Message: fmt.Sprintf("no subscription %d", args.Subscription)}
+	}
+
+	subscription.Close()
+	delete(c.subscriptions, args.Subscription)
+	return true, nil
+}
+
+/*
+Pushes a subscription's changes to the client until the subscription is closed.
+*/
+func (c *wsSession) forward(id int, subscription *Subscription) {
+	defer c.forwarders.Done()
+
+	for change := range subscription.Events() {
+		event := SubscriptionEvent{Subscription: id, Op: change.Op, Key: change.Key, Version: change.Version}
+		if change.Op == CHANGE_OVERFLOW {
+			event.Dropped = subscription.Resume()
+		}
+
+		// An event made of strings and numbers always encodes
+		encoded, _ := json.Marshal(wsEventEnvelope{Version: PROTOCOL_VERSION_V2, Event: event})
+		c.write(encoded)
+	}
+}
+
+func (c *wsSession) closeSubscriptions() {
+	for id, subscription := range c.subscriptions {
+		subscription.Close()
+		delete(c.subscriptions, id)
+	}
+}